@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// The admin API changes how a node gossips while it runs, and acts on the
+// whole cluster, so it is served apart from the read-only status API, and
+// should only listen on a loopback or otherwise trusted address. Keys are
+// rotated by calling it on each node, and saved in the state file. Nodes
+// without a state file go back to the keys in their config file when they
+// restart, so the config file must be changed too. Payloads are base64.
+//
+//	GET  /keyring          lists the installed keys by ID, primary first
+//	POST /keyring/install  {"key": "<base64>"}
+//	POST /keyring/use      {"key": "<base64>"}
+//	POST /keyring/remove   {"key": "<base64>"}
+//	POST /config/set       {"key": "...", "value": "..."}
+//	POST /config/delete    {"key": "..."}
+//	POST /events           {"name": "...", "payload": "<base64>"}
+//	POST /queries          {"name": "...", "payload": "<base64>", "tags": {...}, "timeout": "5s"}
+
+type KeyringStatus struct {
+	Encrypted    bool     `json:"encrypted"`
+	PrimaryKeyID string   `json:"primary_key_id,omitempty"`
+	KeyIDs       []string `json:"key_ids"`
+	// Set if key changes won't survive this node restarting
+	Warning string `json:"warning,omitempty"`
+}
+
+type keyRequest struct {
+	Key string `json:"key"`
+}
+
+type configRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type userEventRequest struct {
+	Name    string `json:"name"`
+	Payload []byte `json:"payload"`
+}
+
+type queryAdminRequest struct {
+	Name    string            `json:"name"`
+	Payload []byte            `json:"payload"`
+	Tags    map[string]string `json:"tags"`
+	Timeout string            `json:"timeout"`
+}
+
+func keyringStatus(g *Gossip, keyring *Keyring) KeyringStatus {
+	if keyring == nil {
+		return KeyringStatus{KeyIDs: []string{}}
+	}
+	keyIDs := keyring.KeyIDs()
+	status := KeyringStatus{
+		Encrypted:    true,
+		PrimaryKeyID: keyIDs[0],
+		KeyIDs:       keyIDs,
+	}
+	if g.StateFile == "" {
+		status.Warning = "keys aren't saved without a state file, so change encryption_keys in the config file too, or this node will restart with its old keys"
+	}
+	return status
+}
+
+// NewAdminHandler serves the admin API. Gossip is unencrypted if the keyring
+// is nil, in which case keys can't be changed.
+func NewAdminHandler(g *Gossip, keyring *Keyring) http.Handler {
+	mux := http.NewServeMux()
+	for action, change := range map[string]func(request configRequest) (ConfigEntry, error){
+		"set": func(request configRequest) (ConfigEntry, error) {
+			return g.SetConfig(request.Key, request.Value)
+		},
+		"delete": func(request configRequest) (ConfigEntry, error) {
+			return g.DeleteConfig(request.Key)
+		},
+	} {
+		change := change
+		mux.HandleFunc("/config/"+action, adminEndpoint(func(requestBytes []byte) (int, interface{}) {
+			var request configRequest
+			if err := json.Unmarshal(requestBytes, &request); err != nil {
+				return http.StatusBadRequest, adminError(fmt.Sprintf("error deserialising request: %s", err))
+			}
+			entry, err := change(request)
+			if err != nil {
+				return http.StatusBadRequest, adminError(err.Error())
+			}
+			return http.StatusOK, entry
+		}))
+	}
+	mux.HandleFunc("/events", adminEndpoint(func(requestBytes []byte) (int, interface{}) {
+		var request userEventRequest
+		if err := json.Unmarshal(requestBytes, &request); err != nil {
+			return http.StatusBadRequest, adminError(fmt.Sprintf("error deserialising request: %s", err))
+		}
+		if err := g.UserEvent(request.Name, request.Payload); err != nil {
+			return http.StatusBadRequest, adminError(err.Error())
+		}
+		return http.StatusOK, request
+	}))
+	mux.HandleFunc("/queries", adminEndpoint(func(requestBytes []byte) (int, interface{}) {
+		var request queryAdminRequest
+		if err := json.Unmarshal(requestBytes, &request); err != nil {
+			return http.StatusBadRequest, adminError(fmt.Sprintf("error deserialising request: %s", err))
+		}
+		params := QueryParams{Tags: request.Tags}
+		if request.Timeout != "" {
+			timeout, err := time.ParseDuration(request.Timeout)
+			if err != nil {
+				return http.StatusBadRequest, adminError(fmt.Sprintf("error parsing timeout: %s", err))
+			}
+			if timeout > maxQueryTimeout {
+				return http.StatusBadRequest, adminError(fmt.Sprintf("timeout must be at most %s", maxQueryTimeout))
+			}
+			params.Timeout = timeout
+		}
+		result, err := g.Query(request.Name, request.Payload, params)
+		if err != nil {
+			return http.StatusBadRequest, adminError(err.Error())
+		}
+		return http.StatusOK, result
+	}))
+	mux.HandleFunc("/keyring", statusEndpoint(func() (int, interface{}) {
+		return http.StatusOK, keyringStatus(g, keyring)
+	}))
+	for action, change := range map[string]func(*Keyring, []byte) error{
+		"install": (*Keyring).Install,
+		"use":     (*Keyring).Use,
+		"remove":  (*Keyring).Remove,
+	} {
+		action, change := action, change
+		mux.HandleFunc("/keyring/"+action, adminEndpoint(func(requestBytes []byte) (int, interface{}) {
+			if keyring == nil {
+				return http.StatusConflict, adminError("gossip is not encrypted, so there are no keys to change")
+			}
+			var request keyRequest
+			if err := json.Unmarshal(requestBytes, &request); err != nil {
+				return http.StatusBadRequest, adminError(fmt.Sprintf("error deserialising request: %s", err))
+			}
+			key, err := ParseKey(request.Key)
+			if err != nil {
+				return http.StatusBadRequest, adminError(err.Error())
+			}
+			if err = change(keyring, key); err != nil {
+				return http.StatusConflict, adminError(err.Error())
+			}
+			infoLog.Printf("keyring: %s key %s\n", action, KeyID(key))
+			if err = g.SaveState(); err != nil {
+				errorLog.Println(err)
+				return http.StatusInternalServerError, adminError(fmt.Sprintf("key %s was changed, but won't survive restarting: %s", KeyID(key), err))
+			}
+			return http.StatusOK, keyringStatus(g, keyring)
+		}))
+	}
+	return mux
+}
+
+type adminErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func adminError(message string) adminErrorResponse {
+	return adminErrorResponse{Error: message}
+}
+
+func adminEndpoint(change func(requestBytes []byte) (int, interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		requestBytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, "error reading request", http.StatusBadRequest)
+			return
+		}
+		statusCode, body := change(requestBytes)
+		responseBytes, err := json.MarshalIndent(body, "", "  ")
+		if err != nil {
+			errorLog.Println(fmt.Errorf("error serialising admin response: %w", err))
+			http.Error(w, "error serialising response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		w.Write(append(responseBytes, '\n'))
+	}
+}
+
+// ServeAdmin serves the admin API until the context is cancelled
+func ServeAdmin(ctx context.Context, g *Gossip, keyring *Keyring, listenAddress string) error {
+	server := &http.Server{
+		Addr:        listenAddress,
+		Handler:     NewAdminHandler(g, keyring),
+		ReadTimeout: 10 * time.Second,
+		// Long enough to wait for query responses
+		WriteTimeout: time.Minute,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("error serving admin API: %w", err)
+	}
+	return nil
+}
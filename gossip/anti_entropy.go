@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Piggybacked updates are only retransmitted a limited number of times, so a
+// node that was partitioned or restarted can miss them. Every PushPullInterval
+// each node swaps its full membership list with one random node, and both
+// merge what they receive using the usual incarnation and state precedence.
+// They also swap their whole cluster config.
+
+func pushPullPeriodically(ctx context.Context, g *Gossip) {
+	ticker := time.NewTicker(g.PushPullInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		g.pushPullRound()
+	}
+}
+
+func (g *Gossip) pushPullRound() {
+	targets := g.randomNodes(1, g.Node.ID)
+	if len(targets) == 0 {
+		return
+	}
+	if err := g.pushPull(targets[0]); err != nil {
+		debugLog.Println(err)
+	}
+}
+
+func (g *Gossip) pushPull(target NodeDescription) error {
+	message := newGossipMessage(g, pushPullMessage)
+	message.Members = g.members()
+	g.Lock()
+	message.Reachability = g.reachabilityReports()
+	message.Config = g.configEntries()
+	g.Unlock()
+	reply, err := g.sendGossipMessage(message, target.RemoteAddress, g.GossipRegularity)
+	if err != nil {
+		return fmt.Errorf("error exchanging state with node '%s': %w", target.ID, err)
+	}
+	g.applyReply(reply)
+	if reply.NodeID == target.ID {
+		g.markAlive(reply.NodeID, reply.Incarnation)
+	}
+	g.applyMembershipUpdates(reply.Members)
+	g.Lock()
+	g.joined = true
+	g.Unlock()
+	debugLog.Printf("exchanged state with node '%s', received %d members\n", target.ID, len(reply.Members))
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Compare the cost of a gossip round trip over each transport, on loopback,
+// with go test -bench Transport. Each round is a ping carrying a typical
+// number of piggybacked updates, and an ack carrying the same number back.
+
+func BenchmarkHTTPTransport(b *testing.B) {
+	benchmarkTransport(b, func() (Transport, string, error) {
+		transport, err := NewHTTPTransport("127.0.0.1:0", nil, time.Second)
+		if err != nil {
+			return nil, "", err
+		}
+		return transport, transport.ListenAddress, nil
+	})
+}
+
+func BenchmarkUDPTransport(b *testing.B) {
+	benchmarkTransport(b, func() (Transport, string, error) {
+		transport, err := NewUDPTransport("127.0.0.1:0", time.Second)
+		if err != nil {
+			return nil, "", err
+		}
+		return transport, transport.ListenAddress, nil
+	})
+}
+
+func BenchmarkEncryptedUDPTransport(b *testing.B) {
+	benchmarkTransport(b, func() (Transport, string, error) {
+		transport, err := NewUDPTransport("127.0.0.1:0", time.Second)
+		if err != nil {
+			return nil, "", err
+		}
+		transport.Keyring, err = NewKeyring(make([]byte, 32))
+		if err != nil {
+			return nil, "", err
+		}
+		return transport, transport.ListenAddress, nil
+	})
+}
+
+// Reports the bytes sent and received per round as well as time and
+// allocations
+func benchmarkTransport(b *testing.B, newTransport func() (Transport, string, error)) {
+	sender, _, err := newTransport()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, receiverAddress, err := newTransport()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer receiver.Close()
+
+	updates := benchmarkMembershipUpdates(5)
+	coordinate := newCoordinate()
+	go sender.Serve(func(*gossipMessage) (*gossipReply, error) {
+		return nil, fmt.Errorf("sender does not expect messages")
+	})
+	go receiver.Serve(func(message *gossipMessage) (*gossipReply, error) {
+		return &gossipReply{
+			NodeID:      "receiver",
+			Incarnation: 1,
+			Timestamp:   time.Now(),
+			Ack:         true,
+			Updates:     updates,
+			Coordinate:  &coordinate,
+		}, nil
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	before := sender.Stats()
+	for i := 0; i < b.N; i++ {
+		message := &gossipMessage{
+			Kind:          pingMessage,
+			NodeID:        "sender",
+			RemoteAddress: "127.0.0.1:1",
+			Incarnation:   1,
+			Timestamp:     time.Now(),
+			Updates:       updates,
+			Coordinate:    &coordinate,
+		}
+		if _, err := sender.Send(receiverAddress, message, time.Second); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	after := sender.Stats()
+	bytes := after.BytesSent - before.BytesSent + after.BytesReceived - before.BytesReceived
+	b.ReportMetric(float64(bytes)/float64(b.N), "bytes/round")
+}
+
+func benchmarkMembershipUpdates(count int) []membershipUpdate {
+	updates := []membershipUpdate{}
+	for i := 0; i < count; i++ {
+		updates = append(updates, membershipUpdate{
+			NodeID:        fmt.Sprintf("node-%d", i),
+			RemoteAddress: fmt.Sprintf("10.0.0.%d:8001", i),
+			State:         NodeAlive,
+			Incarnation:   uint64(i),
+		})
+	}
+	return updates
+}
@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// Clock tells the time. Simulated clusters in tests use a virtual clock, so
+// that they don't depend on how fast they run.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The cluster config is a key/value map that every node converges on, so
+// that settings shared by the whole cluster can be changed from any node
+// without redeploying files. Each entry is versioned by a Lamport clock, so a
+// change made after seeing an entry always supersedes it, and the highest
+// version of each key wins, with ties going to the higher node ID. Deleted
+// keys are kept as tombstones, so that a node which missed the deletion can't
+// bring the key back. Changes are piggybacked like membership updates, and
+// the whole map is swapped in joins and push-pulls.
+
+// Entries are piggybacked on UDP packets, so they must be small
+const maxConfigEntrySize = 512
+
+type ConfigEntry struct {
+	Key       string `json:"key" yaml:"key"`
+	Value     string `json:"value,omitempty" yaml:"value,omitempty"`
+	Version   uint64 `json:"version" yaml:"version"`
+	UpdatedBy NodeID `json:"updated_by" yaml:"updated_by"`
+	Deleted   bool   `json:"deleted,omitempty" yaml:"deleted,omitempty"`
+}
+
+// Whether the entry wins over another entry for the same key
+func (e ConfigEntry) supersedes(other ConfigEntry) bool {
+	if e.Version != other.Version {
+		return e.Version > other.Version
+	}
+	return e.UpdatedBy > other.UpdatedBy
+}
+
+type clusterConfig struct {
+	clock       lamportClock
+	entries     map[string]ConfigEntry
+	broadcasts  transmitQueue
+	subscribers configSubscriberSet
+}
+
+type configSubscriberSet struct {
+	channels map[int]chan ConfigEntry
+	nextID   int
+}
+
+// Must be called with the lock held
+func (s *configSubscriberSet) add(channel chan ConfigEntry) func() {
+	if s.channels == nil {
+		s.channels = map[int]chan ConfigEntry{}
+	}
+	id := s.nextID
+	s.nextID += 1
+	s.channels[id] = channel
+	return func() {
+		if _, ok := s.channels[id]; ok {
+			delete(s.channels, id)
+			close(channel)
+		}
+	}
+}
+
+// Must be called with the lock held
+func (s *configSubscriberSet) publish(entry ConfigEntry) int {
+	dropped := 0
+	for _, channel := range s.channels {
+		select {
+		case channel <- entry:
+		default:
+			dropped += 1
+		}
+	}
+	return dropped
+}
+
+// SetConfig sets a key in the cluster config, and gossips it to every node
+func (g *Gossip) SetConfig(key, value string) (ConfigEntry, error) {
+	return g.changeConfig(key, value, false)
+}
+
+// DeleteConfig deletes a key from the cluster config on every node
+func (g *Gossip) DeleteConfig(key string) (ConfigEntry, error) {
+	return g.changeConfig(key, "", true)
+}
+
+func (g *Gossip) changeConfig(key, value string, deleted bool) (ConfigEntry, error) {
+	if key == "" {
+		return ConfigEntry{}, fmt.Errorf("config keys must not be empty")
+	}
+	if size := len(key) + len(value); size > maxConfigEntrySize {
+		return ConfigEntry{}, fmt.Errorf("config entries must be at most %d bytes, got %d", maxConfigEntrySize, size)
+	}
+	g.Lock()
+	defer g.Unlock()
+	entry := ConfigEntry{
+		Key:       key,
+		Value:     value,
+		Version:   g.clusterConfig.clock.increment(),
+		UpdatedBy: g.Node.ID,
+		Deleted:   deleted,
+	}
+	g.receiveConfigEntry(entry)
+	return entry, nil
+}
+
+// ClusterConfig returns the keys and values of the cluster config
+func (g *Gossip) ClusterConfig() map[string]string {
+	g.Lock()
+	defer g.Unlock()
+	config := map[string]string{}
+	for key, entry := range g.clusterConfig.entries {
+		if !entry.Deleted {
+			config[key] = entry.Value
+		}
+	}
+	return config
+}
+
+// ConfigEntries lists every entry in the cluster config, including deleted
+// keys, sorted by key
+func (g *Gossip) ConfigEntries() []ConfigEntry {
+	g.Lock()
+	defer g.Unlock()
+	return g.configEntries()
+}
+
+// ConfigVersion is the highest version of any entry, which is the same on
+// every node once they have converged
+func (g *Gossip) ConfigVersion() uint64 {
+	g.Lock()
+	defer g.Unlock()
+	return g.configVersion()
+}
+
+// Must be called with the lock held
+func (g *Gossip) configVersion() uint64 {
+	version := uint64(0)
+	for _, entry := range g.clusterConfig.entries {
+		if entry.Version > version {
+			version = entry.Version
+		}
+	}
+	return version
+}
+
+// SubscribeConfig returns a channel of changes to the cluster config, and a
+// function to unsubscribe. Changes are dropped if the channel is full.
+func (g *Gossip) SubscribeConfig() (<-chan ConfigEntry, func()) {
+	changes := make(chan ConfigEntry, 64)
+	g.Lock()
+	defer g.Unlock()
+	return changes, g.unsubscriber(g.clusterConfig.subscribers.add(changes))
+}
+
+// Must be called with the lock held
+func (g *Gossip) configEntries() []ConfigEntry {
+	entries := make([]ConfigEntry, 0, len(g.clusterConfig.entries))
+	for _, entry := range g.clusterConfig.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// Must be called with the lock held
+func (g *Gossip) applyConfigEntries(entries []ConfigEntry) {
+	for _, entry := range entries {
+		g.clusterConfig.clock.witness(entry.Version)
+		g.receiveConfigEntry(entry)
+	}
+}
+
+// Must be called with the lock held. Applies and gossips on entries that
+// supersede what this node has.
+func (g *Gossip) receiveConfigEntry(entry ConfigEntry) {
+	if current, ok := g.clusterConfig.entries[entry.Key]; ok && !entry.supersedes(current) {
+		return
+	}
+	if g.clusterConfig.entries == nil {
+		g.clusterConfig.entries = map[string]ConfigEntry{}
+	}
+	g.clusterConfig.entries[entry.Key] = entry
+	debugLog.Printf("cluster config '%s' changed by node '%s' at version %d\n", entry.Key, entry.UpdatedBy, entry.Version)
+
+	// A newer entry for the same key replaces one still being gossiped
+	g.clusterConfig.broadcasts.push(entry.Key, entry, len(entry.Key)+len(entry.Value))
+	if dropped := g.clusterConfig.subscribers.publish(entry); dropped > 0 {
+		warnLog.Printf("dropped change to cluster config '%s' as %d subscribers are not keeping up\n", entry.Key, dropped)
+	}
+}
+
+// Must be called with the lock held. Works the same as piggybackedUserEvents.
+func (g *Gossip) piggybackedConfigEntries() []ConfigEntry {
+	entries := []ConfigEntry{}
+	for _, item := range g.clusterConfig.broadcasts.take(g.MaxPiggybackedUpdates, maxConfigEntrySize, g.retransmitLimit()) {
+		entries = append(entries, item.(ConfigEntry))
+	}
+	return entries
+}
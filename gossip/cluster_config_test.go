@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// The entry that wins out of those set, by the highest version and then the
+// highest node ID, for each key
+func winningConfigEntries(set []ConfigEntry) []ConfigEntry {
+	winners := map[string]ConfigEntry{}
+	for _, entry := range set {
+		if winner, ok := winners[entry.Key]; !ok || entry.supersedes(winner) {
+			winners[entry.Key] = entry
+		}
+	}
+	entries := []ConfigEntry{}
+	for _, entry := range winners {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+func configConverged(s *Simulation, expected []ConfigEntry) func() bool {
+	return func() bool {
+		for _, node := range s.Nodes {
+			if !reflect.DeepEqual(node.ConfigEntries(), expected) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestSimulatedConfigConverges(t *testing.T) {
+	s := NewSimulation(newSimulationConfig(10))
+	expectConverged(t, s, "joining", 15)
+
+	// Every node sets the same key at once, and some set it again
+	set := []ConfigEntry{}
+	for i, node := range s.Nodes {
+		for j := 0; j <= i%3; j++ {
+			entry, err := node.SetConfig("concurrent", fmt.Sprintf("%s-%d", node.Node.ID, j))
+			if err != nil {
+				t.Fatal(err)
+			}
+			set = append(set, entry)
+		}
+	}
+	expected := winningConfigEntries(set)
+	if rounds, converged := s.RunUntil(configConverged(s, expected), 15); !converged {
+		t.Fatalf("expected every node to have %+v within 15 rounds, still hadn't after %d", expected, rounds)
+	}
+
+	// Both sides change keys while they can't reach each other, and carry on
+	// until they stop gossiping the changes
+	sides := [][]int{{0, 1, 2, 3, 4, 5}, {6, 7, 8, 9}}
+	s.Partition(sides...)
+	for i := 0; i < s.partitionRounds(); i++ {
+		s.Step()
+	}
+	changes := []struct {
+		node    int
+		key     string
+		value   string
+		deleted bool
+	}{
+		{0, "partitioned", "majority", false},
+		{7, "partitioned", "minority", false},
+		{8, "partitioned", "minority again", false},
+		{2, "concurrent", "majority", false},
+		{9, "concurrent", "", true},
+		{6, "minority only", "minority", false},
+	}
+	for _, change := range changes {
+		var entry ConfigEntry
+		var err error
+		if change.deleted {
+			entry, err = s.Nodes[change.node].DeleteConfig(change.key)
+		} else {
+			entry, err = s.Nodes[change.node].SetConfig(change.key, change.value)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		set = append(set, entry)
+	}
+	for i := 0; i < 30; i++ {
+		s.Step()
+	}
+	if reflect.DeepEqual(s.Nodes[0].ConfigEntries(), s.Nodes[9].ConfigEntries()) {
+		t.Fatal("expected the sides of the partition to have different config")
+	}
+
+	s.Heal()
+	expected = winningConfigEntries(set)
+	pushPullRounds := int(s.Config.GossipSettings.PushPullInterval / s.Config.GossipSettings.GossipRegularity)
+	if rounds, converged := s.RunUntil(configConverged(s, expected), 2*pushPullRounds); !converged {
+		t.Fatalf("expected every node to have %+v within %d rounds of healing, still hadn't after %d", expected, 2*pushPullRounds, rounds)
+	}
+}
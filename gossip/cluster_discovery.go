@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type ClusterDiscovery interface {
 	DiscoverNodes() ([]NodeDescription, error)
+	// Watch rediscovers nodes every interval, calling onChange with any nodes
+	// that were added or removed since the last time. It only returns if the
+	// stop channel is closed.
+	Watch(interval time.Duration, stop <-chan struct{}, onChange func(added, removed []NodeDescription))
 }
 
 func indexNodes(nodes []NodeDescription) map[string]NodeDescription {
@@ -21,6 +31,9 @@ func indexNodes(nodes []NodeDescription) map[string]NodeDescription {
 
 type ClusterDiscoveryFromFile struct {
 	ConfigFile string
+
+	lastModified time.Time
+	lastSize     int64
 }
 
 func (c *ClusterDiscoveryFromFile) DiscoverNodes() ([]NodeDescription, error) {
@@ -40,3 +53,137 @@ func (c *ClusterDiscoveryFromFile) DiscoverNodes() ([]NodeDescription, error) {
 
 	return config.Nodes, nil
 }
+
+// The file is only reread if its modification time or size has changed
+func (c *ClusterDiscoveryFromFile) Watch(interval time.Duration, stop <-chan struct{}, onChange func(added, removed []NodeDescription)) {
+	watchClusterDiscovery(interval, stop, onChange, func() ([]NodeDescription, bool, error) {
+		info, err := os.Stat(c.ConfigFile)
+		if err != nil {
+			return nil, false, fmt.Errorf("error checking config file: %w", err)
+		}
+		if info.ModTime().Equal(c.lastModified) && info.Size() == c.lastSize {
+			return nil, false, nil
+		}
+		nodes, err := c.DiscoverNodes()
+		if err != nil {
+			return nil, false, err
+		}
+		c.lastModified = info.ModTime()
+		c.lastSize = info.Size()
+		return nodes, true, nil
+	})
+}
+
+// ClusterDiscoveryFromDNS finds nodes using SRV records, or using A and AAAA
+// records if Port is set. Nodes found through SRV records use the target
+// hostname as their node ID. Nodes found through A or AAAA records have no
+// node ID, so can only be used as seeds to join the cluster through.
+type ClusterDiscoveryFromDNS struct {
+	Name string
+	Port int
+	// Address of a DNS server to query instead of the system resolver,
+	// such as a local stub resolver
+	ResolverAddress string
+	Timeout         time.Duration
+}
+
+func (c *ClusterDiscoveryFromDNS) DiscoverNodes() ([]NodeDescription, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resolver := c.resolver()
+	nodes := []NodeDescription{}
+	if c.Port != 0 {
+		addresses, err := resolver.LookupHost(ctx, c.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up DNS name '%s': %w", c.Name, err)
+		}
+		for _, address := range addresses {
+			nodes = append(nodes, NodeDescription{
+				RemoteAddress: net.JoinHostPort(address, strconv.Itoa(c.Port)),
+			})
+		}
+		return nodes, nil
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, "", "", c.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up DNS SRV name '%s': %w", c.Name, err)
+	}
+	for _, record := range records {
+		hostname := strings.TrimSuffix(record.Target, ".")
+		nodes = append(nodes, NodeDescription{
+			ID:            hostname,
+			RemoteAddress: net.JoinHostPort(hostname, strconv.Itoa(int(record.Port))),
+		})
+	}
+	return nodes, nil
+}
+
+func (c *ClusterDiscoveryFromDNS) Watch(interval time.Duration, stop <-chan struct{}, onChange func(added, removed []NodeDescription)) {
+	watchClusterDiscovery(interval, stop, onChange, func() ([]NodeDescription, bool, error) {
+		nodes, err := c.DiscoverNodes()
+		return nodes, err == nil, err
+	})
+}
+
+func (c *ClusterDiscoveryFromDNS) resolver() *net.Resolver {
+	if c.ResolverAddress == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, c.ResolverAddress)
+		},
+	}
+}
+
+// Polls discover every interval. discover returns false if nothing could have
+// changed. Nodes found the first time are not reported, as they are expected
+// to have been found with DiscoverNodes at startup. Nodes are compared by both
+// their ID and address, so that nodes without an ID can be tracked too.
+func watchClusterDiscovery(interval time.Duration, stop <-chan struct{}, onChange func(added, removed []NodeDescription), discover func() ([]NodeDescription, bool, error)) {
+	var previous map[string]NodeDescription
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		nodes, changed, err := discover()
+		if err != nil {
+			warnLog.Println(fmt.Errorf("error rediscovering nodes: %w", err))
+		}
+		if changed {
+			current := make(map[string]NodeDescription, len(nodes))
+			added := []NodeDescription{}
+			for _, node := range nodes {
+				key := node.ID + "@" + node.RemoteAddress
+				current[key] = node
+				if _, ok := previous[key]; !ok {
+					added = append(added, node)
+				}
+			}
+			removed := []NodeDescription{}
+			for key, node := range previous {
+				if _, ok := current[key]; !ok {
+					removed = append(removed, node)
+				}
+			}
+			firstDiscovery := previous == nil
+			previous = current
+			if !firstDiscovery && (len(added) > 0 || len(removed) > 0) {
+				onChange(added, removed)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
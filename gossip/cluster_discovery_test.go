@@ -0,0 +1,310 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Answers SRV, A and AAAA queries from records that can be changed while it
+// runs, like a local stub resolver
+type stubResolver struct {
+	conn net.PacketConn
+
+	lock    sync.Mutex
+	srv     map[string][]net.SRV
+	a       map[string][]net.IP
+	queries int
+}
+
+func newStubResolver(t *testing.T) *stubResolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &stubResolver{conn: conn, srv: map[string][]net.SRV{}, a: map[string][]net.IP{}}
+	go r.serve()
+	t.Cleanup(func() { conn.Close() })
+	return r
+}
+
+func (r *stubResolver) address() string {
+	return r.conn.LocalAddr().String()
+}
+
+func (r *stubResolver) waitForQuery(t *testing.T) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		r.lock.Lock()
+		queries := r.queries
+		r.lock.Unlock()
+		if queries > 0 {
+			return
+		}
+	}
+	t.Fatal("expected the resolver to be queried")
+}
+
+func (r *stubResolver) setSRV(name string, records ...net.SRV) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.srv[name] = records
+}
+
+func (r *stubResolver) setA(name string, ips ...net.IP) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.a[name] = ips
+}
+
+func (r *stubResolver) serve() {
+	buffer := make([]byte, 512)
+	for {
+		n, from, err := r.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buffer[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		answer := r.answer(query)
+		response, err := answer.Pack()
+		if err != nil {
+			continue
+		}
+		r.conn.WriteTo(response, from)
+	}
+}
+
+func (r *stubResolver) answer(query dnsmessage.Message) dnsmessage.Message {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.queries += 1
+
+	question := query.Questions[0]
+	name := question.Name.String()
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+		Questions: query.Questions,
+	}
+	_, knownSRV := r.srv[name]
+	_, knownA := r.a[name]
+	if !knownSRV && !knownA {
+		response.RCode = dnsmessage.RCodeNameError
+		return response
+	}
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 1}
+	switch question.Type {
+	case dnsmessage.TypeSRV:
+		for _, record := range r.srv[name] {
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: header,
+				Body: &dnsmessage.SRVResource{
+					Priority: record.Priority,
+					Weight:   record.Weight,
+					Port:     record.Port,
+					Target:   dnsmessage.MustNewName(record.Target),
+				},
+			})
+		}
+	case dnsmessage.TypeA:
+		for _, ip := range r.a[name] {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip.To4())
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: &a})
+		}
+	}
+	return response
+}
+
+func sortedNodes(nodes []NodeDescription) []NodeDescription {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID+nodes[i].RemoteAddress < nodes[j].ID+nodes[j].RemoteAddress
+	})
+	return nodes
+}
+
+func TestDiscoverNodesFromDNSSRVRecords(t *testing.T) {
+	resolver := newStubResolver(t)
+	resolver.setSRV("_gossip._udp.example.test.",
+		net.SRV{Target: "node-1.example.test.", Port: 8001},
+		net.SRV{Target: "node-2.example.test.", Port: 8002},
+	)
+
+	discovery := &ClusterDiscoveryFromDNS{Name: "_gossip._udp.example.test.", ResolverAddress: resolver.address()}
+	nodes, err := discovery.DiscoverNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []NodeDescription{
+		{ID: "node-1.example.test", RemoteAddress: "node-1.example.test:8001"},
+		{ID: "node-2.example.test", RemoteAddress: "node-2.example.test:8002"},
+	}
+	if !reflect.DeepEqual(sortedNodes(nodes), expected) {
+		t.Fatalf("expected %v, got %v", expected, nodes)
+	}
+}
+
+func TestDiscoverNodesFromDNSARecords(t *testing.T) {
+	resolver := newStubResolver(t)
+	resolver.setA("nodes.example.test.", net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"))
+
+	discovery := &ClusterDiscoveryFromDNS{Name: "nodes.example.test.", Port: 8001, ResolverAddress: resolver.address()}
+	nodes, err := discovery.DiscoverNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nodes found through A records have no ID, so are only seeds
+	expected := []NodeDescription{
+		{RemoteAddress: "10.0.0.1:8001"},
+		{RemoteAddress: "10.0.0.2:8001"},
+	}
+	if !reflect.DeepEqual(sortedNodes(nodes), expected) {
+		t.Fatalf("expected %v, got %v", expected, nodes)
+	}
+}
+
+func TestDiscoverNodesFromDNSFailsForUnknownName(t *testing.T) {
+	resolver := newStubResolver(t)
+	discovery := &ClusterDiscoveryFromDNS{Name: "_gossip._udp.missing.test.", ResolverAddress: resolver.address()}
+	if _, err := discovery.DiscoverNodes(); err == nil {
+		t.Fatal("expected an error discovering nodes under an unknown name")
+	}
+}
+
+type discoveryChange struct {
+	added, removed []NodeDescription
+}
+
+// Watches until the stop channel is closed, returning the changes reported
+func watchChanges(t *testing.T, watch func(stop <-chan struct{}, onChange func(added, removed []NodeDescription))) (chan discoveryChange, func()) {
+	changes := make(chan discoveryChange, 16)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		watch(stop, func(added, removed []NodeDescription) {
+			changes <- discoveryChange{sortedNodes(added), sortedNodes(removed)}
+		})
+	}()
+	return changes, func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func expectChange(t *testing.T, changes chan discoveryChange, expected discoveryChange) {
+	t.Helper()
+	select {
+	case change := <-changes:
+		if len(change.added) == 0 {
+			change.added = nil
+		}
+		if len(change.removed) == 0 {
+			change.removed = nil
+		}
+		if !reflect.DeepEqual(change, expected) {
+			t.Fatalf("expected change %+v, got %+v", expected, change)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected change %+v, got none", expected)
+	}
+}
+
+func TestWatchClusterDiscoveryReportsAddedAndRemovedNodes(t *testing.T) {
+	node1 := NodeDescription{ID: "node-1", RemoteAddress: "127.0.0.1:8001"}
+	node2 := NodeDescription{ID: "node-2", RemoteAddress: "127.0.0.1:8002"}
+	node2Moved := NodeDescription{ID: "node-2", RemoteAddress: "127.0.0.1:9002"}
+	seed := NodeDescription{RemoteAddress: "127.0.0.1:8003"}
+
+	type discovery struct {
+		nodes   []NodeDescription
+		changed bool
+	}
+	discoveries := make(chan discovery)
+	changes, stop := watchChanges(t, func(stop <-chan struct{}, onChange func(added, removed []NodeDescription)) {
+		watchClusterDiscovery(time.Millisecond, stop, onChange, func() ([]NodeDescription, bool, error) {
+			select {
+			case d := <-discoveries:
+				return d.nodes, d.changed, nil
+			case <-stop:
+				return nil, false, nil
+			}
+		})
+	})
+	defer stop()
+
+	// Nodes found the first time are expected to be known already
+	discoveries <- discovery{[]NodeDescription{node1}, true}
+	discoveries <- discovery{[]NodeDescription{node1, node2, seed}, true}
+	expectChange(t, changes, discoveryChange{added: []NodeDescription{seed, node2}})
+	// Nothing is reported while nothing has changed
+	discoveries <- discovery{nil, false}
+	discoveries <- discovery{[]NodeDescription{node1, node2, seed}, true}
+	// A node that moves is removed at its old address and added at its new one
+	discoveries <- discovery{[]NodeDescription{node2Moved}, true}
+	expectChange(t, changes, discoveryChange{
+		added:   []NodeDescription{node2Moved},
+		removed: []NodeDescription{seed, node1, node2},
+	})
+
+	select {
+	case change := <-changes:
+		t.Fatalf("expected no more changes, got %+v", change)
+	default:
+	}
+}
+
+func TestWatchDNSDiscoveryReportsChangedRecords(t *testing.T) {
+	resolver := newStubResolver(t)
+	name := "_gossip._udp.example.test."
+	resolver.setSRV(name, net.SRV{Target: "node-1.example.test.", Port: 8001})
+
+	discovery := &ClusterDiscoveryFromDNS{Name: name, ResolverAddress: resolver.address()}
+	changes, stop := watchChanges(t, func(stop <-chan struct{}, onChange func(added, removed []NodeDescription)) {
+		discovery.Watch(10*time.Millisecond, stop, onChange)
+	})
+	defer stop()
+
+	// The records change after the first discovery
+	resolver.waitForQuery(t)
+	resolver.setSRV(name, net.SRV{Target: "node-2.example.test.", Port: 8002})
+	expectChange(t, changes, discoveryChange{
+		added:   []NodeDescription{{ID: "node-2.example.test", RemoteAddress: "node-2.example.test:8002"}},
+		removed: []NodeDescription{{ID: "node-1.example.test", RemoteAddress: "node-1.example.test:8001"}},
+	})
+}
+
+// A node's view of discovery can be stale or partial, so it mustn't declare
+// nodes it no longer discovers to have left
+func TestNodesNoLongerDiscoveredAreLeftToFailureDetection(t *testing.T) {
+	s := NewSimulation(newSimulationConfig(5))
+	expectConverged(t, s, "joining", 15)
+	observer, removed := s.Nodes[0], s.Nodes[4]
+	noLongerDiscovered := []NodeDescription{{ID: removed.Node.ID, RemoteAddress: removed.Node.RemoteAddress}}
+
+	observer.UpdateDiscoveredNodes(nil, noLongerDiscovered)
+	for i := 0; i < 20; i++ {
+		s.Step()
+	}
+	if !s.Converged() {
+		t.Fatal("expected a running node no longer discovered to stay a member")
+	}
+	expectNoFalsePositives(t, s, "a running node no longer being discovered")
+
+	s.Crash(4)
+	observer.UpdateDiscoveredNodes(nil, noLongerDiscovered)
+	expectConverged(t, s, "a crash", 15)
+	observer.Lock()
+	state := observer.OtherNodeStatuses[removed.Node.ID].State
+	observer.Unlock()
+	if state != NodeDead {
+		t.Fatalf("expected the crashed node to be declared dead by failure detection, got %s", state)
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// gossipctl queries the status API of a gossip node, and changes its keyring
+// and the cluster config through the admin API.
+//
+//	gossipctl -address 127.0.0.1:9001 members
+//	gossipctl -address 127.0.0.1:9001 -state alive -tag role=redis members
+//	gossipctl -address 127.0.0.1:9001 -sort proximity -tag role=redis members
+//	gossipctl -address 127.0.0.1:9001 summary
+//	gossipctl -address 127.0.0.1:9001 config
+//	gossipctl -address 127.0.0.1:9001 leases
+//	gossipctl generate-key
+//	gossipctl -admin-address 127.0.0.1:9101 keys
+//	gossipctl -admin-address 127.0.0.1:9101 install-key|use-key|remove-key <key>
+//	gossipctl -admin-address 127.0.0.1:9101 set-config <key> <value>
+//	gossipctl -admin-address 127.0.0.1:9101 delete-config <key>
+//	gossipctl -admin-address 127.0.0.1:9101 event <name> [payload]
+//	gossipctl -admin-address 127.0.0.1:9101 -tag role=redis query <name> [payload]
+
+type memberStatus struct {
+	ID                 string            `json:"id"`
+	RemoteAddress      string            `json:"remote_address"`
+	State              string            `json:"state"`
+	Incarnation        uint64            `json:"incarnation"`
+	Tags               map[string]string `json:"tags"`
+	Zone               string            `json:"zone"`
+	Self               bool              `json:"self"`
+	LastSeenAgeSeconds *float64          `json:"last_seen_age_seconds"`
+	SuspectedAt        *time.Time        `json:"suspected_at"`
+	EstimatedRTT       *float64          `json:"estimated_rtt_seconds"`
+}
+
+type summaryStatus struct {
+	NodeID      string `json:"node_id"`
+	Incarnation uint64 `json:"incarnation"`
+	LocalHealth int    `json:"local_health"`
+	Coordinate  struct {
+		Error float64 `json:"error"`
+	} `json:"coordinate"`
+	ClusterNodeCount         int    `json:"cluster_node_count"`
+	OtherNodesSeenRecently   int    `json:"other_nodes_seen_recently"`
+	OtherNodesSuspected      int    `json:"other_nodes_suspected"`
+	OtherNodesDead           int    `json:"other_nodes_dead"`
+	RecentlySawMostOfCluster bool   `json:"recently_saw_most_of_cluster"`
+	QuorumPolicy             string `json:"quorum_policy"`
+	ClusterVotes             int    `json:"cluster_votes"`
+	VotesSeenRecently        int    `json:"votes_seen_recently"`
+	Zones                    []struct {
+		Zone              string `json:"zone"`
+		Nodes             int    `json:"nodes"`
+		NodesSeenRecently int    `json:"nodes_seen_recently"`
+		Votes             int    `json:"votes"`
+		VotesSeenRecently int    `json:"votes_seen_recently"`
+		SawMostOfZone     bool   `json:"saw_most_of_zone"`
+	} `json:"zones"`
+	Leader         string     `json:"leader"`
+	IsLeader       bool       `json:"is_leader"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at"`
+	ConfigVersion  uint64     `json:"config_version"`
+	Partitions     struct {
+		Components  [][]string `json:"components"`
+		Unreachable []string   `json:"unreachable"`
+		Asymmetric  []struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		} `json:"asymmetric"`
+	} `json:"partitions"`
+}
+
+type configEntry struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Version   uint64 `json:"version"`
+	UpdatedBy string `json:"updated_by"`
+	Deleted   bool   `json:"deleted"`
+}
+
+type clusterConfigStatus struct {
+	Version uint64        `json:"version"`
+	Entries []configEntry `json:"entries"`
+}
+
+type leaseStatus struct {
+	Name           string     `json:"name"`
+	GrantedTo      string     `json:"granted_to"`
+	Token          uint64     `json:"token"`
+	HeldByThisNode bool       `json:"held_by_this_node"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+}
+
+type keyringStatus struct {
+	Encrypted    bool     `json:"encrypted"`
+	PrimaryKeyID string   `json:"primary_key_id"`
+	KeyIDs       []string `json:"key_ids"`
+}
+
+type queryResult struct {
+	Responses []struct {
+		From    string `json:"from"`
+		Payload []byte `json:"payload"`
+		Error   string `json:"error"`
+	} `json:"responses"`
+	Acked   []string `json:"acked"`
+	NoReply []string `json:"no_reply"`
+}
+
+func main() {
+	address := flag.String("address", "127.0.0.1:9001", "status API address of the node to query")
+	adminAddress := flag.String("admin-address", "127.0.0.1:9101", "admin API address of the node to change")
+	timeout := flag.Duration("timeout", 5*time.Second, "how long to wait for the node to respond")
+	rawJSON := flag.Bool("json", false, "print the JSON response as it is")
+	state := flag.String("state", "", "only list members in this state, such as alive")
+	sortBy := flag.String("sort", "id", "list members by id, or nearest first by proximity")
+	tags := tagFlags{}
+	flag.Var(&tags, "tag", "only list or query members with this key=value tag; can be repeated")
+	queryTimeout := flag.Duration("query-timeout", 5*time.Second, "how long a query waits for responses")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] members|summary|config|leases|generate-key|keys\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] set-config <key> <value>|delete-config <key>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] install-key|use-key|remove-key <key>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] event|query <name> [payload]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	// Everything after the name is the payload of an event or query, or the
+	// value of a config key
+	var payload []byte
+	if flag.NArg() > 2 {
+		payload = []byte(strings.Join(flag.Args()[2:], " "))
+	}
+	switch command := flag.Arg(0); command {
+	case "members":
+		query := url.Values{}
+		if *state != "" {
+			query.Set("state", *state)
+		}
+		query.Set("sort", *sortBy)
+		for _, tag := range tags {
+			query.Add("tag", tag)
+		}
+		var members []memberStatus
+		responseBytes, err := get(client, *address, "/members?"+query.Encode(), &members)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *rawJSON {
+			os.Stdout.Write(responseBytes)
+			return
+		}
+		printMembers(members)
+	case "summary":
+		var summary summaryStatus
+		responseBytes, err := get(client, *address, "/summary", &summary)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *rawJSON {
+			os.Stdout.Write(responseBytes)
+			return
+		}
+		printSummary(summary)
+	case "generate-key":
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal(fmt.Errorf("error generating key: %w", err))
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+	case "config":
+		var config clusterConfigStatus
+		responseBytes, err := get(client, *address, "/config", &config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *rawJSON {
+			os.Stdout.Write(responseBytes)
+			return
+		}
+		printClusterConfig(config)
+	case "leases":
+		var leases []leaseStatus
+		responseBytes, err := get(client, *address, "/leases", &leases)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *rawJSON {
+			os.Stdout.Write(responseBytes)
+			return
+		}
+		printLeases(leases)
+	case "set-config", "delete-config":
+		if flag.NArg() < 2 || (command == "delete-config" && flag.NArg() != 2) {
+			flag.Usage()
+			os.Exit(2)
+		}
+		action := strings.TrimSuffix(command, "-config")
+		request := map[string]string{"key": flag.Arg(1), "value": string(payload)}
+		var entry configEntry
+		responseBytes, err := post(client, *adminAddress, "/config/"+action, request, &entry)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *rawJSON {
+			os.Stdout.Write(responseBytes)
+			return
+		}
+		verb := "Set"
+		if entry.Deleted {
+			verb = "Deleted"
+		}
+		fmt.Printf("%s '%s' at version %d\n", verb, entry.Key, entry.Version)
+	case "keys":
+		var keyring keyringStatus
+		responseBytes, err := get(client, *adminAddress, "/keyring", &keyring)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *rawJSON {
+			os.Stdout.Write(responseBytes)
+			return
+		}
+		printKeyring(keyring)
+	case "install-key", "use-key", "remove-key":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		action := strings.TrimSuffix(command, "-key")
+		var keyring keyringStatus
+		responseBytes, err := post(client, *adminAddress, "/keyring/"+action, map[string]string{"key": flag.Arg(1)}, &keyring)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *rawJSON {
+			os.Stdout.Write(responseBytes)
+			return
+		}
+		printKeyring(keyring)
+	case "event":
+		if flag.NArg() < 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		request := map[string]interface{}{"name": flag.Arg(1), "payload": payload}
+		var response map[string]interface{}
+		if _, err := post(client, *adminAddress, "/events", request, &response); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("sent user event '%s'\n", flag.Arg(1))
+	case "query":
+		if flag.NArg() < 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		queryTags := map[string]string{}
+		for _, tag := range tags {
+			parts := strings.SplitN(tag, "=", 2)
+			queryTags[parts[0]] = parts[1]
+		}
+		request := map[string]interface{}{
+			"name":    flag.Arg(1),
+			"payload": payload,
+			"tags":    queryTags,
+			"timeout": queryTimeout.String(),
+		}
+		// The node waits for the query timeout before responding
+		client.Timeout = *timeout + *queryTimeout
+		var result queryResult
+		responseBytes, err := post(client, *adminAddress, "/queries", request, &result)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *rawJSON {
+			os.Stdout.Write(responseBytes)
+			return
+		}
+		printQueryResult(result)
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "unknown command '%s'\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func get(client *http.Client, address, path string, response interface{}) ([]byte, error) {
+	httpResponse, err := client.Get("http://" + address + path)
+	if err != nil {
+		return nil, fmt.Errorf("error querying node: %w", err)
+	}
+	return readResponse(httpResponse, response)
+}
+
+func post(client *http.Client, address, path string, request, response interface{}) ([]byte, error) {
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("error serialising request: %w", err)
+	}
+	httpResponse, err := client.Post("http://"+address+path, "application/json", bytes.NewReader(requestBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error calling node: %w", err)
+	}
+	return readResponse(httpResponse, response)
+}
+
+func readResponse(httpResponse *http.Response, response interface{}) ([]byte, error) {
+	defer httpResponse.Body.Close()
+	responseBytes, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("node responded with status %d: %s", httpResponse.StatusCode, responseBytes)
+	}
+	if err = json.Unmarshal(responseBytes, response); err != nil {
+		return nil, fmt.Errorf("error deserialising response: %w", err)
+	}
+	return responseBytes, nil
+}
+
+func printMembers(members []memberStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tZONE\tSTATE\tINCARNATION\tLAST SEEN\tRTT\tTAGS")
+	for _, member := range members {
+		lastSeen := "never"
+		switch {
+		case member.Self:
+			lastSeen = "self"
+		case member.LastSeenAgeSeconds != nil:
+			age := time.Duration(*member.LastSeenAgeSeconds * float64(time.Second))
+			lastSeen = age.Round(time.Millisecond).String() + " ago"
+		}
+		rtt := "unknown"
+		if member.EstimatedRTT != nil {
+			rtt = time.Duration(*member.EstimatedRTT * float64(time.Second)).Round(time.Microsecond).String()
+		}
+		tags := []string{}
+		for key, value := range member.Tags {
+			tags = append(tags, key+"="+value)
+		}
+		sort.Strings(tags)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", member.ID, member.RemoteAddress, member.Zone, member.State, member.Incarnation, lastSeen, rtt, strings.Join(tags, ","))
+	}
+	w.Flush()
+}
+
+func printSummary(summary summaryStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Node\t%s (incarnation %d)\n", summary.NodeID, summary.Incarnation)
+	fmt.Fprintf(w, "Local health\t%d\n", summary.LocalHealth)
+	fmt.Fprintf(w, "Coordinate error\t%.3f\n", summary.Coordinate.Error)
+	fmt.Fprintf(w, "Cluster nodes\t%d\n", summary.ClusterNodeCount)
+	fmt.Fprintf(w, "Alive\t%d\n", 1+summary.OtherNodesSeenRecently)
+	fmt.Fprintf(w, "Suspected\t%d\n", summary.OtherNodesSuspected)
+	fmt.Fprintf(w, "Dead\t%d\n", summary.OtherNodesDead)
+	fmt.Fprintf(w, "Quorum\t%v (%s policy, %d of %d votes seen)\n", summary.RecentlySawMostOfCluster, summary.QuorumPolicy, summary.VotesSeenRecently, summary.ClusterVotes)
+	for _, zone := range summary.Zones {
+		name := zone.Zone
+		if name == "" {
+			name = "(none)"
+		}
+		reachability := "lost"
+		if zone.SawMostOfZone {
+			reachability = "reachable"
+		}
+		fmt.Fprintf(w, "Zone %s\t%d of %d nodes and %d of %d votes seen, so %s\n", name, zone.NodesSeenRecently, zone.Nodes, zone.VotesSeenRecently, zone.Votes, reachability)
+	}
+	leader := summary.Leader
+	if leader == "" {
+		leader = "none"
+	}
+	if summary.IsLeader && summary.LeaseExpiresAt != nil {
+		leader += fmt.Sprintf(" (this node, lease expires %s)", summary.LeaseExpiresAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Leader\t%s\n", leader)
+	fmt.Fprintf(w, "Config version\t%d\n", summary.ConfigVersion)
+	partitions := summary.Partitions
+	for i, component := range partitions.Components {
+		fmt.Fprintf(w, "Partition %d\t%s\n", i+1, strings.Join(component, ", "))
+	}
+	if len(partitions.Unreachable) > 0 {
+		fmt.Fprintf(w, "Unreachable\t%s\n", strings.Join(partitions.Unreachable, ", "))
+	}
+	for _, pair := range partitions.Asymmetric {
+		fmt.Fprintf(w, "Asymmetric\t%s sees %s, but not the other way around\n", pair.From, pair.To)
+	}
+	w.Flush()
+}
+
+func printClusterConfig(config clusterConfigStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tVERSION\tUPDATED BY")
+	for _, entry := range config.Entries {
+		if !entry.Deleted {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", entry.Key, entry.Value, entry.Version, entry.UpdatedBy)
+		}
+	}
+	w.Flush()
+}
+
+func printLeases(leases []leaseStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tGRANTED TO\tTOKEN\tHELD\tEXPIRES IN")
+	for _, lease := range leases {
+		expiresIn := ""
+		if lease.ExpiresAt != nil {
+			expiresIn = time.Until(*lease.ExpiresAt).Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%v\t%s\n", lease.Name, lease.GrantedTo, lease.Token, lease.HeldByThisNode, expiresIn)
+	}
+	w.Flush()
+}
+
+func printKeyring(keyring keyringStatus) {
+	if !keyring.Encrypted {
+		fmt.Println("Gossip is not encrypted")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY ID\tPRIMARY")
+	for _, keyID := range keyring.KeyIDs {
+		fmt.Fprintf(w, "%s\t%v\n", keyID, keyID == keyring.PrimaryKeyID)
+	}
+	w.Flush()
+}
+
+func printQueryResult(result queryResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tRESPONSE")
+	for _, response := range result.Responses {
+		if response.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\n", response.From, response.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\n", response.From, response.Payload)
+	}
+	for _, nodeID := range result.Acked {
+		fmt.Fprintf(w, "%s\t(no response)\n", nodeID)
+	}
+	for _, nodeID := range result.NoReply {
+		fmt.Fprintf(w, "%s\t(no reply before the deadline)\n", nodeID)
+	}
+	w.Flush()
+}
+
+type tagFlags []string
+
+func (t *tagFlags) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *tagFlags) Set(pair string) error {
+	if !strings.Contains(pair, "=") {
+		return fmt.Errorf("tags must be key=value, got '%s'", pair)
+	}
+	*t = append(*t, pair)
+	return nil
+}
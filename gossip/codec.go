@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// A compact binary encoding of gossip messages and replies, used by the UDP
+// transport. Integers are varints, strings are length-prefixed, and message
+// kinds and node states are single bytes.
+
+const codecVersion = 11
+
+var gossipMessageKindCodes = map[gossipMessageKind]byte{
+	pingMessage:     1,
+	pingReqMessage:  2,
+	joinMessage:     3,
+	leaveMessage:    4,
+	pushPullMessage: 5,
+	queryMessage:    6,
+	leaseMessage:    7,
+}
+
+func encodeGossipMessage(message *gossipMessage) ([]byte, error) {
+	kindCode, ok := gossipMessageKindCodes[message.Kind]
+	if !ok {
+		return nil, fmt.Errorf("cannot encode gossip message of unknown kind '%s'", message.Kind)
+	}
+
+	e := &encoder{}
+	e.byte(codecVersion)
+	e.byte(kindCode)
+	e.string(message.NodeID)
+	e.string(message.RemoteAddress)
+	e.uvarint(message.Incarnation)
+	e.time(message.Timestamp)
+	e.tags(message.Tags)
+	e.string(message.Zone)
+	e.varint(int64(message.Votes))
+	e.string(message.Target)
+	e.string(message.TargetAddress)
+	e.membershipUpdates(message.Updates)
+	e.membershipUpdates(message.Members)
+	e.reachabilityReports(message.Reachability)
+	e.userEvents(message.Events)
+	e.configEntries(message.Config)
+	e.queryRequest(message.Query)
+	e.leaseRequest(message.Lease)
+	e.coordinate(message.Coordinate)
+	return e.Bytes(), nil
+}
+
+func decodeGossipMessage(messageBytes []byte) (*gossipMessage, error) {
+	d := &decoder{buf: messageBytes}
+	if version := d.byte(); d.err == nil && version != codecVersion {
+		return nil, fmt.Errorf("cannot decode gossip message of unknown version %d", version)
+	}
+	kindCode := d.byte()
+	message := &gossipMessage{
+		NodeID:        d.string(),
+		RemoteAddress: d.string(),
+		Incarnation:   d.uvarint(),
+		Timestamp:     d.time(),
+		Tags:          d.tags(),
+		Zone:          d.string(),
+		Votes:         int(d.varint()),
+		Target:        d.string(),
+		TargetAddress: d.string(),
+		Updates:       d.membershipUpdates(),
+		Members:       d.membershipUpdates(),
+		Reachability:  d.reachabilityReports(),
+		Events:        d.userEvents(),
+		Config:        d.configEntries(),
+		Query:         d.queryRequest(),
+		Lease:         d.leaseRequest(),
+		Coordinate:    d.coordinate(),
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("error decoding gossip message: %w", d.err)
+	}
+	for kind, code := range gossipMessageKindCodes {
+		if code == kindCode {
+			message.Kind = kind
+		}
+	}
+	if message.Kind == "" {
+		return nil, fmt.Errorf("cannot decode gossip message of unknown kind %d", kindCode)
+	}
+	return message, nil
+}
+
+func encodeGossipReply(reply *gossipReply) []byte {
+	e := &encoder{}
+	e.byte(codecVersion)
+	e.string(reply.NodeID)
+	e.uvarint(reply.Incarnation)
+	e.time(reply.Timestamp)
+	e.bool(reply.Ack)
+	e.string(reply.Zone)
+	e.varint(int64(reply.Votes))
+	e.membershipUpdates(reply.Updates)
+	e.membershipUpdates(reply.Members)
+	e.reachabilityReports(reply.Reachability)
+	e.userEvents(reply.Events)
+	e.configEntries(reply.Config)
+	e.queryResponse(reply.QueryResponse)
+	e.leaseGrant(reply.LeaseGrant)
+	e.coordinate(reply.Coordinate)
+	return e.Bytes()
+}
+
+func decodeGossipReply(replyBytes []byte) (*gossipReply, error) {
+	d := &decoder{buf: replyBytes}
+	if version := d.byte(); d.err == nil && version != codecVersion {
+		return nil, fmt.Errorf("cannot decode gossip reply of unknown version %d", version)
+	}
+	reply := &gossipReply{
+		NodeID:        d.string(),
+		Incarnation:   d.uvarint(),
+		Timestamp:     d.time(),
+		Ack:           d.bool(),
+		Zone:          d.string(),
+		Votes:         int(d.varint()),
+		Updates:       d.membershipUpdates(),
+		Members:       d.membershipUpdates(),
+		Reachability:  d.reachabilityReports(),
+		Events:        d.userEvents(),
+		Config:        d.configEntries(),
+		QueryResponse: d.queryResponse(),
+		LeaseGrant:    d.leaseGrant(),
+		Coordinate:    d.coordinate(),
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("error decoding gossip reply: %w", d.err)
+	}
+	return reply, nil
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) byte(b byte) {
+	e.WriteByte(b)
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.byte(1)
+	} else {
+		e.byte(0)
+	}
+}
+
+func (e *encoder) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (e *encoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) time(t time.Time) {
+	if t.IsZero() {
+		e.varint(0)
+		return
+	}
+	e.varint(t.UnixNano())
+}
+
+func (e *encoder) membershipUpdates(updates []membershipUpdate) {
+	e.uvarint(uint64(len(updates)))
+	for _, update := range updates {
+		e.string(update.NodeID)
+		e.string(update.RemoteAddress)
+		e.byte(byte(update.State))
+		e.uvarint(update.Incarnation)
+		e.tags(update.Tags)
+		e.string(update.Zone)
+		e.varint(int64(update.Votes))
+		e.string(update.From)
+	}
+}
+
+// Tags are sorted by key, so that encoding is deterministic
+func (e *encoder) tags(tags map[string]string) {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	e.uvarint(uint64(len(keys)))
+	for _, key := range keys {
+		e.string(key)
+		e.string(tags[key])
+	}
+}
+
+func (e *encoder) reachabilityReports(reports []reachabilityReport) {
+	e.uvarint(uint64(len(reports)))
+	for _, report := range reports {
+		e.string(report.NodeID)
+		e.time(report.ChangedAt)
+		e.uvarint(uint64(len(report.Unreachable)))
+		for _, nodeID := range report.Unreachable {
+			e.string(nodeID)
+		}
+	}
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) userEvents(events []UserEvent) {
+	e.uvarint(uint64(len(events)))
+	for _, event := range events {
+		e.string(event.Name)
+		e.bytes(event.Payload)
+		e.uvarint(event.LTime)
+		e.string(event.Origin)
+	}
+}
+
+func (e *encoder) configEntries(entries []ConfigEntry) {
+	e.uvarint(uint64(len(entries)))
+	for _, entry := range entries {
+		e.string(entry.Key)
+		e.string(entry.Value)
+		e.uvarint(entry.Version)
+		e.string(entry.UpdatedBy)
+		e.bool(entry.Deleted)
+	}
+}
+
+// Queries, leases and their responses are optional, so are preceded by
+// whether they are present
+func (e *encoder) queryRequest(request *queryRequest) {
+	e.bool(request != nil)
+	if request == nil {
+		return
+	}
+	e.string(request.Name)
+	e.bytes(request.Payload)
+	e.uvarint(request.LTime)
+	e.tags(request.Tags)
+	e.varint(int64(request.Timeout))
+}
+
+func (e *encoder) queryResponse(response *queryResponse) {
+	e.bool(response != nil)
+	if response == nil {
+		return
+	}
+	e.bool(response.Responded)
+	e.bytes(response.Payload)
+	e.string(response.Error)
+}
+
+func (e *encoder) leaseRequest(request *leaseRequest) {
+	e.bool(request != nil)
+	if request == nil {
+		return
+	}
+	e.string(request.Name)
+	e.uvarint(request.Token)
+	e.varint(int64(request.Duration))
+	e.bool(request.Renewal)
+	e.bool(request.Release)
+}
+
+func (e *encoder) leaseGrant(grant *leaseGrant) {
+	e.bool(grant != nil)
+	if grant == nil {
+		return
+	}
+	e.bool(grant.Granted)
+	e.string(grant.Holder)
+	e.uvarint(grant.Token)
+}
+
+func (e *encoder) float64(f float64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(f))
+	e.Write(b[:])
+}
+
+func (e *encoder) coordinate(coordinate *Coordinate) {
+	e.bool(coordinate != nil)
+	if coordinate == nil {
+		return
+	}
+	e.uvarint(uint64(len(coordinate.Vec)))
+	for _, component := range coordinate.Vec {
+		e.float64(component)
+	}
+	e.float64(coordinate.Error)
+	e.float64(coordinate.Adjustment)
+	e.float64(coordinate.Height)
+}
+
+// Decoding stops at the first error, after which every method returns a zero
+// value. The error is checked once at the end.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 1 {
+		d.fail(fmt.Errorf("unexpected end of data"))
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) bool() bool {
+	return d.byte() == 1
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail(fmt.Errorf("invalid varint"))
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail(fmt.Errorf("invalid varint"))
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	length := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.buf)) < length {
+		d.fail(fmt.Errorf("unexpected end of data"))
+		return ""
+	}
+	s := string(d.buf[:length])
+	d.buf = d.buf[length:]
+	return s
+}
+
+func (d *decoder) time() time.Time {
+	unixNano := d.varint()
+	if unixNano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, unixNano)
+}
+
+// Counts are checked against the remaining data, so that a corrupt count
+// can't cause a huge allocation
+func (d *decoder) count() int {
+	count := d.uvarint()
+	if count > uint64(len(d.buf)) {
+		d.fail(fmt.Errorf("count of %d is more than the remaining data", count))
+		return 0
+	}
+	return int(count)
+}
+
+func (d *decoder) membershipUpdates() []membershipUpdate {
+	count := d.count()
+	if count == 0 {
+		return nil
+	}
+	updates := make([]membershipUpdate, 0, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		updates = append(updates, membershipUpdate{
+			NodeID:        d.string(),
+			RemoteAddress: d.string(),
+			State:         NodeState(d.byte()),
+			Incarnation:   d.uvarint(),
+			Tags:          d.tags(),
+			Zone:          d.string(),
+			Votes:         int(d.varint()),
+			From:          d.string(),
+		})
+	}
+	return updates
+}
+
+func (d *decoder) reachabilityReports() []reachabilityReport {
+	count := d.count()
+	if count == 0 {
+		return nil
+	}
+	reports := make([]reachabilityReport, 0, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		report := reachabilityReport{
+			NodeID:    d.string(),
+			ChangedAt: d.time(),
+		}
+		unreachableCount := d.count()
+		for j := 0; j < unreachableCount && d.err == nil; j++ {
+			report.Unreachable = append(report.Unreachable, d.string())
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func (d *decoder) tags() map[string]string {
+	count := d.count()
+	if count == 0 {
+		return nil
+	}
+	tags := make(map[string]string, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		key := d.string()
+		tags[key] = d.string()
+	}
+	return tags
+}
+
+func (d *decoder) bytes() []byte {
+	length := d.uvarint()
+	if d.err != nil || length == 0 {
+		return nil
+	}
+	if uint64(len(d.buf)) < length {
+		d.fail(fmt.Errorf("unexpected end of data"))
+		return nil
+	}
+	b := append([]byte{}, d.buf[:length]...)
+	d.buf = d.buf[length:]
+	return b
+}
+
+func (d *decoder) userEvents() []UserEvent {
+	count := d.count()
+	if count == 0 {
+		return nil
+	}
+	events := make([]UserEvent, 0, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		events = append(events, UserEvent{
+			Name:    d.string(),
+			Payload: d.bytes(),
+			LTime:   d.uvarint(),
+			Origin:  d.string(),
+		})
+	}
+	return events
+}
+
+func (d *decoder) configEntries() []ConfigEntry {
+	count := d.count()
+	if count == 0 {
+		return nil
+	}
+	entries := make([]ConfigEntry, 0, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		entries = append(entries, ConfigEntry{
+			Key:       d.string(),
+			Value:     d.string(),
+			Version:   d.uvarint(),
+			UpdatedBy: d.string(),
+			Deleted:   d.bool(),
+		})
+	}
+	return entries
+}
+
+func (d *decoder) queryRequest() *queryRequest {
+	if !d.bool() {
+		return nil
+	}
+	return &queryRequest{
+		Name:    d.string(),
+		Payload: d.bytes(),
+		LTime:   d.uvarint(),
+		Tags:    d.tags(),
+		Timeout: time.Duration(d.varint()),
+	}
+}
+
+func (d *decoder) queryResponse() *queryResponse {
+	if !d.bool() {
+		return nil
+	}
+	return &queryResponse{
+		Responded: d.bool(),
+		Payload:   d.bytes(),
+		Error:     d.string(),
+	}
+}
+
+func (d *decoder) leaseRequest() *leaseRequest {
+	if !d.bool() {
+		return nil
+	}
+	return &leaseRequest{
+		Name:     d.string(),
+		Token:    d.uvarint(),
+		Duration: time.Duration(d.varint()),
+		Renewal:  d.bool(),
+		Release:  d.bool(),
+	}
+}
+
+func (d *decoder) leaseGrant() *leaseGrant {
+	if !d.bool() {
+		return nil
+	}
+	return &leaseGrant{
+		Granted: d.bool(),
+		Holder:  d.string(),
+		Token:   d.uvarint(),
+	}
+}
+
+func (d *decoder) float64() float64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 8 {
+		d.fail(fmt.Errorf("unexpected end of data"))
+		return 0
+	}
+	f := math.Float64frombits(binary.BigEndian.Uint64(d.buf[:8]))
+	d.buf = d.buf[8:]
+	return f
+}
+
+func (d *decoder) coordinate() *Coordinate {
+	if !d.bool() {
+		return nil
+	}
+	coordinate := &Coordinate{Vec: make([]float64, d.count())}
+	for i := range coordinate.Vec {
+		coordinate.Vec[i] = d.float64()
+	}
+	coordinate.Error = d.float64()
+	coordinate.Adjustment = d.float64()
+	coordinate.Height = d.float64()
+	return coordinate
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Every field is set, so that a field the codec misses fails the round trip
+func testGossipMessage(kind gossipMessageKind) *gossipMessage {
+	return &gossipMessage{
+		Kind:          kind,
+		NodeID:        "node-1",
+		RemoteAddress: "127.0.0.1:9001",
+		Incarnation:   3,
+		Timestamp:     time.Unix(1600000000, 123),
+		Tags:          map[string]string{"role": "web", "region": "eu"},
+		Zone:          "zone-a",
+		Votes:         2,
+		Target:        "node-2",
+		TargetAddress: "127.0.0.1:9002",
+		Updates:       testMembershipUpdates(),
+		Members:       testMembershipUpdates(),
+		Reachability: []reachabilityReport{
+			{NodeID: "node-1", ChangedAt: time.Unix(1600000001, 0), Unreachable: []NodeID{"node-3", "node-4"}},
+		},
+		Events: []UserEvent{{Name: "deploy", Payload: []byte("v2"), LTime: 7, Origin: "node-2"}},
+		Config: []ConfigEntry{
+			{Key: "feature", Value: "on", Version: 4, UpdatedBy: "node-1"},
+			{Key: "old", Version: 5, UpdatedBy: "node-2", Deleted: true},
+		},
+		Query:      &queryRequest{Name: "ping", Payload: []byte("?"), LTime: 8, Tags: map[string]string{"role": "web"}, Timeout: time.Second},
+		Lease:      &leaseRequest{Name: "job", Token: 9, Duration: time.Minute, Renewal: true, Release: true},
+		Coordinate: testCoordinate(),
+	}
+}
+
+func testGossipReply() *gossipReply {
+	return &gossipReply{
+		NodeID:      "node-2",
+		Incarnation: 4,
+		Timestamp:   time.Unix(1600000000, 456),
+		Ack:         true,
+		Zone:        "zone-b",
+		Votes:       1,
+		Updates:     testMembershipUpdates(),
+		Members:     testMembershipUpdates(),
+		Reachability: []reachabilityReport{
+			{NodeID: "node-2", ChangedAt: time.Unix(1600000002, 0), Unreachable: []NodeID{"node-3"}},
+		},
+		Events:        []UserEvent{{Name: "deploy", Payload: []byte("v3"), LTime: 10, Origin: "node-1"}},
+		Config:        []ConfigEntry{{Key: "feature", Value: "off", Version: 6, UpdatedBy: "node-2"}},
+		QueryResponse: &queryResponse{Responded: true, Payload: []byte("pong"), Error: "partial"},
+		LeaseGrant:    &leaseGrant{Granted: true, Holder: "node-1", Token: 9},
+		Coordinate:    testCoordinate(),
+	}
+}
+
+func testMembershipUpdates() []membershipUpdate {
+	return []membershipUpdate{
+		{NodeID: "node-2", RemoteAddress: "127.0.0.1:9002", State: NodeAlive, Incarnation: 1, Tags: map[string]string{"role": "db"}, Zone: "zone-b", Votes: 1, From: "node-1"},
+		{NodeID: "node-3", State: NodeSuspect, Incarnation: 2, From: "node-2"},
+		{NodeID: "node-4", State: NodeDead, Incarnation: 3},
+		{NodeID: "node-5", State: NodeLeft, Incarnation: 4},
+	}
+}
+
+func testCoordinate() *Coordinate {
+	return &Coordinate{Vec: []float64{0.001, -0.002, 0.5}, Error: 0.25, Adjustment: -0.0001, Height: 0.00001}
+}
+
+func expectEveryFieldSet(t *testing.T, name string, value interface{}) {
+	t.Helper()
+	v := reflect.ValueOf(value).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Fatalf("expected the test %s to set %s", name, v.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestGossipMessagesRoundTrip(t *testing.T) {
+	kinds := []gossipMessageKind{}
+	for kind := range gossipMessageKindCodes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		t.Run(kind, func(t *testing.T) {
+			for _, message := range []*gossipMessage{testGossipMessage(kind), {Kind: kind}} {
+				messageBytes, err := encodeGossipMessage(message)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := decodeGossipMessage(messageBytes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(decoded, message) {
+					t.Fatalf("expected %+v, got %+v", message, decoded)
+				}
+			}
+		})
+	}
+	expectEveryFieldSet(t, "message", testGossipMessage(pingMessage))
+}
+
+func TestGossipRepliesRoundTrip(t *testing.T) {
+	for _, reply := range []*gossipReply{testGossipReply(), {}} {
+		decoded, err := decodeGossipReply(encodeGossipReply(reply))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, reply) {
+			t.Fatalf("expected %+v, got %+v", reply, decoded)
+		}
+	}
+	expectEveryFieldSet(t, "reply", testGossipReply())
+}
+
+func TestEncodingMessageOfUnknownKindFails(t *testing.T) {
+	if _, err := encodeGossipMessage(&gossipMessage{Kind: "unknown"}); err == nil {
+		t.Fatal("expected encoding a message of unknown kind to fail")
+	}
+}
+
+func TestDecodingMalformedGossipFails(t *testing.T) {
+	messageBytes, err := encodeGossipMessage(testGossipMessage(pingMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyBytes := encodeGossipReply(testGossipReply())
+
+	for i := range messageBytes {
+		if _, err := decodeGossipMessage(messageBytes[:i]); err == nil {
+			t.Fatalf("expected a message truncated to %d of %d bytes not to decode", i, len(messageBytes))
+		}
+	}
+	for i := range replyBytes {
+		if _, err := decodeGossipReply(replyBytes[:i]); err == nil {
+			t.Fatalf("expected a reply truncated to %d of %d bytes not to decode", i, len(replyBytes))
+		}
+	}
+
+	wrongVersion := append([]byte{codecVersion + 1}, messageBytes[1:]...)
+	if _, err := decodeGossipMessage(wrongVersion); err == nil {
+		t.Fatal("expected a message of another version not to decode")
+	}
+	wrongVersion = append([]byte{codecVersion + 1}, replyBytes[1:]...)
+	if _, err := decodeGossipReply(wrongVersion); err == nil {
+		t.Fatal("expected a reply of another version not to decode")
+	}
+	unknownKind := append([]byte{codecVersion, 255}, messageBytes[2:]...)
+	if _, err := decodeGossipMessage(unknownKind); err == nil {
+		t.Fatal("expected a message of unknown kind not to decode")
+	}
+}
+
+// A corrupt count or length must fail rather than allocate what it claims
+func TestDecodingOversizedCountsFails(t *testing.T) {
+	const oversized = 1 << 40
+	header := func() *encoder {
+		e := &encoder{}
+		e.byte(codecVersion)
+		e.byte(gossipMessageKindCodes[pingMessage])
+		return e
+	}
+	tests := []struct {
+		name   string
+		encode func(e *encoder)
+	}{
+		{"string length", func(e *encoder) {
+			e.uvarint(oversized)
+		}},
+		{"tag count", func(e *encoder) {
+			e.string("node-1")
+			e.string("127.0.0.1:9001")
+			e.uvarint(1)
+			e.time(time.Time{})
+			e.uvarint(oversized)
+		}},
+		{"update count", func(e *encoder) {
+			e.string("node-1")
+			e.string("127.0.0.1:9001")
+			e.uvarint(1)
+			e.time(time.Time{})
+			e.tags(nil)
+			e.string("")
+			e.varint(0)
+			e.string("")
+			e.uvarint(oversized)
+		}},
+		{"varint longer than 64 bits", func(e *encoder) {
+			e.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := header()
+			test.encode(e)
+			// Enough trailing data that the count isn't simply past the end
+			e.Write(make([]byte, 64))
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := decodeGossipMessage(e.Bytes())
+			runtime.ReadMemStats(&after)
+			if err == nil {
+				t.Fatal("expected decoding to fail")
+			}
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+				t.Fatalf("expected decoding to allocate little, allocated %d bytes", allocated)
+			}
+		})
+	}
+}
+
+// Randomly corrupts valid encodings, from a fixed seed so that failures can
+// be reproduced. Decoding has to return, with or without an error, rather
+// than panic.
+func TestDecodingCorruptGossipDoesntPanic(t *testing.T) {
+	messageBytes, err := encodeGossipMessage(testGossipMessage(pushPullMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyBytes := encodeGossipReply(testGossipReply())
+	random := rand.New(rand.NewSource(1))
+	corrupt := func(valid []byte) []byte {
+		corrupted := append([]byte{}, valid...)
+		for i := random.Intn(4); i >= 0; i-- {
+			position := random.Intn(len(corrupted))
+			switch random.Intn(3) {
+			case 0:
+				corrupted[position] = byte(random.Intn(256))
+			case 1:
+				corrupted = corrupted[:position]
+			case 2:
+				corrupted = append(corrupted[:position], corrupted[position+1:]...)
+			}
+			if len(corrupted) == 0 {
+				break
+			}
+		}
+		return corrupted
+	}
+
+	for i := 0; i < 10000; i++ {
+		decodeGossipMessage(corrupt(messageBytes))
+		decodeGossipReply(corrupt(replyBytes))
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is everything a node needs to start, taken from its section of the
+// cluster config file. Anything not set in the file has a default.
+type Config struct {
+	NodeID        NodeID
+	ListenAddress string
+	RemoteAddress string
+	LogLevel      string
+	// Address to serve the read-only status API and metrics on, or empty to
+	// not serve them
+	StatusAddress string
+	// Address to serve the admin API on, which can change the keyring, or
+	// empty to not serve it
+	AdminAddress string
+	// Metadata gossiped to other nodes, such as role
+	Tags map[string]string
+	// The failure domain this node is in, such as a rack or availability
+	// zone, and its weight in quorum decisions
+	Zone  string
+	Votes int
+	// Base64 AES keys to encrypt gossip with. The first is the primary key,
+	// which gossip is encrypted with. Gossip isn't encrypted if this is empty.
+	EncryptionKeys []string
+	// Either udp, or http which is slower but supports Mutual TLS
+	Transport string
+	TLS       TLSConfig
+
+	GossipSettings GossipSettings
+}
+
+type TLSConfig struct {
+	CAFile   string `yaml:"ca_file"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+func DefaultConfig(nodeID NodeID) *Config {
+	return &Config{
+		NodeID:    nodeID,
+		LogLevel:  "info",
+		Transport: "udp",
+		GossipSettings: GossipSettings{
+			GossipRegularity:         1 * time.Second,
+			NodeTimeoutAfter:         5 * time.Second,
+			MaxNodeTimeoutMultiplier: 4,
+			SuspicionConfirmations:   3,
+			MaxLocalHealth:           8,
+			ProbeTimeout:             300 * time.Millisecond,
+			IndirectProbeCount:       3,
+			MaxPiggybackedUpdates:    10,
+			RetransmitMultiplier:     4,
+			LeaderLeaseDuration:      10 * time.Second,
+			QuorumPolicy:             QuorumMajorityOfVotes,
+			PushPullInterval:         30 * time.Second,
+			StateSaveInterval:        10 * time.Second,
+		},
+	}
+}
+
+// LoadConfig reads the section of the config file for a node. It is not an
+// error for the node to be missing from the file, as nodes not in the file
+// can join the cluster, but their addresses must then be set some other way.
+func LoadConfig(path string, nodeID NodeID) (*Config, error) {
+	var config struct {
+		Nodes []struct {
+			ID             NodeID            `yaml:"id"`
+			RemoteAddress  string            `yaml:"remote_address"`
+			ListenAddress  string            `yaml:"listen_address"`
+			LogLevel       string            `yaml:"log_level"`
+			StatusAddress  string            `yaml:"status_address"`
+			AdminAddress   string            `yaml:"admin_address"`
+			Tags           map[string]string `yaml:"tags"`
+			Zone           string            `yaml:"zone"`
+			Votes          int               `yaml:"votes"`
+			EncryptionKeys []string          `yaml:"encryption_keys"`
+			Transport      string            `yaml:"transport"`
+			TLS            TLSConfig         `yaml:"tls"`
+
+			GossipRegularity         time.Duration  `yaml:"gossip_regularity"`
+			NodeTimeoutAfter         time.Duration  `yaml:"node_timeout_after"`
+			MaxNodeTimeoutMultiplier int            `yaml:"max_node_timeout_multiplier"`
+			SuspicionConfirmations   *int           `yaml:"suspicion_confirmations"`
+			MaxLocalHealth           *int           `yaml:"max_local_health"`
+			ProbeTimeout             time.Duration  `yaml:"probe_timeout"`
+			IndirectProbeCount       *int           `yaml:"indirect_probe_count"`
+			MaxPiggybackedUpdates    int            `yaml:"max_piggybacked_updates"`
+			RetransmitMultiplier     int            `yaml:"retransmit_multiplier"`
+			LeaderLeaseDuration      time.Duration  `yaml:"leader_lease_duration"`
+			PushPullInterval         *time.Duration `yaml:"push_pull_interval"`
+			QuorumPolicy             QuorumPolicy   `yaml:"quorum_policy"`
+			ExpectedClusterSize      int            `yaml:"expected_cluster_size"`
+			StateFile                string         `yaml:"state_file"`
+			StateSaveInterval        *time.Duration `yaml:"state_save_interval"`
+		} `yaml:"nodes"`
+	}
+	yamlBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	if err = yaml.Unmarshal(yamlBytes, &config); err != nil {
+		return nil, fmt.Errorf("error deserialising config file: %w", err)
+	}
+
+	parsedConfig := DefaultConfig(nodeID)
+	for _, nodeConfig := range config.Nodes {
+		if nodeConfig.ID != nodeID {
+			continue
+		}
+		parsedConfig.RemoteAddress = nodeConfig.RemoteAddress
+		parsedConfig.ListenAddress = nodeConfig.ListenAddress
+		if nodeConfig.LogLevel != "" {
+			parsedConfig.LogLevel = nodeConfig.LogLevel
+		}
+		parsedConfig.StatusAddress = nodeConfig.StatusAddress
+		parsedConfig.AdminAddress = nodeConfig.AdminAddress
+		parsedConfig.Tags = nodeConfig.Tags
+		parsedConfig.Zone = nodeConfig.Zone
+		parsedConfig.Votes = nodeConfig.Votes
+		parsedConfig.EncryptionKeys = nodeConfig.EncryptionKeys
+		if nodeConfig.Transport != "" {
+			parsedConfig.Transport = nodeConfig.Transport
+		}
+		parsedConfig.TLS = nodeConfig.TLS
+
+		settings := &parsedConfig.GossipSettings
+		if nodeConfig.GossipRegularity != 0 {
+			settings.GossipRegularity = nodeConfig.GossipRegularity
+		}
+		if nodeConfig.NodeTimeoutAfter != 0 {
+			settings.NodeTimeoutAfter = nodeConfig.NodeTimeoutAfter
+		}
+		if nodeConfig.MaxNodeTimeoutMultiplier != 0 {
+			settings.MaxNodeTimeoutMultiplier = nodeConfig.MaxNodeTimeoutMultiplier
+		}
+		if nodeConfig.SuspicionConfirmations != nil {
+			settings.SuspicionConfirmations = *nodeConfig.SuspicionConfirmations
+		}
+		if nodeConfig.MaxLocalHealth != nil {
+			settings.MaxLocalHealth = *nodeConfig.MaxLocalHealth
+		}
+		if nodeConfig.ProbeTimeout != 0 {
+			settings.ProbeTimeout = nodeConfig.ProbeTimeout
+		}
+		if nodeConfig.IndirectProbeCount != nil {
+			settings.IndirectProbeCount = *nodeConfig.IndirectProbeCount
+		}
+		if nodeConfig.MaxPiggybackedUpdates != 0 {
+			settings.MaxPiggybackedUpdates = nodeConfig.MaxPiggybackedUpdates
+		}
+		if nodeConfig.RetransmitMultiplier != 0 {
+			settings.RetransmitMultiplier = nodeConfig.RetransmitMultiplier
+		}
+		if nodeConfig.LeaderLeaseDuration != 0 {
+			settings.LeaderLeaseDuration = nodeConfig.LeaderLeaseDuration
+		}
+		if nodeConfig.PushPullInterval != nil {
+			settings.PushPullInterval = *nodeConfig.PushPullInterval
+		}
+		if nodeConfig.QuorumPolicy != "" {
+			settings.QuorumPolicy = nodeConfig.QuorumPolicy
+		}
+		settings.ExpectedClusterSize = nodeConfig.ExpectedClusterSize
+		settings.StateFile = nodeConfig.StateFile
+		if nodeConfig.StateSaveInterval != nil {
+			settings.StateSaveInterval = *nodeConfig.StateSaveInterval
+		}
+	}
+	return parsedConfig, nil
+}
+
+// Validate checks the config without changing it
+func (c *Config) Validate() error {
+	if c.NodeID == "" {
+		return fmt.Errorf("config must specify a node id")
+	}
+	if c.RemoteAddress == "" {
+		return fmt.Errorf("config must specify a remote address for node '%s'", c.NodeID)
+	}
+	if err := validateLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if err := validateTags(c.Tags); err != nil {
+		return err
+	}
+	if c.Votes < 0 {
+		return fmt.Errorf("votes must not be negative, got %d", c.Votes)
+	}
+	for i, encodedKey := range c.EncryptionKeys {
+		if _, err := ParseKey(encodedKey); err != nil {
+			return fmt.Errorf("encryption key %d is invalid: %w", i+1, err)
+		}
+	}
+
+	tlsFiles := 0
+	for _, file := range []string{c.TLS.CAFile, c.TLS.CertFile, c.TLS.KeyFile} {
+		if file != "" {
+			tlsFiles += 1
+		}
+	}
+	if tlsFiles != 0 && tlsFiles != 3 {
+		return fmt.Errorf("config must specify all of a TLS CA file, cert file and key file, or none of them")
+	}
+	switch c.Transport {
+	case "udp":
+		if tlsFiles != 0 {
+			return fmt.Errorf("mutual TLS is only supported by the http transport")
+		}
+	case "http":
+	default:
+		return fmt.Errorf("unknown transport '%s', must be udp or http", c.Transport)
+	}
+
+	settings := c.GossipSettings
+	if settings.GossipRegularity <= 0 {
+		return fmt.Errorf("gossip regularity must be positive, got %s", settings.GossipRegularity)
+	}
+	if settings.ProbeTimeout <= 0 || settings.ProbeTimeout >= settings.GossipRegularity {
+		return fmt.Errorf("probe timeout must be positive and less than gossip regularity, got %s", settings.ProbeTimeout)
+	}
+	if settings.NodeTimeoutAfter <= 0 {
+		return fmt.Errorf("node timeout must be positive, got %s", settings.NodeTimeoutAfter)
+	}
+	if settings.MaxNodeTimeoutMultiplier < 1 {
+		return fmt.Errorf("max node timeout multiplier must be at least 1, got %d", settings.MaxNodeTimeoutMultiplier)
+	}
+	if settings.SuspicionConfirmations < 0 {
+		return fmt.Errorf("suspicion confirmations must not be negative, got %d", settings.SuspicionConfirmations)
+	}
+	if settings.MaxLocalHealth < 0 {
+		return fmt.Errorf("max local health must not be negative, got %d", settings.MaxLocalHealth)
+	}
+	if settings.IndirectProbeCount < 0 {
+		return fmt.Errorf("indirect probe count must not be negative, got %d", settings.IndirectProbeCount)
+	}
+	if settings.MaxPiggybackedUpdates <= 0 {
+		return fmt.Errorf("max piggybacked updates must be positive, got %d", settings.MaxPiggybackedUpdates)
+	}
+	if settings.RetransmitMultiplier <= 0 {
+		return fmt.Errorf("retransmit multiplier must be positive, got %d", settings.RetransmitMultiplier)
+	}
+	if settings.LeaderLeaseDuration <= 2*settings.GossipRegularity {
+		return fmt.Errorf("leader lease duration must be more than twice gossip regularity, got %s", settings.LeaderLeaseDuration)
+	}
+	if settings.PushPullInterval < 0 {
+		return fmt.Errorf("push-pull interval must not be negative, got %s", settings.PushPullInterval)
+	}
+	if settings.StateSaveInterval < 0 {
+		return fmt.Errorf("state save interval must not be negative, got %s", settings.StateSaveInterval)
+	}
+	if settings.ExpectedClusterSize < 0 {
+		return fmt.Errorf("expected cluster size must not be negative, got %d", settings.ExpectedClusterSize)
+	}
+	switch settings.QuorumPolicy {
+	case QuorumMajorityOfVotes, QuorumMajorityOfZones:
+	default:
+		return fmt.Errorf("unknown quorum policy '%s', must be majority or zones", settings.QuorumPolicy)
+	}
+	return nil
+}
+
+// Tags are gossiped in every alive update, so they must be small
+const maxTagsSize = 512
+
+func validateTags(tags map[string]string) error {
+	size := 0
+	for key, value := range tags {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("tag keys must not be empty or contain '=', got '%s'", key)
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxTagsSize {
+		return fmt.Errorf("tags must be at most %d bytes in total, got %d", maxTagsSize, size)
+	}
+	return nil
+}
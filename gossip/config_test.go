@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected func(config *Config)
+	}{
+		{
+			name:     "node missing from the file",
+			yaml:     "nodes:\n  - id: node-2\n    remote_address: 127.0.0.1:8002\n",
+			expected: func(config *Config) {},
+		},
+		{
+			name: "defaults",
+			yaml: "nodes:\n  - id: node-1\n    remote_address: 127.0.0.1:8001\n",
+			expected: func(config *Config) {
+				config.RemoteAddress = "127.0.0.1:8001"
+			},
+		},
+		{
+			name: "overrides",
+			yaml: `nodes:
+  - id: node-1
+    remote_address: 127.0.0.1:8001
+    listen_address: :8001
+    log_level: debug
+    transport: http
+    tags:
+      role: web
+    zone: zone-a
+    votes: 2
+    gossip_regularity: 2s
+    probe_timeout: 500ms
+    suspicion_confirmations: 5
+    push_pull_interval: 1m
+    quorum_policy: zones
+    expected_cluster_size: 5
+`,
+			expected: func(config *Config) {
+				config.RemoteAddress = "127.0.0.1:8001"
+				config.ListenAddress = ":8001"
+				config.LogLevel = "debug"
+				config.Transport = "http"
+				config.Tags = map[string]string{"role": "web"}
+				config.Zone = "zone-a"
+				config.Votes = 2
+				config.GossipSettings.GossipRegularity = 2 * time.Second
+				config.GossipSettings.ProbeTimeout = 500 * time.Millisecond
+				config.GossipSettings.SuspicionConfirmations = 5
+				config.GossipSettings.PushPullInterval = time.Minute
+				config.GossipSettings.QuorumPolicy = QuorumMajorityOfZones
+				config.GossipSettings.ExpectedClusterSize = 5
+			},
+		},
+		{
+			// Zero is a setting of its own for these, rather than the default
+			name: "pointer fields set to zero",
+			yaml: `nodes:
+  - id: node-1
+    suspicion_confirmations: 0
+    max_local_health: 0
+    indirect_probe_count: 0
+    push_pull_interval: 0s
+    state_save_interval: 0s
+`,
+			expected: func(config *Config) {
+				config.GossipSettings.SuspicionConfirmations = 0
+				config.GossipSettings.MaxLocalHealth = 0
+				config.GossipSettings.IndirectProbeCount = 0
+				config.GossipSettings.PushPullInterval = 0
+				config.GossipSettings.StateSaveInterval = 0
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yml")
+			if err := ioutil.WriteFile(path, []byte(test.yaml), 0600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := LoadConfig(path, "node-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := DefaultConfig("node-1")
+			test.expected(expected)
+			if !reflect.DeepEqual(config, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, config)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFailsOnUnreadableFiles(t *testing.T) {
+	dir := t.TempDir()
+	malformed := filepath.Join(dir, "malformed.yml")
+	if err := ioutil.WriteFile(malformed, []byte("nodes: {"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "missing.yml"), malformed} {
+		if _, err := LoadConfig(path, "node-1"); err == nil {
+			t.Fatalf("expected loading '%s' to fail", path)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(config *Config)
+		valid  bool
+	}{
+		{"defaults", func(config *Config) {}, true},
+		{"mutual TLS", func(config *Config) {
+			config.Transport = "http"
+			config.TLS = TLSConfig{CAFile: "ca.pem", CertFile: "node-1.pem", KeyFile: "node-1-key.pem"}
+		}, true},
+		{"no node ID", func(config *Config) { config.NodeID = "" }, false},
+		{"no remote address", func(config *Config) { config.RemoteAddress = "" }, false},
+		{"unknown log level", func(config *Config) { config.LogLevel = "verbose" }, false},
+		{"tag key with '='", func(config *Config) { config.Tags = map[string]string{"a=b": "c"} }, false},
+		{"negative votes", func(config *Config) { config.Votes = -1 }, false},
+		{"invalid encryption key", func(config *Config) { config.EncryptionKeys = []string{"not base64"} }, false},
+		{"some TLS files", func(config *Config) {
+			config.Transport = "http"
+			config.TLS = TLSConfig{CAFile: "ca.pem", CertFile: "node-1.pem"}
+		}, false},
+		{"TLS with udp", func(config *Config) {
+			config.TLS = TLSConfig{CAFile: "ca.pem", CertFile: "node-1.pem", KeyFile: "node-1-key.pem"}
+		}, false},
+		{"unknown transport", func(config *Config) { config.Transport = "tcp" }, false},
+		{"probe timeout as long as gossip regularity", func(config *Config) {
+			config.GossipSettings.ProbeTimeout = config.GossipSettings.GossipRegularity
+		}, false},
+		{"lease duration of twice gossip regularity", func(config *Config) {
+			config.GossipSettings.LeaderLeaseDuration = 2 * config.GossipSettings.GossipRegularity
+		}, false},
+		{"negative push-pull interval", func(config *Config) { config.GossipSettings.PushPullInterval = -time.Second }, false},
+		{"negative expected cluster size", func(config *Config) { config.GossipSettings.ExpectedClusterSize = -1 }, false},
+		{"unknown quorum policy", func(config *Config) { config.GossipSettings.QuorumPolicy = "unanimous" }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig("node-1")
+			config.RemoteAddress = "127.0.0.1:8001"
+			test.change(config)
+			if err := config.Validate(); (err == nil) != test.valid {
+				t.Fatalf("expected valid to be %v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestValidatingConfigDoesntChangeIt(t *testing.T) {
+	config := DefaultConfig("node-1")
+	config.RemoteAddress = "127.0.0.1:8001"
+	config.LogLevel = "debug"
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddress != "" {
+		t.Fatalf("expected the listen address to be left unset, got '%s'", config.ListenAddress)
+	}
+	// TestMain discards debug logs
+	if debugLog.Writer() != ioutil.Discard {
+		t.Fatal("expected the log level to be left alone")
+	}
+}
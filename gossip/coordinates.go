@@ -0,0 +1,292 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Each node keeps Vivaldi network coordinates, so that the round trip time to
+// any member can be estimated without measuring it. A node's coordinates move
+// after every successful direct probe, so that the distance to the probed
+// node's coordinates better matches the round trip time. Nodes send their
+// coordinates with pings and acks, and keep the latest they have received
+// from each member.
+//
+// This follows Vivaldi with the height vectors, adjustment terms and gravity
+// towards the origin used by Serf, and a median filter over recent round
+// trip times to each member to ignore outliers.
+
+const (
+	coordinateDimensionality = 8
+	vivaldiErrorMax          = 1.5
+	vivaldiCE                = 0.25
+	vivaldiCC                = 0.25
+	adjustmentWindowSize     = 20
+	heightMin                = 10.0e-6
+	latencyFilterSize        = 3
+	gravityRho               = 150.0
+	zeroThreshold            = 1.0e-6
+	// Round trips longer than this are assumed to be mismeasured
+	maxCoordinateRTT = 10 * time.Second
+)
+
+// Coordinate is a position in seconds. Height models the time taken to get
+// from a node onto the core of the network, and Adjustment corrects for
+// distances that can't be embedded in Euclidean space.
+type Coordinate struct {
+	Vec        []float64 `json:"vec" yaml:"vec"`
+	Error      float64   `json:"error" yaml:"error"`
+	Adjustment float64   `json:"adjustment" yaml:"adjustment"`
+	Height     float64   `json:"height" yaml:"height"`
+}
+
+func newCoordinate() Coordinate {
+	return Coordinate{
+		Vec:    make([]float64, coordinateDimensionality),
+		Error:  vivaldiErrorMax,
+		Height: heightMin,
+	}
+}
+
+func (c Coordinate) clone() Coordinate {
+	c.Vec = append([]float64{}, c.Vec...)
+	return c
+}
+
+func (c Coordinate) isValid() bool {
+	if len(c.Vec) != coordinateDimensionality {
+		return false
+	}
+	for _, component := range c.Vec {
+		if math.IsNaN(component) || math.IsInf(component, 0) {
+			return false
+		}
+	}
+	for _, value := range []float64{c.Error, c.Adjustment, c.Height} {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// DistanceTo estimates the round trip time between two coordinates
+func (c Coordinate) DistanceTo(other Coordinate) time.Duration {
+	distance := c.rawDistanceTo(other)
+	if adjusted := distance + c.Adjustment + other.Adjustment; adjusted > 0 {
+		distance = adjusted
+	}
+	return time.Duration(distance * float64(time.Second))
+}
+
+func (c Coordinate) rawDistanceTo(other Coordinate) float64 {
+	return magnitude(difference(c.Vec, other.Vec)) + c.Height + other.Height
+}
+
+// Moves the coordinate towards other by force seconds, or away if negative
+func (c Coordinate) applyForce(force float64, other Coordinate, random *rand.Rand) Coordinate {
+	moved := c.clone()
+	unit, distance := unitVectorAt(c.Vec, other.Vec, random)
+	for i := range moved.Vec {
+		moved.Vec[i] += unit[i] * force
+	}
+	if distance > zeroThreshold {
+		moved.Height = (moved.Height+other.Height)*force/distance + moved.Height
+		moved.Height = math.Max(moved.Height, heightMin)
+	}
+	return moved
+}
+
+// The unit vector from b to a, and the distance between them. Coordinates
+// in the same place are pushed apart in a random direction.
+func unitVectorAt(a, b []float64, random *rand.Rand) ([]float64, float64) {
+	unit := difference(a, b)
+	if distance := magnitude(unit); distance > zeroThreshold {
+		for i := range unit {
+			unit[i] /= distance
+		}
+		return unit, distance
+	}
+	for i := range unit {
+		unit[i] = random.Float64() - 0.5
+	}
+	if distance := magnitude(unit); distance > zeroThreshold {
+		for i := range unit {
+			unit[i] /= distance
+		}
+		return unit, 0
+	}
+	unit = make([]float64, len(unit))
+	unit[0] = 1
+	return unit, 0
+}
+
+func difference(a, b []float64) []float64 {
+	result := make([]float64, len(a))
+	for i := range a {
+		result[i] = a[i] - b[i]
+	}
+	return result
+}
+
+func magnitude(v []float64) float64 {
+	sum := 0.0
+	for _, component := range v {
+		sum += component * component
+	}
+	return math.Sqrt(sum)
+}
+
+type vivaldi struct {
+	coordinate        Coordinate
+	adjustmentIndex   int
+	adjustmentSamples []float64
+	latencySamples    map[NodeID][]float64
+	// The latest coordinates received from each member
+	peers map[NodeID]Coordinate
+}
+
+func newVivaldi() vivaldi {
+	return vivaldi{
+		coordinate:        newCoordinate(),
+		adjustmentSamples: make([]float64, adjustmentWindowSize),
+		latencySamples:    map[NodeID][]float64{},
+		peers:             map[NodeID]Coordinate{},
+	}
+}
+
+// Must be called with the lock held. Remembers a member's coordinates.
+func (g *Gossip) learnCoordinate(nodeID NodeID, coordinate *Coordinate) {
+	if coordinate == nil || nodeID == g.Node.ID || !coordinate.isValid() {
+		return
+	}
+	g.coordinates.peers[nodeID] = coordinate.clone()
+}
+
+// Must be called with the lock held. Forgets a member that is dead or has
+// left, until it sends its coordinates again.
+func (g *Gossip) forgetCoordinate(nodeID NodeID) {
+	delete(g.coordinates.peers, nodeID)
+	delete(g.coordinates.latencySamples, nodeID)
+}
+
+// Must be called with the lock held. Moves this node's coordinates after
+// measuring the round trip time to a member.
+func (g *Gossip) updateCoordinate(nodeID NodeID, coordinate *Coordinate, rtt time.Duration) {
+	if coordinate == nil || !coordinate.isValid() || rtt <= 0 || rtt > maxCoordinateRTT {
+		return
+	}
+	g.learnCoordinate(nodeID, coordinate)
+	v := &g.coordinates
+	rttSeconds := v.filterLatency(nodeID, rtt.Seconds())
+	v.updateVivaldi(*coordinate, rttSeconds, g.random)
+	v.updateAdjustment(*coordinate, rttSeconds)
+	v.updateGravity(g.random)
+	if !v.coordinate.isValid() {
+		warnLog.Println("resetting network coordinates as they became invalid")
+		v.coordinate = newCoordinate()
+	}
+}
+
+// Returns the median of the latest round trip times to a member
+func (v *vivaldi) filterLatency(nodeID NodeID, rttSeconds float64) float64 {
+	samples := append(v.latencySamples[nodeID], rttSeconds)
+	if len(samples) > latencyFilterSize {
+		samples = samples[1:]
+	}
+	v.latencySamples[nodeID] = samples
+
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)/2]
+}
+
+func (v *vivaldi) updateVivaldi(other Coordinate, rttSeconds float64, random *rand.Rand) {
+	rttSeconds = math.Max(rttSeconds, zeroThreshold)
+	distance := v.coordinate.DistanceTo(other).Seconds()
+	wrongness := math.Abs(distance-rttSeconds) / rttSeconds
+
+	totalError := math.Max(v.coordinate.Error+other.Error, zeroThreshold)
+	weight := v.coordinate.Error / totalError
+	v.coordinate.Error = vivaldiCE*weight*wrongness + v.coordinate.Error*(1.0-vivaldiCE*weight)
+	v.coordinate.Error = math.Min(v.coordinate.Error, vivaldiErrorMax)
+
+	force := vivaldiCC * weight * (rttSeconds - distance)
+	v.coordinate = v.coordinate.applyForce(force, other, random)
+}
+
+// The adjustment is half the average error over recent round trips, which
+// can't be removed by moving in Euclidean space
+func (v *vivaldi) updateAdjustment(other Coordinate, rttSeconds float64) {
+	v.adjustmentSamples[v.adjustmentIndex] = rttSeconds - v.coordinate.rawDistanceTo(other)
+	v.adjustmentIndex = (v.adjustmentIndex + 1) % adjustmentWindowSize
+	sum := 0.0
+	for _, sample := range v.adjustmentSamples {
+		sum += sample
+	}
+	v.coordinate.Adjustment = sum / (2.0 * adjustmentWindowSize)
+}
+
+// Pulls coordinates back towards the origin, so that the whole cluster
+// doesn't drift away over time
+func (v *vivaldi) updateGravity(random *rand.Rand) {
+	origin := newCoordinate()
+	distance := origin.DistanceTo(v.coordinate).Seconds()
+	force := -1.0 * math.Pow(distance/gravityRho, 2.0)
+	v.coordinate = v.coordinate.applyForce(force, origin, random)
+}
+
+// Coordinate returns this node's network coordinates
+func (g *Gossip) Coordinate() Coordinate {
+	g.Lock()
+	defer g.Unlock()
+	return g.coordinates.coordinate.clone()
+}
+
+// EstimateRTT estimates the round trip time to a member from its coordinates.
+// Returns false if its coordinates aren't known yet.
+func (g *Gossip) EstimateRTT(nodeID NodeID) (time.Duration, bool) {
+	g.Lock()
+	defer g.Unlock()
+	return g.estimateRTT(nodeID)
+}
+
+// Must be called with the lock held
+func (g *Gossip) estimateRTT(nodeID NodeID) (time.Duration, bool) {
+	if nodeID == g.Node.ID {
+		return 0, true
+	}
+	coordinate, ok := g.coordinates.peers[nodeID]
+	if !ok {
+		return 0, false
+	}
+	return g.coordinates.coordinate.DistanceTo(coordinate), true
+}
+
+// MembersByProximity lists alive members with the tags, including this node,
+// nearest first. Members whose coordinates aren't known yet come last.
+func (g *Gossip) MembersByProximity(tags map[string]string) []NodeDescription {
+	members := g.MembersWithTags(tags)
+	g.Lock()
+	defer g.Unlock()
+	sort.SliceStable(members, func(i, j int) bool {
+		return g.closerThan(members[i].ID, members[j].ID)
+	})
+	return members
+}
+
+// Must be called with the lock held. Orders members by estimated round trip
+// time, then by ID, with members whose coordinates aren't known last.
+func (g *Gossip) closerThan(a, b NodeID) bool {
+	rttA, knownA := g.estimateRTT(a)
+	rttB, knownB := g.estimateRTT(b)
+	if knownA != knownB {
+		return knownA
+	}
+	if rttA != rttB {
+		return rttA < rttB
+	}
+	return a < b
+}
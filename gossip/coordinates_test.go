@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCoordinatesOfDeadAndLeftMembersAreForgotten(t *testing.T) {
+	tests := []struct {
+		state     NodeState
+		forgotten bool
+	}{
+		{NodeSuspect, false},
+		{NodeDead, true},
+		{NodeLeft, true},
+	}
+	for _, test := range tests {
+		t.Run(test.state.String(), func(t *testing.T) {
+			g := NewGossip(&Node{ID: "node-1"}, GossipSettings{})
+			setNodeState(g, "node-2", NodeAlive)
+			coordinate := newCoordinate()
+			g.Lock()
+			g.updateCoordinate("node-2", &coordinate, 10*time.Millisecond)
+			g.Unlock()
+
+			setNodeState(g, "node-2", test.state)
+			g.Lock()
+			_, samplesKept := g.coordinates.latencySamples["node-2"]
+			g.Unlock()
+			if _, known := g.EstimateRTT("node-2"); known == test.forgotten || samplesKept == test.forgotten {
+				t.Fatalf("expected coordinates to be forgotten to be %v, got known %v and samples kept %v", test.forgotten, known, samplesKept)
+			}
+		})
+	}
+}
+
+// Each node takes a fixed time to receive messages, like the time to get
+// from a node onto the core of the network, so every link has a fixed round
+// trip time that coordinates can be checked against
+func TestSimulatedCoordinatesEstimateRoundTripTimes(t *testing.T) {
+	config := newSimulationConfig(20)
+	config.Jitter = 0
+	config.LossRate = 0
+	config.MeasureRoundTrips = true
+	s := NewSimulation(config)
+	delays := map[NodeID]time.Duration{}
+	for i, node := range s.Nodes {
+		delays[node.Node.ID] = time.Duration(i%5) * 10 * time.Millisecond
+		s.Network.Delay(node.Node.RemoteAddress, delays[node.Node.ID])
+	}
+	expectConverged(t, s, "joining", 15)
+	for i := 0; i < 200; i++ {
+		s.Step()
+	}
+
+	relativeErrors := []float64{}
+	for _, node := range s.Nodes {
+		for _, other := range s.Nodes {
+			if other == node {
+				continue
+			}
+			estimate, ok := node.EstimateRTT(other.Node.ID)
+			if !ok {
+				t.Fatalf("expected node '%s' to know the coordinates of node '%s'", node.Node.ID, other.Node.ID)
+			}
+			rtt := 2*config.Latency + delays[node.Node.ID] + delays[other.Node.ID]
+			relativeError := float64(estimate-rtt) / float64(rtt)
+			if relativeError < 0 {
+				relativeError = -relativeError
+			}
+			relativeErrors = append(relativeErrors, relativeError)
+		}
+	}
+	sort.Float64s(relativeErrors)
+	// Vivaldi keeps adjusting, so estimates settle near round trip times
+	// rather than on them
+	if median := relativeErrors[len(relativeErrors)/2]; median > 0.2 {
+		t.Fatalf("expected the median estimate to be within 20%% of the round trip time, was %.0f%% out", 100*median)
+	}
+	if percentile := relativeErrors[len(relativeErrors)*9/10]; percentile > 0.5 {
+		t.Fatalf("expected 90%% of estimates to be within 50%% of round trip times, the 90th percentile was %.0f%% out", 100*percentile)
+	}
+}
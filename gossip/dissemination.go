@@ -0,0 +1,228 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Membership updates are spread epidemically. Every message and reply carries
+// up to MaxPiggybackedUpdates recent updates, and each update is passed on a
+// number of times that grows logarithmically with the cluster size. That is
+// enough for every node to receive it with high probability, even if some
+// links between nodes are down.
+
+type membershipUpdate struct {
+	NodeID        NodeID    `yaml:"node_id"`
+	RemoteAddress string    `yaml:"remote_address,omitempty"`
+	State         NodeState `yaml:"state"`
+	Incarnation   uint64    `yaml:"incarnation"`
+	// Only alive updates change a node's tags. A node increments its
+	// incarnation when its tags change, so that the new tags take precedence.
+	Tags map[string]string `yaml:"tags,omitempty"`
+	// Zones and votes don't change while a node runs, so they are taken from
+	// any alive update, unless it was sent before they were known
+	Zone  string `yaml:"zone,omitempty"`
+	Votes int    `yaml:"votes,omitempty"`
+	// The node that suspects the node, for suspect updates, so that
+	// independent suspicions can be counted
+	From NodeID `yaml:"from,omitempty"`
+}
+
+// Gossip waiting to be piggybacked on messages, kept until each item has been
+// sent enough times. Queued items with the same non-empty key are replaced,
+// as the newer item supersedes them.
+type transmitQueue struct {
+	items []*queuedItem
+}
+
+type queuedItem struct {
+	key       string
+	item      interface{}
+	size      int
+	transmits int
+}
+
+func (q *transmitQueue) push(key string, item interface{}, size int) {
+	if key != "" {
+		for i, queued := range q.items {
+			if queued.key == key {
+				q.items = append(q.items[:i], q.items[i+1:]...)
+				break
+			}
+		}
+	}
+	q.items = append(q.items, &queuedItem{key: key, item: item, size: size})
+}
+
+// Takes up to maxItems of the least transmitted items, stopping before their
+// sizes add up to more than maxSize unless maxSize is zero, and forgets items
+// once they have been taken transmitLimit times
+func (q *transmitQueue) take(maxItems, maxSize, transmitLimit int) []interface{} {
+	sort.SliceStable(q.items, func(i, j int) bool {
+		return q.items[i].transmits < q.items[j].transmits
+	})
+
+	items := []interface{}{}
+	size := 0
+	for _, queued := range q.items {
+		size += queued.size
+		if len(items) >= maxItems || (maxSize > 0 && len(items) > 0 && size > maxSize) {
+			break
+		}
+		items = append(items, queued.item)
+		queued.transmits += 1
+	}
+
+	remaining := q.items[:0]
+	for _, queued := range q.items {
+		if queued.transmits < transmitLimit {
+			remaining = append(remaining, queued)
+		}
+	}
+	q.items = remaining
+	return items
+}
+
+// Must be called with the lock held. Replaces any queued update about the
+// same node, as the newer update supersedes it.
+func (g *Gossip) queueBroadcast(update membershipUpdate) {
+	g.broadcasts.push(update.NodeID, update, 0)
+}
+
+// Must be called with the lock held. Takes the least transmitted updates,
+// and forgets updates that have been transmitted enough times.
+func (g *Gossip) piggybackedUpdates() []membershipUpdate {
+	updates := []membershipUpdate{}
+	for _, item := range g.broadcasts.take(g.MaxPiggybackedUpdates, 0, g.retransmitLimit()) {
+		updates = append(updates, item.(membershipUpdate))
+	}
+	return updates
+}
+
+// Must be called with the lock held
+func (g *Gossip) retransmitLimit() int {
+	clusterNodeCount := 1 + len(g.OtherNodeStatuses)
+	return g.RetransmitMultiplier * int(math.Ceil(math.Log10(float64(clusterNodeCount+1))))
+}
+
+func (g *Gossip) applyMembershipUpdates(updates []membershipUpdate) {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, update := range updates {
+		g.applyMembershipUpdate(update)
+	}
+}
+
+// Must be called with the lock held. Updates with a higher incarnation
+// override those with a lower incarnation. At the same incarnation, suspect
+// overrides alive and dead overrides both. Only the node itself increments
+// its incarnation, which it does to refute being suspected. Left is treated
+// the same as dead. Nodes we didn't know about are added if they're alive.
+func (g *Gossip) applyMembershipUpdate(update membershipUpdate) {
+	if update.NodeID == g.Node.ID {
+		if update.State != NodeAlive && update.Incarnation >= g.Incarnation {
+			g.Incarnation = update.Incarnation + 1
+			infoLog.Printf("refuting being %s with incarnation %d\n", update.State, g.Incarnation)
+			// Being suspected is a sign this node may be slow itself
+			g.adjustLocalHealth(1)
+			g.queueBroadcast(membershipUpdate{
+				NodeID:        g.Node.ID,
+				RemoteAddress: g.Node.RemoteAddress,
+				State:         NodeAlive,
+				Incarnation:   g.Incarnation,
+				Tags:          g.Node.Tags,
+				Zone:          g.Node.Zone,
+				Votes:         g.Node.Votes,
+			})
+		}
+		return
+	}
+
+	nodeStatus, ok := g.OtherNodeStatuses[update.NodeID]
+	if !ok {
+		if update.State == NodeAlive {
+			g.addNode(NodeDescription{
+				ID:            update.NodeID,
+				RemoteAddress: update.RemoteAddress,
+				Tags:          copyTags(update.Tags),
+				Zone:          update.Zone,
+				Votes:         update.Votes,
+			}, update.Incarnation)
+		}
+		return
+	}
+	if update.State == NodeAlive && (update.Zone != "" || update.Votes != 0) {
+		g.learnZone(update.NodeID, update.Zone, update.Votes)
+		nodeStatus = g.OtherNodeStatuses[update.NodeID]
+	}
+	// Nodes can be added before their tags are known, such as when they
+	// first contact us, so tags are filled in at the same incarnation
+	if update.State == NodeAlive && update.Incarnation == nodeStatus.Incarnation && nodeStatus.Node.Tags == nil && len(update.Tags) > 0 {
+		nodeStatus.Node.Tags = copyTags(update.Tags)
+		g.setNodeStatus(update.NodeID, nodeStatus)
+		update.RemoteAddress = nodeStatus.Node.RemoteAddress
+		g.queueBroadcast(update)
+		return
+	}
+	switch update.State {
+	case NodeAlive:
+		if update.Incarnation <= nodeStatus.Incarnation {
+			return
+		}
+	case NodeSuspect:
+		if update.Incarnation < nodeStatus.Incarnation {
+			return
+		}
+		if update.Incarnation == nodeStatus.Incarnation && nodeStatus.State == NodeSuspect {
+			g.confirmSuspicion(update, nodeStatus)
+			return
+		}
+		if update.Incarnation == nodeStatus.Incarnation && nodeStatus.State != NodeAlive {
+			return
+		}
+	case NodeDead:
+		if update.Incarnation < nodeStatus.Incarnation {
+			return
+		}
+		if nodeStatus.State == NodeDead || nodeStatus.State == NodeLeft {
+			return
+		}
+	case NodeLeft:
+		if update.Incarnation < nodeStatus.Incarnation || nodeStatus.State == NodeLeft {
+			return
+		}
+	default:
+		return
+	}
+
+	if nodeStatus.State != update.State {
+		infoLog.Printf("node '%s' is %s (incarnation %d)\n", update.NodeID, update.State, update.Incarnation)
+	}
+	now := g.Clock.Now()
+	switch update.State {
+	case NodeAlive:
+		nodeStatus.SuspectedAt = nil
+		nodeStatus.suspectedBy = nil
+	case NodeSuspect:
+		if nodeStatus.State != NodeSuspect {
+			nodeStatus.SuspectedAt = &now
+			nodeStatus.suspectedBy = nil
+		}
+		nodeStatus.addSuspicion(update.From)
+	}
+	nodeStatus.State = update.State
+	nodeStatus.Incarnation = update.Incarnation
+	if update.RemoteAddress != "" {
+		nodeStatus.Node.RemoteAddress = update.RemoteAddress
+	}
+	if update.State == NodeAlive {
+		nodeStatus.Node.Tags = copyTags(update.Tags)
+	}
+	g.setNodeStatus(update.NodeID, nodeStatus)
+	update.RemoteAddress = nodeStatus.Node.RemoteAddress
+	update.Tags = nodeStatus.Node.Tags
+	update.Zone = nodeStatus.Node.Zone
+	update.Votes = nodeStatus.Node.Votes
+	g.queueBroadcast(update)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTransmitQueueTakesLeastTransmittedItems(t *testing.T) {
+	var q transmitQueue
+	q.push("a", "a1", 0)
+	q.push("b", "b1", 0)
+	q.push("", "c", 0)
+	// A newer item with the same key replaces the older one
+	q.push("a", "a2", 0)
+
+	rounds := [][]interface{}{
+		{"b1", "c"},
+		{"a2", "b1"},
+		{"a2", "c"},
+		{},
+	}
+	for i, expected := range rounds {
+		if taken := q.take(2, 0, 2); !reflect.DeepEqual(taken, expected) {
+			t.Fatalf("expected take %d to be %v, got %v", i, expected, taken)
+		}
+	}
+}
+
+func TestTransmitQueueLimitsSizeTaken(t *testing.T) {
+	var q transmitQueue
+	q.push("", "big", 100)
+	q.push("", "small", 10)
+	q.push("", "bigger", 200)
+
+	// The first item is always taken, so that an item over the limit is
+	// still sent alone
+	if taken := q.take(10, 50, 1); !reflect.DeepEqual(taken, []interface{}{"big"}) {
+		t.Fatalf("expected only the first item, got %v", taken)
+	}
+	if taken := q.take(10, 300, 1); !reflect.DeepEqual(taken, []interface{}{"small", "bigger"}) {
+		t.Fatalf("expected the rest, got %v", taken)
+	}
+}
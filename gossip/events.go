@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Applications embedding Gossip can subscribe to nodes changing state, rather
+// than polling Summary.
+
+type MembershipEventType int
+
+const (
+	MemberJoined MembershipEventType = iota
+	MemberSuspected
+	MemberDead
+	MemberRecovered
+	MemberLeft
+)
+
+func (t MembershipEventType) String() string {
+	switch t {
+	case MemberJoined:
+		return "joined"
+	case MemberSuspected:
+		return "suspected"
+	case MemberDead:
+		return "dead"
+	case MemberRecovered:
+		return "recovered"
+	case MemberLeft:
+		return "left"
+	default:
+		return fmt.Sprintf("MembershipEventType(%d)", int(t))
+	}
+}
+
+type MembershipEvent struct {
+	Type        MembershipEventType
+	Node        NodeDescription
+	Incarnation uint64
+	At          time.Time
+	LastSeenAt  *time.Time
+}
+
+// Returns a function for a subscriber to unsubscribe with, which removes it
+// with the lock held
+func (g *Gossip) unsubscriber(remove func()) func() {
+	return func() {
+		g.Lock()
+		defer g.Unlock()
+		remove()
+	}
+}
+
+// Each kind of event has a set of subscribers of its own, so that channels
+// are typed. Sets of other kinds work the same as this one.
+type membershipSubscriberSet struct {
+	channels map[int]chan MembershipEvent
+	nextID   int
+}
+
+// Must be called with the lock held. Returns a function to remove the
+// channel, which closes it.
+func (s *membershipSubscriberSet) add(channel chan MembershipEvent) func() {
+	if s.channels == nil {
+		s.channels = map[int]chan MembershipEvent{}
+	}
+	id := s.nextID
+	s.nextID += 1
+	s.channels[id] = channel
+	return func() {
+		if _, ok := s.channels[id]; ok {
+			delete(s.channels, id)
+			close(channel)
+		}
+	}
+}
+
+// Must be called with the lock held. Events are dropped for subscribers
+// whose channels are full, and the number dropped is returned.
+func (s *membershipSubscriberSet) publish(event MembershipEvent) int {
+	dropped := 0
+	for _, channel := range s.channels {
+		select {
+		case channel <- event:
+		default:
+			dropped += 1
+		}
+	}
+	return dropped
+}
+
+// Subscribe returns a channel of membership events, and a function to
+// unsubscribe. Events are dropped if the channel is full.
+func (g *Gossip) Subscribe() (<-chan MembershipEvent, func()) {
+	events := make(chan MembershipEvent, 64)
+	g.Lock()
+	defer g.Unlock()
+	return events, g.unsubscriber(g.membershipSubscribers.add(events))
+}
+
+// Must be called with the lock held. Stores the status of a node, publishing
+// an event if its state changed.
+func (g *Gossip) setNodeStatus(nodeID NodeID, nodeStatus NodeGossip) {
+	previousStatus, known := g.OtherNodeStatuses[nodeID]
+	g.OtherNodeStatuses[nodeID] = nodeStatus
+	if known && previousStatus.State == nodeStatus.State {
+		return
+	}
+	if nodeStatus.State == NodeDead || nodeStatus.State == NodeLeft {
+		g.forgetCoordinate(nodeID)
+	}
+
+	var eventType MembershipEventType
+	switch nodeStatus.State {
+	case NodeAlive:
+		// Nodes known about at startup but never seen before are joining
+		eventType = MemberJoined
+		if known && previousStatus.State != NodeLeft && previousStatus.LastSeenAt != nil {
+			eventType = MemberRecovered
+		}
+	case NodeSuspect:
+		eventType = MemberSuspected
+	case NodeDead:
+		eventType = MemberDead
+	case NodeLeft:
+		eventType = MemberLeft
+	default:
+		return
+	}
+
+	g.metrics.stateChanged(nodeID, nodeStatus.State)
+	node := nodeStatus.Node
+	node.Tags = copyTags(node.Tags)
+	event := MembershipEvent{
+		Type:        eventType,
+		Node:        node,
+		Incarnation: nodeStatus.Incarnation,
+		At:          g.Clock.Now(),
+		LastSeenAt:  nodeStatus.LastSeenAt,
+	}
+	if dropped := g.membershipSubscribers.publish(event); dropped > 0 {
+		warnLog.Printf("dropped %s event for node '%s' as %d subscribers are not keeping up\n", event.Type, nodeID, dropped)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func setNodeState(g *Gossip, nodeID NodeID, state NodeState) {
+	g.Lock()
+	defer g.Unlock()
+	g.setNodeStatus(nodeID, NodeGossip{Node: NodeDescription{ID: nodeID}, State: state})
+}
+
+func TestSubscribersReceiveMembershipEvents(t *testing.T) {
+	g := NewGossip(&Node{ID: "node-1"}, GossipSettings{})
+	first, unsubscribeFirst := g.Subscribe()
+	second, unsubscribeSecond := g.Subscribe()
+	defer unsubscribeSecond()
+
+	setNodeState(g, "node-2", NodeAlive)
+	setNodeState(g, "node-2", NodeSuspect)
+	for _, events := range []<-chan MembershipEvent{first, second} {
+		for _, expected := range []MembershipEventType{MemberJoined, MemberSuspected} {
+			if event := <-events; event.Type != expected || event.Node.ID != "node-2" {
+				t.Fatalf("expected node-2 %s, got node '%s' %s", expected, event.Node.ID, event.Type)
+			}
+		}
+	}
+
+	// Unsubscribing closes the channel, and only stops events to it
+	unsubscribeFirst()
+	unsubscribeFirst()
+	setNodeState(g, "node-2", NodeDead)
+	if event, ok := <-first; ok {
+		t.Fatalf("expected the channel to be closed, got %s", event.Type)
+	}
+	if event := <-second; event.Type != MemberDead {
+		t.Fatalf("expected %s, got %s", MemberDead, event.Type)
+	}
+}
+
+func TestSubscribersThatDontKeepUpMissEvents(t *testing.T) {
+	g := NewGossip(&Node{ID: "node-1"}, GossipSettings{})
+	events, unsubscribe := g.Subscribe()
+	defer unsubscribe()
+
+	// Alternating states publishes an event every time
+	states := []NodeState{NodeAlive, NodeSuspect}
+	for i := 0; i < cap(events)+10; i++ {
+		setNodeState(g, "node-2", states[i%2])
+	}
+	if len(events) != cap(events) {
+		t.Fatalf("expected %d events to be kept, got %d", cap(events), len(events))
+	}
+}
+
+func TestMembershipEventsDontShareTags(t *testing.T) {
+	g := NewGossip(&Node{ID: "node-1"}, GossipSettings{})
+	events, unsubscribe := g.Subscribe()
+	defer unsubscribe()
+
+	g.Lock()
+	g.setNodeStatus("node-2", NodeGossip{Node: NodeDescription{ID: "node-2", Tags: map[string]string{"role": "web"}}, State: NodeAlive})
+	g.Unlock()
+	event := <-events
+	event.Node.Tags["role"] = "db"
+	if members := g.MembersWithTags(map[string]string{"role": "web"}); len(members) != 1 || members[0].ID != "node-2" {
+		t.Fatalf("expected changing an event's tags to leave the member's tags alone, got members %+v", members)
+	}
+}
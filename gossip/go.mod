@@ -2,4 +2,7 @@ module github.com/46bit/distributed-systems/gossip
 
 go 1.15
 
-require gopkg.in/yaml.v2 v2.4.0
+require (
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
+	gopkg.in/yaml.v2 v2.4.0
+)
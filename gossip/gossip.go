@@ -1,20 +1,67 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
-
-	"gopkg.in/yaml.v2"
 )
 
 type GossipSettings struct {
+	// How often a node is probed. Each round probes one randomly chosen node.
 	GossipRegularity time.Duration
+	// How long a suspected node has to be heard from before it is confirmed
+	// dead, once enough other nodes also suspect it.
 	NodeTimeoutAfter time.Duration
+	// How many times longer than NodeTimeoutAfter a node is given while only
+	// one node suspects it. One disables this.
+	MaxNodeTimeoutMultiplier int
+	// How many other nodes must suspect a node before it is given only
+	// NodeTimeoutAfter.
+	SuspicionConfirmations int
+	// Probe timeouts and GossipRegularity are stretched by up to this many
+	// times over while this node seems slow itself. Zero disables this.
+	MaxLocalHealth int
+	// How long to wait for an ack to a direct probe before asking other nodes
+	// to probe indirectly.
+	ProbeTimeout time.Duration
+	// How many other nodes to ask to probe indirectly when a direct probe fails.
+	IndirectProbeCount int
+	// How many membership updates to piggyback on each message.
+	MaxPiggybackedUpdates int
+	// Each membership update is retransmitted RetransmitMultiplier * log(N+1)
+	// times, for a cluster of N nodes.
+	RetransmitMultiplier int
+	// How long a node must be the lowest alive node ID with quorum before it
+	// becomes leader, and how long its leadership lasts without renewal.
+	LeaderLeaseDuration time.Duration
+	// How quorum is decided, from a majority of votes or of zones. Defaults to
+	// a majority of votes.
+	QuorumPolicy QuorumPolicy
+	// How many nodes the cluster is expected to have. Leases must then be
+	// granted by more than half this many nodes as well as most of the
+	// cluster this node knows of. Zero requires knowing of at least
+	// minLeaseClusterSize nodes instead.
+	ExpectedClusterSize int
+	// How often to exchange the full membership list with a random node, so
+	// that nodes which missed updates catch up. Zero disables it.
+	PushPullInterval time.Duration
+	// Where to save this node's incarnation and members, so that it can
+	// rejoin quickly after restarting. Empty disables it.
+	StateFile string
+	// How often to save the state file, as well as when stopping. Zero only
+	// saves it when stopping.
+	StateSaveInterval time.Duration
+	// How gossip is sent between nodes
+	Transport Transport
+	// The keyring the transport encrypts with, if any. Keys changed while
+	// running are saved in the state file, and used instead of the same
+	// keys from the config file after restarting.
+	Keyring *Keyring
+	// Defaults to the system clock
+	Clock Clock
 }
 
 type Gossip struct {
@@ -22,21 +69,73 @@ type Gossip struct {
 	GossipSettings
 
 	Node              *Node
+	Incarnation       uint64
 	OtherNodeStatuses map[NodeID]NodeGossip
+	// Whether this node has swapped members with another node, by joining
+	// or push-pull
+	joined bool
+
+	broadcasts transmitQueue
+	random     *rand.Rand
+	probeOrder []NodeID
+	probeIndex int
+	quorum     quorumState
+	// Lifeguard's local health multiplier, between 0 and MaxLocalHealth
+	localHealth int
+	coordinates vivaldi
+	// The latest reachability report from each node, including this one
+	reachability     map[NodeID]reachabilityReport
+	reportBroadcasts transmitQueue
+
+	membershipSubscribers membershipSubscriberSet
+	userEvents            userEvents
+	queries               queries
+	clusterConfig         clusterConfig
+	leases                leases
+	metrics               gossipMetrics
+	// Held while saving the state file
+	stateFileLock sync.Mutex
+	// The keys the keyring started with, from the config file
+	configKeyIDs []string
 }
 
 type NodeGossip struct {
-	LastSeenAt *time.Time
+	Node        NodeDescription
+	State       NodeState
+	Incarnation uint64
+	LastSeenAt  *time.Time
+	SuspectedAt *time.Time
+
+	// The nodes known to suspect this node, including this one
+	suspectedBy map[NodeID]bool
 }
 
 func NewGossip(node *Node, gossipSettings GossipSettings) *Gossip {
+	if gossipSettings.Clock == nil {
+		gossipSettings.Clock = realClock{}
+	}
 	gossip := &Gossip{
 		GossipSettings:    gossipSettings,
 		Node:              node,
 		OtherNodeStatuses: map[NodeID]NodeGossip{},
+		reachability:      map[NodeID]reachabilityReport{},
+		coordinates:       newVivaldi(),
+		random:            rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if gossipSettings.Keyring != nil {
+		gossip.configKeyIDs = gossipSettings.Keyring.KeyIDs()
 	}
+	// Nodes we have never heard from start out suspected, so they are confirmed
+	// dead if they don't respond within NodeTimeoutAfter. Their tags are
+	// learned from their own gossip rather than trusted from config.
+	now := gossipSettings.Clock.Now()
 	for _, otherNode := range node.OtherNodes {
-		gossip.OtherNodeStatuses[otherNode.ID] = NodeGossip{}
+		otherNode.Tags = nil
+		gossip.OtherNodeStatuses[otherNode.ID] = NodeGossip{
+			Node:        otherNode,
+			State:       NodeSuspect,
+			SuspectedAt: &now,
+		}
 	}
 	return gossip
 }
@@ -44,156 +143,420 @@ func NewGossip(node *Node, gossipSettings GossipSettings) *Gossip {
 func (g *Gossip) Summary() *GossipSummary {
 	g.Lock()
 	defer g.Unlock()
+	return g.summary()
+}
 
-	seenWithinTimeout := 0
+// Must be called with the lock held
+func (g *Gossip) summary() *GossipSummary {
+	// Starts at 1 to count the current node
+	summary := &GossipSummary{
+		ClusterNodeCount: 1,
+		QuorumPolicy:     g.QuorumPolicy,
+		Zones:            map[string]ZoneSummary{},
+	}
+	summary.countZone(g.Node.Zone, g.self().VoteCount(), true)
 	for _, nodeStatus := range g.OtherNodeStatuses {
-		if nodeStatus.LastSeenAt == nil {
-			continue
+		if nodeStatus.State != NodeLeft {
+			summary.ClusterNodeCount += 1
+			summary.countZone(nodeStatus.Node.Zone, nodeStatus.Node.VoteCount(), nodeStatus.State == NodeAlive)
 		}
-		age := time.Now().Sub(*nodeStatus.LastSeenAt)
-		if age > g.NodeTimeoutAfter {
-			continue
+		switch nodeStatus.State {
+		case NodeAlive:
+			summary.OtherNodesSeenRecently += 1
+		case NodeSuspect:
+			summary.OtherNodesSuspected += 1
+		case NodeDead:
+			summary.OtherNodesDead += 1
 		}
-		seenWithinTimeout += 1
-	}
-
-	// Adds 1 to number of nodes for the current node
-	return &GossipSummary{
-		ClusterNodeCount:       1 + len(g.Node.OtherNodes),
-		OtherNodesSeenRecently: seenWithinTimeout,
 	}
+	return summary
 }
 
 type GossipSummary struct {
 	ClusterNodeCount       int
 	OtherNodesSeenRecently int
+	OtherNodesSuspected    int
+	OtherNodesDead         int
+
+	QuorumPolicy QuorumPolicy
+	// Votes of every node that hasn't left, and of this node and the nodes
+	// seen recently
+	ClusterVotes      int
+	VotesSeenRecently int
+	// Nodes without a zone are counted in the "" zone
+	Zones map[string]ZoneSummary
 }
 
-func (g *GossipSummary) RecentlySawMostOfCluster() bool {
-	nodesSeenIncludingItself := 1 + g.OtherNodesSeenRecently
-	return nodesSeenIncludingItself > g.ClusterNodeCount/2
+type ZoneSummary struct {
+	Nodes             int
+	NodesSeenRecently int
+	Votes             int
+	VotesSeenRecently int
 }
 
-func (g *Gossip) Run() error {
-	go gossipBroadcast(g)
-	return gossipServer(g)
+// SawMostOfZone is true if most of the zone's votes were seen recently, which
+// can only be true on one side of a partition
+func (z ZoneSummary) SawMostOfZone() bool {
+	return 2*z.VotesSeenRecently > z.Votes
 }
 
-func gossipServer(g *Gossip) error {
-	mux := http.NewServeMux()
-	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		bodyBytes, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Println(fmt.Errorf("error reading from connection: %w", err))
-			return
+func (g *GossipSummary) countZone(zone string, votes int, seenRecently bool) {
+	zoneSummary := g.Zones[zone]
+	zoneSummary.Nodes += 1
+	zoneSummary.Votes += votes
+	g.ClusterVotes += votes
+	if seenRecently {
+		zoneSummary.NodesSeenRecently += 1
+		zoneSummary.VotesSeenRecently += votes
+		g.VotesSeenRecently += votes
+	}
+	g.Zones[zone] = zoneSummary
+}
+
+// ZonesSeenRecently counts the zones whose votes were mostly seen recently
+func (g *GossipSummary) ZonesSeenRecently() int {
+	zonesSeen := 0
+	for _, zone := range g.Zones {
+		if zone.SawMostOfZone() {
+			zonesSeen += 1
 		}
+	}
+	return zonesSeen
+}
 
-		var gossipMessage gossipMessage
-		if err = yaml.Unmarshal(bodyBytes, &gossipMessage); err != nil {
-			log.Println(fmt.Errorf("error deserialising body: %w", err))
+func (g *GossipSummary) RecentlySawMostOfCluster() bool {
+	switch g.QuorumPolicy {
+	case QuorumMajorityOfZones:
+		return 2*g.ZonesSeenRecently() > len(g.Zones)
+	default:
+		return 2*g.VotesSeenRecently > g.ClusterVotes
+	}
+}
+
+// Run gossips until the context is cancelled. It then tells other nodes that
+// this node is leaving, and closes the transport.
+func (g *Gossip) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var rounds sync.WaitGroup
+	rounds.Add(1)
+	go func() {
+		defer rounds.Done()
+		gossipBroadcast(ctx, g)
+	}()
+	if g.PushPullInterval > 0 {
+		rounds.Add(1)
+		go func() {
+			defer rounds.Done()
+			pushPullPeriodically(ctx, g)
+		}()
+	}
+	if g.StateFile != "" && g.StateSaveInterval > 0 {
+		rounds.Add(1)
+		go func() {
+			defer rounds.Done()
+			saveStatePeriodically(ctx, g)
+		}()
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- g.Transport.Serve(g.handleGossipMessage)
+	}()
+	select {
+	case err := <-served:
+		cancel()
+		rounds.Wait()
+		if err != nil {
+			return fmt.Errorf("error serving gossip: %w", err)
 		}
+		return fmt.Errorf("stopped serving gossip unexpectedly")
+	case <-ctx.Done():
+	}
+
+	// The transport is still needed to leave, and to receive the replies
+	rounds.Wait()
+	g.releaseLeases()
+	if err := g.Leave(); err != nil {
+		warnLog.Println(err)
+	}
+	if err := g.SaveState(); err != nil {
+		warnLog.Println(err)
+	}
+	if err := g.Transport.Close(); err != nil {
+		return fmt.Errorf("error closing transport: %w", err)
+	}
+	if err := <-served; err != nil {
+		return fmt.Errorf("error serving gossip: %w", err)
+	}
+	return nil
+}
 
-		// FIXME: Authenticate nodes with Mutual TLS?
+func (g *Gossip) handleGossipMessage(gossipMessage *gossipMessage) (*gossipReply, error) {
+	g.Lock()
+	g.addNode(NodeDescription{
+		ID:            gossipMessage.NodeID,
+		RemoteAddress: gossipMessage.RemoteAddress,
+		Tags:          copyTags(gossipMessage.Tags),
+		Zone:          gossipMessage.Zone,
+		Votes:         gossipMessage.Votes,
+	}, gossipMessage.Incarnation)
+	g.learnZone(gossipMessage.NodeID, gossipMessage.Zone, gossipMessage.Votes)
+	g.Unlock()
+	if !g.markAlive(gossipMessage.NodeID, gossipMessage.Incarnation) {
+		return nil, fmt.Errorf("received gossip message for unknown node id '%s'", gossipMessage.NodeID)
+	}
+	g.applyMembershipUpdates(gossipMessage.Updates)
+	g.Lock()
+	g.applyReachabilityReports(gossipMessage.Reachability)
+	g.applyUserEvents(gossipMessage.Events)
+	g.applyConfigEntries(gossipMessage.Config)
+	g.learnCoordinate(gossipMessage.NodeID, gossipMessage.Coordinate)
+	g.Unlock()
+
+	reply := newGossipReply(g)
+	switch gossipMessage.Kind {
+	case pingMessage:
+		reply.Ack = true
+		coordinate := g.Coordinate()
+		reply.Coordinate = &coordinate
+	case pingReqMessage:
+		// Not stretched by local health, so that the reply arrives before
+		// the sender gives up on it
+		reply.Ack = g.probeDirectly(gossipMessage.Target, gossipMessage.TargetAddress, g.ProbeTimeout)
+	case joinMessage:
+		reply.Ack = true
+		reply.Members = g.members()
 		g.Lock()
-		_, ok := g.OtherNodeStatuses[gossipMessage.NodeID]
-		if !ok {
-			g.Unlock()
-			log.Println(fmt.Errorf("error: received gossip message for unknown node id '%s'", gossipMessage.NodeID))
-			return
-		}
-		nodeStatus := g.OtherNodeStatuses[gossipMessage.NodeID]
-		now := time.Now()
-		nodeStatus.LastSeenAt = &now
-		g.OtherNodeStatuses[gossipMessage.NodeID] = nodeStatus
+		g.joined = true
+		reply.Reachability = g.reachabilityReports()
+		reply.Config = g.configEntries()
 		g.Unlock()
-
-		reply := newGossipReply(g)
-		replyBytes, err := yaml.Marshal(&reply)
-		if err != nil {
-			log.Println(fmt.Errorf("error serialising reply into YAML: %w", err))
-			return
+	case pushPullMessage:
+		reply.Ack = true
+		reply.Members = g.members()
+		g.Lock()
+		g.joined = true
+		reply.Reachability = g.reachabilityReports()
+		reply.Config = g.configEntries()
+		g.Unlock()
+		g.applyMembershipUpdates(gossipMessage.Members)
+	case queryMessage:
+		if gossipMessage.Query == nil {
+			return nil, fmt.Errorf("received query message without a query")
 		}
-		if _, err = w.Write(replyBytes); err != nil {
-			log.Println(fmt.Errorf("error sending reply: %w", err))
-			return
+		reply.Ack = true
+		reply.QueryResponse = g.respondToQuery(gossipMessage.NodeID, gossipMessage.Query)
+	case leaseMessage:
+		if gossipMessage.Lease == nil {
+			return nil, fmt.Errorf("received lease message without a lease")
 		}
-	}))
-	// FIXME: Configure aggressive timeouts etc
-	return http.ListenAndServe(g.Node.LocalAddress, mux)
+		reply.Ack = true
+		g.Lock()
+		grant := g.grantLease(gossipMessage.NodeID, gossipMessage.Incarnation, gossipMessage.Lease)
+		g.Unlock()
+		// A grant that would be forgotten by restarting isn't safe to give
+		if grant.Granted && !gossipMessage.Lease.Release {
+			if err := g.SaveState(); err != nil {
+				warnLog.Println(fmt.Errorf("refusing lease '%s': %w", gossipMessage.Lease.Name, err))
+				grant = leaseGrant{Token: grant.Token}
+			}
+		}
+		reply.LeaseGrant = &grant
+	case leaveMessage:
+		reply.Ack = true
+		g.applyMembershipUpdates([]membershipUpdate{{
+			NodeID:      gossipMessage.NodeID,
+			State:       NodeLeft,
+			Incarnation: gossipMessage.Incarnation,
+		}})
+	default:
+		return nil, fmt.Errorf("received gossip message of unknown kind '%s'", gossipMessage.Kind)
+	}
+	return reply, nil
 }
 
-func gossipBroadcast(g *Gossip) {
+func gossipBroadcast(ctx context.Context, g *Gossip) {
 	// FIXME: Make gossip regularlity fixed so obviously safe to not lock?
 	g.Lock()
 	gossipRegularity := g.GossipRegularity
 	g.Unlock()
 
-	for range time.Tick(gossipRegularity) {
-		gossipMessage := newGossipMessage(g)
-		for _, otherNode := range g.Node.OtherNodes {
-			err := sendGossipMessage(gossipMessage, otherNode.RemoteAddress)
-			if err != nil {
-				log.Println(fmt.Errorf("error sending gossip message to node '%s': %w", otherNode.ID, err))
-			}
+	timer := time.NewTimer(gossipRegularity)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(g.gossipRound())
+	}
+}
+
+// Returns how long until the next round, which is longer than
+// GossipRegularity while this node seems slow itself
+func (g *Gossip) gossipRound() time.Duration {
+	g.Lock()
+	interval := g.scaleByLocalHealth(g.GossipRegularity)
+	g.Unlock()
+
+	if target, ok := g.nextProbeTarget(); ok {
+		g.probe(target, g.Clock.Now().Add(interval))
+	}
+	g.confirmSuspectedNodesDead()
+	g.updateQuorum()
+	g.updatePartitions()
+	return interval
+}
+
+// Must be called with the lock held. Node IDs are sorted so that random
+// choices between them only depend on the random source.
+func (g *Gossip) knownNodeIDs() []NodeID {
+	nodeIDs := make([]NodeID, 0, len(g.OtherNodeStatuses))
+	for nodeID := range g.OtherNodeStatuses {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	return nodeIDs
+}
+
+// Calls f for each index up to count concurrently, and waits for them all.
+// They are called one at a time instead over a sequential transport.
+func (g *Gossip) forEachConcurrently(count int, f func(i int)) {
+	if _, ok := g.Transport.(sequentialTransport); ok {
+		for i := 0; i < count; i++ {
+			f(i)
 		}
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+		}(i)
 	}
+	wg.Wait()
 }
 
+type gossipMessageKind = string
+
+const (
+	pingMessage     gossipMessageKind = "ping"
+	pingReqMessage  gossipMessageKind = "ping-req"
+	joinMessage     gossipMessageKind = "join"
+	leaveMessage    gossipMessageKind = "leave"
+	pushPullMessage gossipMessageKind = "push-pull"
+	queryMessage    gossipMessageKind = "query"
+	leaseMessage    gossipMessageKind = "lease"
+)
+
 type gossipMessage struct {
-	NodeID    NodeID    `yaml:"node_id"`
-	Timestamp time.Time `yaml:"timestamp"`
+	Kind          gossipMessageKind `yaml:"kind"`
+	NodeID        NodeID            `yaml:"node_id"`
+	RemoteAddress string            `yaml:"remote_address"`
+	Incarnation   uint64            `yaml:"incarnation"`
+	Timestamp     time.Time         `yaml:"timestamp"`
+	// The sender's tags, only sent with joins
+	Tags map[string]string `yaml:"tags,omitempty"`
+	// The sender's zone and votes, which don't change while it runs
+	Zone  string `yaml:"zone,omitempty"`
+	Votes int    `yaml:"votes,omitempty"`
+	// Target is the node to be probed on behalf of the sender of a ping-req,
+	// at TargetAddress if the receiver doesn't know it yet
+	Target        NodeID             `yaml:"target,omitempty"`
+	TargetAddress string             `yaml:"target_address,omitempty"`
+	Updates       []membershipUpdate `yaml:"updates,omitempty"`
+	// Members is the full membership list of the sender of a push-pull
+	Members []membershipUpdate `yaml:"members,omitempty"`
+	// Reachability reports that have changed recently, or every report known
+	// in a push-pull
+	Reachability []reachabilityReport `yaml:"reachability,omitempty"`
+	Events       []UserEvent          `yaml:"events,omitempty"`
+	// Recent changes to the cluster config, or the whole of it in a push-pull
+	Config []ConfigEntry `yaml:"config,omitempty"`
+	Query  *queryRequest `yaml:"query,omitempty"`
+	Lease  *leaseRequest `yaml:"lease,omitempty"`
+	// The sender's network coordinates, only sent with pings
+	Coordinate *Coordinate `yaml:"coordinate,omitempty"`
 }
 
-func newGossipMessage(g *Gossip) *gossipMessage {
+func newGossipMessage(g *Gossip, kind gossipMessageKind) *gossipMessage {
 	g.Lock()
 	defer g.Unlock()
-	return &gossipMessage{
-		NodeID:    g.Node.ID,
-		Timestamp: time.Now(),
+	message := &gossipMessage{
+		Kind:          kind,
+		NodeID:        g.Node.ID,
+		RemoteAddress: g.Node.RemoteAddress,
+		Incarnation:   g.Incarnation,
+		Timestamp:     g.Clock.Now(),
+		Zone:          g.Node.Zone,
+		Votes:         g.Node.Votes,
+		Updates:       g.piggybackedUpdates(),
+		Reachability:  g.piggybackedReachabilityReports(),
+		Events:        g.piggybackedUserEvents(),
+		Config:        g.piggybackedConfigEntries(),
+	}
+	if kind == joinMessage {
+		message.Tags = g.Node.Tags
 	}
+	if kind == pingMessage {
+		coordinate := g.coordinates.coordinate.clone()
+		message.Coordinate = &coordinate
+	}
+	return message
 }
 
 type gossipReply struct {
-	NodeID    NodeID    `yaml:"node_id"`
-	Timestamp time.Time `yaml:"timestamp"`
+	NodeID      NodeID             `yaml:"node_id"`
+	Incarnation uint64             `yaml:"incarnation"`
+	Timestamp   time.Time          `yaml:"timestamp"`
+	Ack         bool               `yaml:"ack"`
+	Zone        string             `yaml:"zone,omitempty"`
+	Votes       int                `yaml:"votes,omitempty"`
+	Updates     []membershipUpdate `yaml:"updates,omitempty"`
+	// Members is the full membership list, sent in reply to a join or push-pull
+	Members      []membershipUpdate   `yaml:"members,omitempty"`
+	Reachability []reachabilityReport `yaml:"reachability,omitempty"`
+	Events       []UserEvent          `yaml:"events,omitempty"`
+	// The whole cluster config in reply to a join or push-pull
+	Config        []ConfigEntry  `yaml:"config,omitempty"`
+	QueryResponse *queryResponse `yaml:"query_response,omitempty"`
+	LeaseGrant    *leaseGrant    `yaml:"lease_grant,omitempty"`
+	// The replying node's network coordinates, only sent in reply to pings
+	Coordinate *Coordinate `yaml:"coordinate,omitempty"`
 }
 
 func newGossipReply(g *Gossip) *gossipReply {
 	g.Lock()
 	defer g.Unlock()
 	return &gossipReply{
-		NodeID:    g.Node.ID,
-		Timestamp: time.Now(),
+		NodeID:       g.Node.ID,
+		Incarnation:  g.Incarnation,
+		Timestamp:    g.Clock.Now(),
+		Zone:         g.Node.Zone,
+		Votes:        g.Node.Votes,
+		Updates:      g.piggybackedUpdates(),
+		Reachability: g.piggybackedReachabilityReports(),
+		Events:       g.piggybackedUserEvents(),
+		Config:       g.piggybackedConfigEntries(),
 	}
 }
 
-func sendGossipMessage(gossipMessage *gossipMessage, nodeAddress string) error {
-	url := fmt.Sprintf("http://%s/", nodeAddress)
-	messageBytes, err := yaml.Marshal(gossipMessage)
-	if err != nil {
-		return fmt.Errorf("error serialising message into YAML: %w", err)
-	}
-
-	r, err := http.Post(url, "application/json", bytes.NewBuffer(messageBytes))
-	if err != nil {
-		return fmt.Errorf("error sending gossip message to node at '%s': %w", nodeAddress, err)
-	}
-
-	bodyBytes, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return fmt.Errorf("error reading from connection: %w", err)
-	}
-
-	var gossipReply gossipReply
-	if err = yaml.Unmarshal(bodyBytes, &gossipReply); err != nil {
-		return fmt.Errorf("error deserialising body: %w", err)
-	}
+// Applies the gossip piggybacked on a reply
+func (g *Gossip) applyReply(reply *gossipReply) {
+	g.applyMembershipUpdates(reply.Updates)
+	g.Lock()
+	g.learnZone(reply.NodeID, reply.Zone, reply.Votes)
+	g.applyReachabilityReports(reply.Reachability)
+	g.applyUserEvents(reply.Events)
+	g.applyConfigEntries(reply.Config)
+	g.Unlock()
+}
 
-	// FIXME: There's no real need for a reply. Just using Mutual TLS
-	// with certs containing the Node ID would be enough to be sure it is
-	// working properly.
-	if gossipReply.NodeID == "" {
-		return fmt.Errorf("gossip reply had no nodeid")
-	}
-	return nil
+func (g *Gossip) sendGossipMessage(gossipMessage *gossipMessage, nodeAddress string, timeout time.Duration) (*gossipReply, error) {
+	return g.Transport.Send(nodeAddress, gossipMessage, timeout)
 }
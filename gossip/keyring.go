@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Gossip can be encrypted and authenticated with AES-GCM, using a keyring
+// shared by every node. Payloads are encrypted with the primary key, and
+// decrypted with whichever installed key works. Keys are rotated without
+// downtime by installing the new key on every node, then using it as the
+// primary key on every node, and then removing the old key.
+//
+// Each encrypted payload is a version byte, a random nonce, and the sealed
+// payload. Random nonces are safe for about 2^32 payloads per key, which is
+// another reason to rotate keys.
+
+const (
+	encryptionVersion = 1
+	nonceSize         = 12
+	// Added to each payload by encryption
+	encryptionOverhead = 1 + nonceSize + 16
+)
+
+type Keyring struct {
+	lock sync.Mutex
+	// The primary key is first
+	keys [][]byte
+}
+
+// NewKeyring returns a keyring holding the given keys, the first of which is
+// the primary key
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("a keyring needs at least one key")
+	}
+	k := &Keyring{}
+	for _, key := range keys {
+		if err := k.Install(key); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// ParseKey decodes a base64 AES-128, AES-192 or AES-256 key
+func ParseKey(encodedKey string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key as base64: %w", err)
+	}
+	if err = validateKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func validateKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("keys must be 16, 24 or 32 bytes, got %d bytes", len(key))
+	}
+}
+
+// KeyID identifies a key without revealing it
+func KeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
+// Install adds a key that payloads can be decrypted with. It doesn't become
+// the primary key unless the keyring was empty.
+func (k *Keyring) Install(key []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.index(key) >= 0 {
+		return nil
+	}
+	k.keys = append(k.keys, append([]byte{}, key...))
+	return nil
+}
+
+// Use makes an installed key the primary key, which payloads are encrypted
+// with
+func (k *Keyring) Use(key []byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	i := k.index(key)
+	if i < 0 {
+		return fmt.Errorf("key %s is not installed", KeyID(key))
+	}
+	primaryKey := k.keys[i]
+	copy(k.keys[1:i+1], k.keys[:i])
+	k.keys[0] = primaryKey
+	return nil
+}
+
+// Remove removes an installed key, unless it is the primary key
+func (k *Keyring) Remove(key []byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	i := k.index(key)
+	if i < 0 {
+		return fmt.Errorf("key %s is not installed", KeyID(key))
+	}
+	if i == 0 {
+		return fmt.Errorf("key %s is the primary key, so it can't be removed", KeyID(key))
+	}
+	k.keys = append(k.keys[:i], k.keys[i+1:]...)
+	return nil
+}
+
+// Replaces every key, the first of which becomes the primary key
+func (k *Keyring) replace(keys [][]byte) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("a keyring needs at least one key")
+	}
+	for _, key := range keys {
+		if err := validateKey(key); err != nil {
+			return err
+		}
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys = nil
+	for _, key := range keys {
+		if k.index(key) < 0 {
+			k.keys = append(k.keys, append([]byte{}, key...))
+		}
+	}
+	return nil
+}
+
+// Lists copies of the installed keys, starting with the primary key
+func (k *Keyring) installedKeys() [][]byte {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	keys := make([][]byte, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, append([]byte{}, key...))
+	}
+	return keys
+}
+
+// KeyIDs lists the IDs of the installed keys, starting with the primary key
+func (k *Keyring) KeyIDs() []string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	keyIDs := make([]string, 0, len(k.keys))
+	for _, key := range k.keys {
+		keyIDs = append(keyIDs, KeyID(key))
+	}
+	return keyIDs
+}
+
+// Must be called with the lock held
+func (k *Keyring) index(key []byte) int {
+	for i, installedKey := range k.keys {
+		if bytes.Equal(installedKey, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Encrypts a payload with the primary key. The additional data is
+// authenticated but not encrypted.
+func (k *Keyring) encrypt(payload, additionalData []byte) ([]byte, error) {
+	k.lock.Lock()
+	primaryKey := k.keys[0]
+	k.lock.Unlock()
+
+	gcm, err := newGCM(primaryKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := make([]byte, 1+nonceSize, encryptionOverhead+len(payload))
+	encrypted[0] = encryptionVersion
+	if _, err = io.ReadFull(rand.Reader, encrypted[1:]); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	return gcm.Seal(encrypted, encrypted[1:], payload, additionalData), nil
+}
+
+// Decrypts a payload with whichever installed key it was encrypted with
+func (k *Keyring) decrypt(encrypted, additionalData []byte) ([]byte, error) {
+	if len(encrypted) < encryptionOverhead {
+		return nil, fmt.Errorf("encrypted payload is too short")
+	}
+	if encrypted[0] != encryptionVersion {
+		return nil, fmt.Errorf("encrypted payload has unknown version %d", encrypted[0])
+	}
+	k.lock.Lock()
+	keys := append([][]byte{}, k.keys...)
+	k.lock.Unlock()
+
+	nonce, sealed := encrypted[1:1+nonceSize], encrypted[1+nonceSize:]
+	for _, key := range keys {
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if payload, err := gcm.Open(nil, nonce, sealed, additionalData); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, fmt.Errorf("payload could not be decrypted with any installed key")
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestKeyringRotatesKeys(t *testing.T) {
+	oldKey, newKey := testKey(1), testKey(2)
+	keyring, err := NewKeyring(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedWithOldKey, err := keyring.encrypt([]byte("payload"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = keyring.Install(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if keyIDs := keyring.KeyIDs(); len(keyIDs) != 2 || keyIDs[0] != KeyID(oldKey) {
+		t.Fatalf("expected the old key to stay primary once the new key is installed, got %v", keyIDs)
+	}
+	if err = keyring.Use(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if keyIDs := keyring.KeyIDs(); len(keyIDs) != 2 || keyIDs[0] != KeyID(newKey) {
+		t.Fatalf("expected the new key to be primary, got %v", keyIDs)
+	}
+	if err = keyring.Remove(newKey); err == nil {
+		t.Fatal("expected removing the primary key to be refused")
+	}
+	if _, err = keyring.decrypt(encryptedWithOldKey, nil); err != nil {
+		t.Fatalf("expected payloads encrypted with the old key to decrypt until it is removed, got %v", err)
+	}
+	if err = keyring.Remove(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if keyIDs := keyring.KeyIDs(); len(keyIDs) != 1 || keyIDs[0] != KeyID(newKey) {
+		t.Fatalf("expected only the new key to be left, got %v", keyIDs)
+	}
+	if _, err = keyring.decrypt(encryptedWithOldKey, nil); err == nil {
+		t.Fatal("expected payloads encrypted with the removed key not to decrypt")
+	}
+}
+
+func TestKeyringDecryptsWithAnyInstalledKey(t *testing.T) {
+	sender, err := NewKeyring(testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewKeyring(testKey(1), testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := sender.encrypt([]byte("payload"), []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := receiver.decrypt(encrypted, []byte("data"))
+	if err != nil || string(payload) != "payload" {
+		t.Fatalf("expected the payload to decrypt with a key that isn't primary, got %q: %v", payload, err)
+	}
+}
+
+func TestKeyringRejectsWrongKeysAndTamperedPayloads(t *testing.T) {
+	keyring, err := NewKeyring(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyring, err := NewKeyring(testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := keyring.encrypt([]byte("payload"), []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := func(i int) []byte {
+		payload := append([]byte{}, encrypted...)
+		payload[i] ^= 1
+		return payload
+	}
+
+	tests := []struct {
+		name           string
+		keyring        *Keyring
+		encrypted      []byte
+		additionalData string
+	}{
+		{"wrong key", otherKeyring, encrypted, "data"},
+		{"tampered additional data", keyring, encrypted, "date"},
+		{"tampered nonce", keyring, tampered(1), "data"},
+		{"tampered ciphertext", keyring, tampered(len(encrypted) - 1), "data"},
+		{"unknown version", keyring, tampered(0), "data"},
+		{"truncated", keyring, encrypted[:encryptionOverhead-1], "data"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if payload, err := test.keyring.decrypt(test.encrypted, []byte(test.additionalData)); err == nil {
+				t.Fatalf("expected decrypting to fail, got %q", payload)
+			}
+		})
+	}
+}
+
+// Keys are rotated one node at a time, as an operator would through the
+// admin API, checking no node is suspected at any point
+func TestRollingKeyRotation(t *testing.T) {
+	oldKey, newKey := testKey(1), testKey(2)
+	s := NewSimulation(newSimulationConfig(5))
+	for _, transport := range s.transports {
+		keyring, err := NewKeyring(oldKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport.Keyring = keyring
+	}
+	expectConverged(t, s, "joining", 15)
+
+	steps := []struct {
+		name   string
+		change func(*Keyring, []byte) error
+		key    []byte
+	}{
+		{"installing the new key", (*Keyring).Install, newKey},
+		{"using the new key", (*Keyring).Use, newKey},
+		{"removing the old key", (*Keyring).Remove, oldKey},
+	}
+	for _, step := range steps {
+		for _, transport := range s.transports {
+			if err := step.change(transport.Keyring, step.key); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 5; i++ {
+				s.Step()
+			}
+		}
+		if !s.Converged() {
+			t.Fatalf("expected the cluster to stay converged while %s", step.name)
+		}
+		expectNoFalsePositives(t, s, step.name)
+	}
+
+	// Only the new key works once the old one is removed everywhere
+	oldKeyring, err := NewKeyring(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsider := s.Network.Transport("outsider")
+	outsider.Keyring = oldKeyring
+	if _, err := outsider.Send(s.Nodes[0].Node.RemoteAddress, newGossipMessage(s.Nodes[0], pingMessage), s.Nodes[0].ProbeTimeout); err == nil {
+		t.Fatal("expected a node with only the old key to be rejected")
+	}
+}
+
+func TestKeysChangedWhileRunningAreSaved(t *testing.T) {
+	configKey, rotatedKey, newConfigKey := testKey(1), testKey(2), testKey(3)
+	stateFile := filepath.Join(t.TempDir(), "state.yml")
+	newNode := func(configKeys ...[]byte) *Gossip {
+		keyring, err := NewKeyring(configKeys...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewGossip(&Node{ID: "node-1"}, GossipSettings{StateFile: stateFile, Keyring: keyring})
+	}
+
+	g := newNode(configKey)
+	if err := g.Keyring.Install(rotatedKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Keyring.Use(rotatedKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Keyring.Remove(configKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := LoadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		configKey      []byte
+		expectedKeyIDs []string
+	}{
+		{"config unchanged", configKey, []string{KeyID(rotatedKey)}},
+		{"config changed", newConfigKey, []string{KeyID(newConfigKey)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			restarted := newNode(test.configKey)
+			if err := restarted.RestoreState(state); err != nil {
+				t.Fatal(err)
+			}
+			if keyIDs := restarted.Keyring.KeyIDs(); strings.Join(keyIDs, ",") != strings.Join(test.expectedKeyIDs, ",") {
+				t.Fatalf("expected keys %v, got %v", test.expectedKeyIDs, keyIDs)
+			}
+		})
+	}
+}
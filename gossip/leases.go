@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Leases let one node at a time run a singleton job, such as draining a
+// queue. A node with quorum acquires a named lease by asking every member
+// that hasn't left to grant it, and holds it if the members that granted it
+// are most of the cluster, counted the same way as quorum. Members that seem
+// dead are asked too, as views of the cluster can be wrong for a while after
+// a partition heals. A member refuses to grant a lease that it has granted to
+// another node until that grant has expired on its own clock, so two nodes
+// can't both be granted a lease by most of the cluster. Unlike leadership,
+// this doesn't depend on how quickly a partitioned node notices it has lost
+// quorum.
+//
+// It does depend on nodes agreeing on who is in the cluster, as majorities of
+// two different views needn't share a member. Nodes must have joined the
+// cluster to acquire leases, and must know of at least ExpectedClusterSize
+// nodes, or minLeaseClusterSize if that is unset, so that a node that has
+// just started, or has been cut off since it started, can't be a majority by
+// itself. Setting ExpectedClusterSize also requires grants from more than
+// half that many nodes, which is safe however views differ, as long as the
+// cluster doesn't grow past that size.
+//
+// Each acquisition gets a higher fencing token than any granted before, as
+// any two majorities share a member that refuses tokens it has already seen.
+// Renewals keep their token. Higher tokens seen by then must be from failed
+// attempts, as nobody else can have acquired the lease while it was held.
+// Anything the lease guards should reject writes with a lower token than it
+// has seen, in case a holder stalls past the end of its lease.
+//
+// Grants are timed from when a member receives the request, and the holder
+// times its lease from before it sent the request, minus maxLeaseClockDrift.
+// This is safe as long as no node's clock runs more than maxLeaseClockDrift
+// faster than another's. Clocks don't need to agree on the time.
+//
+// A node's grant is replaced when it acquires the lease again, such as after
+// restarting without knowing it held the lease. Requests with a lower
+// incarnation than the grant are from before the node restarted, so are
+// refused.
+//
+// Members save their grants and tokens to their StateFile before replying,
+// so that they still refuse other nodes after restarting. Members without a
+// StateFile forget them, so if most of the cluster restarts within a lease's
+// duration, such as in a rolling deploy, the lease can be held twice.
+
+const (
+	maxLeaseNameSize   = 256
+	maxLeaseClockDrift = 0.05
+	// Unless ExpectedClusterSize is set
+	minLeaseClusterSize = 3
+)
+
+type Lease struct {
+	Name string `json:"name"`
+	// Increases every time the lease is acquired
+	Token     uint64    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type LeaseStatus struct {
+	Name string `json:"name"`
+	// The node this node last granted the lease to, if it hasn't expired
+	GrantedTo NodeID `json:"granted_to,omitempty"`
+	// The highest token this node has seen for the lease
+	Token          uint64     `json:"token"`
+	HeldByThisNode bool       `json:"held_by_this_node"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+}
+
+type leaseRequest struct {
+	Name     string        `yaml:"name"`
+	Token    uint64        `yaml:"token"`
+	Duration time.Duration `yaml:"duration"`
+	Renewal  bool          `yaml:"renewal,omitempty"`
+	Release  bool          `yaml:"release,omitempty"`
+}
+
+type leaseGrant struct {
+	Granted bool `yaml:"granted"`
+	// The node the lease is granted to instead, if refused because of it
+	Holder NodeID `yaml:"holder,omitempty"`
+	// The highest token the member has seen for the lease
+	Token uint64 `yaml:"token"`
+}
+
+type leaseGrantRecord struct {
+	holder      NodeID
+	incarnation uint64
+	token       uint64
+	expiresAt   time.Time
+}
+
+type heldLease struct {
+	Lease
+	duration time.Duration
+}
+
+type leases struct {
+	held    map[string]heldLease
+	granted map[string]leaseGrantRecord
+	// The highest token seen for each lease
+	tokens map[string]uint64
+}
+
+// AcquireLease tries to acquire a lease for the duration, and fails if it is
+// held by another node or this node lacks quorum. Acquiring a lease this node
+// already holds renews it. Nodes that try at the same time can refuse each
+// other, so retries should be jittered.
+//
+// Only one node holds a lease at a time as long as nodes agree on who is in
+// the cluster, or the cluster has no more than ExpectedClusterSize nodes.
+// Acquiring fails until this node has joined the cluster, and knows of at
+// least ExpectedClusterSize nodes including itself, or three if that is
+// unset. A cluster of one node must set ExpectedClusterSize to one.
+func (g *Gossip) AcquireLease(name string, duration time.Duration) (Lease, error) {
+	if name == "" || len(name) > maxLeaseNameSize {
+		return Lease{}, fmt.Errorf("lease names must be between 1 and %d bytes, got %d", maxLeaseNameSize, len(name))
+	}
+	if duration <= 0 {
+		return Lease{}, fmt.Errorf("lease duration must be positive, got %s", duration)
+	}
+	if _, held := g.Lease(name); held {
+		return g.RenewLease(name)
+	}
+
+	g.Lock()
+	hasQuorum := g.quorum.hasQuorum
+	err := g.knowsEnoughOfClusterForLeases()
+	g.Unlock()
+	if err != nil {
+		return Lease{}, fmt.Errorf("lease '%s' can't be acquired: %w", name, err)
+	}
+	if !hasQuorum {
+		return Lease{}, fmt.Errorf("lease '%s' can't be acquired without quorum", name)
+	}
+	// Members that have seen a higher token refuse the lease, and reply with
+	// that token, so it is worth trying again straight away with a higher one
+	for attempt := 0; ; attempt++ {
+		g.Lock()
+		token := g.leases.tokens[name] + 1
+		g.Unlock()
+		lease, grantedBy, err := g.requestLease(&leaseRequest{Name: name, Token: token, Duration: duration})
+		if err == nil {
+			infoLog.Printf("acquired lease '%s' with token %d\n", name, token)
+			return lease, nil
+		}
+		// Members that granted the lease would otherwise refuse everyone
+		// else until their grants expire
+		g.releaseGrants(name, token, grantedBy)
+		g.Lock()
+		staleToken := g.leases.tokens[name] > token
+		g.Unlock()
+		if attempt > 0 || !staleToken {
+			return Lease{}, err
+		}
+	}
+}
+
+// RenewLease extends a lease this node holds by the duration it was acquired
+// for. The lease is kept until it expires if it can't be renewed.
+func (g *Gossip) RenewLease(name string) (Lease, error) {
+	g.Lock()
+	lease, held := g.heldLease(name)
+	g.Unlock()
+	if !held {
+		return Lease{}, fmt.Errorf("lease '%s' is not held by this node", name)
+	}
+	renewed, _, err := g.requestLease(&leaseRequest{
+		Name:     name,
+		Token:    lease.Token,
+		Duration: lease.duration,
+		Renewal:  true,
+	})
+	if err != nil {
+		return Lease{}, fmt.Errorf("error renewing lease: %w", err)
+	}
+	return renewed, nil
+}
+
+// ReleaseLease gives up a lease this node holds, so that another node can
+// acquire it straight away
+func (g *Gossip) ReleaseLease(name string) error {
+	g.Lock()
+	lease, held := g.heldLease(name)
+	if !held {
+		g.Unlock()
+		return fmt.Errorf("lease '%s' is not held by this node", name)
+	}
+	delete(g.leases.held, name)
+	members := []NodeID{}
+	for _, nodeID := range g.knownNodeIDs() {
+		if g.OtherNodeStatuses[nodeID].State != NodeLeft {
+			members = append(members, nodeID)
+		}
+	}
+	g.Unlock()
+
+	infoLog.Printf("released lease '%s' with token %d\n", name, lease.Token)
+	g.releaseGrants(name, lease.Token, append(members, g.Node.ID))
+	return nil
+}
+
+// Lease returns a lease this node holds, if it hasn't expired
+func (g *Gossip) Lease(name string) (Lease, bool) {
+	g.Lock()
+	defer g.Unlock()
+	lease, held := g.heldLease(name)
+	return lease.Lease, held
+}
+
+// Leases lists every lease this node has held, granted or seen a token for,
+// sorted by name
+func (g *Gossip) Leases() []LeaseStatus {
+	g.Lock()
+	defer g.Unlock()
+
+	now := g.Clock.Now()
+	statuses := []LeaseStatus{}
+	for name, token := range g.leases.tokens {
+		status := LeaseStatus{Name: name, Token: token}
+		if record, ok := g.leases.granted[name]; ok && now.Before(record.expiresAt) {
+			status.GrantedTo = record.holder
+		}
+		if lease, held := g.heldLease(name); held {
+			status.HeldByThisNode = true
+			expiresAt := lease.ExpiresAt
+			status.ExpiresAt = &expiresAt
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// Must be called with the lock held. Forgets the lease if it has expired.
+func (g *Gossip) heldLease(name string) (heldLease, bool) {
+	lease, ok := g.leases.held[name]
+	if !ok {
+		return heldLease{}, false
+	}
+	if !g.Clock.Now().Before(lease.ExpiresAt) {
+		infoLog.Printf("lease '%s' with token %d expired\n", name, lease.Token)
+		delete(g.leases.held, name)
+		return heldLease{}, false
+	}
+	return lease, true
+}
+
+// Asks this node and every member that hasn't left to grant the lease.
+// Returns which nodes granted it, so that they can be released if most of the
+// cluster didn't.
+func (g *Gossip) requestLease(request *leaseRequest) (Lease, []NodeID, error) {
+	name := request.Name
+	g.Lock()
+	startedAt := g.Clock.Now()
+	if grant := g.grantLease(g.Node.ID, g.Incarnation, request); !grant.Granted {
+		g.Unlock()
+		return Lease{}, nil, leaseRefused(name, grant)
+	}
+	members := []NodeDescription{}
+	for _, nodeID := range g.knownNodeIDs() {
+		nodeStatus := g.OtherNodeStatuses[nodeID]
+		if nodeStatus.State != NodeLeft {
+			members = append(members, nodeStatus.Node)
+		}
+	}
+	g.Unlock()
+	if err := g.SaveState(); err != nil {
+		return Lease{}, []NodeID{g.Node.ID}, fmt.Errorf("error saving lease '%s': %w", name, err)
+	}
+
+	grants := make([]*leaseGrant, len(members))
+	g.forEachConcurrently(len(members), func(i int) {
+		message := newGossipMessage(g, leaseMessage)
+		message.Lease = request
+		reply, err := g.sendGossipMessage(message, members[i].RemoteAddress, g.ProbeTimeout)
+		if err != nil {
+			debugLog.Println(fmt.Errorf("error requesting lease from node '%s': %w", members[i].ID, err))
+			return
+		}
+		g.applyReply(reply)
+		grants[i] = reply.LeaseGrant
+	})
+
+	g.Lock()
+	defer g.Unlock()
+	grantedBy := map[NodeID]bool{g.Node.ID: true}
+	grantedByIDs := []NodeID{g.Node.ID}
+	var refusal *leaseGrant
+	for i, grant := range grants {
+		if grant == nil {
+			continue
+		}
+		g.witnessLeaseToken(name, grant.Token)
+		if grant.Granted {
+			grantedBy[members[i].ID] = true
+			grantedByIDs = append(grantedByIDs, members[i].ID)
+		} else if refusal == nil || grant.Holder != "" {
+			refusal = grant
+		}
+	}
+	if !g.grantedByMostOfCluster(grantedBy) {
+		if refusal != nil {
+			return Lease{}, grantedByIDs, leaseRefused(name, *refusal)
+		}
+		return Lease{}, grantedByIDs, fmt.Errorf("lease '%s' was only granted by %d nodes, not most of the cluster", name, len(grantedByIDs))
+	}
+
+	lease := heldLease{
+		Lease: Lease{
+			Name:      name,
+			Token:     request.Token,
+			ExpiresAt: startedAt.Add(request.Duration - time.Duration(float64(request.Duration)*maxLeaseClockDrift)),
+		},
+		duration: request.Duration,
+	}
+	if !g.Clock.Now().Before(lease.ExpiresAt) {
+		return Lease{}, grantedByIDs, fmt.Errorf("lease '%s' expired before it was granted", name)
+	}
+	if g.leases.held == nil {
+		g.leases.held = map[string]heldLease{}
+	}
+	g.leases.held[name] = lease
+	return lease.Lease, grantedByIDs, nil
+}
+
+func leaseRefused(name string, grant leaseGrant) error {
+	if grant.Holder != "" {
+		return fmt.Errorf("lease '%s' is held by node '%s'", name, grant.Holder)
+	}
+	return fmt.Errorf("lease '%s' was refused by a node that has seen token %d", name, grant.Token)
+}
+
+// Tells nodes that granted a lease that it is no longer needed
+func (g *Gossip) releaseGrants(name string, token uint64, nodeIDs []NodeID) {
+	request := &leaseRequest{Name: name, Token: token, Release: true}
+	g.Lock()
+	members := []NodeDescription{}
+	for _, nodeID := range nodeIDs {
+		if nodeID == g.Node.ID {
+			g.grantLease(g.Node.ID, g.Incarnation, request)
+		} else if nodeStatus, ok := g.OtherNodeStatuses[nodeID]; ok {
+			members = append(members, nodeStatus.Node)
+		}
+	}
+	g.Unlock()
+
+	g.forEachConcurrently(len(members), func(i int) {
+		message := newGossipMessage(g, leaseMessage)
+		message.Lease = request
+		reply, err := g.sendGossipMessage(message, members[i].RemoteAddress, g.ProbeTimeout)
+		if err != nil {
+			debugLog.Println(fmt.Errorf("error releasing lease with node '%s': %w", members[i].ID, err))
+			return
+		}
+		g.applyReply(reply)
+	})
+}
+
+// Releases every lease this node holds, before it leaves
+func (g *Gossip) releaseLeases() {
+	g.Lock()
+	names := []string{}
+	for name := range g.leases.held {
+		names = append(names, name)
+	}
+	g.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		if err := g.ReleaseLease(name); err != nil {
+			debugLog.Println(err)
+		}
+	}
+}
+
+// Must be called with the lock held. Grants a lease unless it has been
+// granted to another node and hasn't expired, or it is being acquired with a
+// token that has been seen before.
+func (g *Gossip) grantLease(from NodeID, incarnation uint64, request *leaseRequest) leaseGrant {
+	if g.leases.granted == nil {
+		g.leases.granted = map[string]leaseGrantRecord{}
+	}
+	record, known := g.leases.granted[request.Name]
+	sameHolder := known && record.holder == from
+	if sameHolder && incarnation < record.incarnation {
+		return leaseGrant{Holder: from, Token: g.leases.tokens[request.Name]}
+	}
+
+	if request.Release {
+		if sameHolder && record.token == request.Token {
+			record.expiresAt = time.Time{}
+			g.leases.granted[request.Name] = record
+		}
+		return leaseGrant{Granted: true, Token: g.leases.tokens[request.Name]}
+	}
+
+	now := g.Clock.Now()
+	if known && !sameHolder && now.Before(record.expiresAt) {
+		return leaseGrant{Holder: record.holder, Token: g.leases.tokens[request.Name]}
+	}
+	if !request.Renewal && request.Token <= g.leases.tokens[request.Name] {
+		return leaseGrant{Token: g.leases.tokens[request.Name]}
+	}
+	g.leases.granted[request.Name] = leaseGrantRecord{
+		holder:      from,
+		incarnation: incarnation,
+		token:       request.Token,
+		expiresAt:   now.Add(request.Duration),
+	}
+	g.witnessLeaseToken(request.Name, request.Token)
+	return leaseGrant{Granted: true, Token: request.Token}
+}
+
+// Must be called with the lock held
+func (g *Gossip) witnessLeaseToken(name string, token uint64) {
+	if g.leases.tokens == nil {
+		g.leases.tokens = map[string]uint64{}
+	}
+	if token > g.leases.tokens[name] {
+		g.leases.tokens[name] = token
+	}
+}
+
+// Must be called with the lock held
+func (g *Gossip) knowsEnoughOfClusterForLeases() error {
+	clusterSize := g.ExpectedClusterSize
+	if clusterSize == 0 {
+		clusterSize = minLeaseClusterSize
+	}
+	if !g.joined && clusterSize > 1 {
+		return fmt.Errorf("this node hasn't joined the cluster")
+	}
+	members := 1
+	for _, nodeStatus := range g.OtherNodeStatuses {
+		if nodeStatus.State != NodeLeft {
+			members += 1
+		}
+	}
+	if members < clusterSize {
+		return fmt.Errorf("this node only knows of %d nodes, fewer than the %d expected", members, clusterSize)
+	}
+	return nil
+}
+
+// Must be called with the lock held. Counts the nodes that granted a lease
+// the same way as the nodes seen recently are counted for quorum, and also
+// checks more than half of ExpectedClusterSize granted it.
+func (g *Gossip) grantedByMostOfCluster(grantedBy map[NodeID]bool) bool {
+	if 2*len(grantedBy) <= g.ExpectedClusterSize {
+		return false
+	}
+	summary := &GossipSummary{QuorumPolicy: g.QuorumPolicy, Zones: map[string]ZoneSummary{}}
+	summary.countZone(g.Node.Zone, g.self().VoteCount(), grantedBy[g.Node.ID])
+	for nodeID, nodeStatus := range g.OtherNodeStatuses {
+		if nodeStatus.State != NodeLeft {
+			summary.countZone(nodeStatus.Node.Zone, nodeStatus.Node.VoteCount(), grantedBy[nodeID])
+		}
+	}
+	return summary.RecentlySawMostOfCluster()
+}
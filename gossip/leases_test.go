@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type leaseJobs struct {
+	name     string
+	duration time.Duration
+
+	token            uint64
+	acquisitions     int
+	overlaps         int
+	tokenRegressions int
+}
+
+// How often nodes without the lease try to acquire it, in rounds
+const leaseAttemptEvery = 5
+
+// Runs a round of the job on every running node, checking who holds the
+// lease after each node has run
+func (s *Simulation) runLeaseJobs(jobs *leaseJobs) {
+	for i, node := range s.Nodes {
+		if s.crashed[node.Node.ID] {
+			continue
+		}
+		var err error
+		if lease, held := node.Lease(jobs.name); held {
+			if lease.ExpiresAt.Sub(node.Clock.Now()) < jobs.duration/2 {
+				_, err = node.RenewLease(jobs.name)
+			}
+		} else if (s.Round+i)%leaseAttemptEvery == 0 {
+			_, err = node.AcquireLease(jobs.name, jobs.duration)
+		}
+		if err != nil {
+			debugLog.Println(err)
+		}
+
+		holders := s.leaseHolders(jobs.name)
+		if len(holders) > 1 {
+			jobs.overlaps += 1
+		}
+		for _, holder := range holders {
+			lease, _ := s.Nodes[holder].Lease(jobs.name)
+			if lease.Token < jobs.token {
+				jobs.tokenRegressions += 1
+			}
+			if lease.Token > jobs.token {
+				jobs.token = lease.Token
+				jobs.acquisitions += 1
+			}
+		}
+	}
+}
+
+// The running nodes that hold a lease
+func (s *Simulation) leaseHolders(name string) []int {
+	holders := []int{}
+	for i, node := range s.Nodes {
+		if _, held := node.Lease(name); held && !s.crashed[node.Node.ID] {
+			holders = append(holders, i)
+		}
+	}
+	return holders
+}
+
+// Every node runs a job guarded by a lease, with clocks running at rates up
+// to maxLeaseClockDrift apart. Nodes try to acquire the lease every few
+// rounds, and renew it once half of it has passed. Every other node is
+// restarted, then the holder is crashed, then cut off with a minority of the
+// cluster, then cut off alone, to check that no two nodes ever hold the lease
+// at once and that tokens only go up.
+func TestLeaseIsHeldByOneNodeAtATime(t *testing.T) {
+	config := newSimulationConfig(30)
+	config.ClockDrift = maxLeaseClockDrift
+	config.StateDir = t.TempDir()
+	s := NewSimulation(config)
+	// Leases are only safe once nodes agree on who is in the cluster
+	expectConverged(t, s, "joining", 15)
+
+	// Long enough that members restarted while it is held would grant it to
+	// another node before it is renewed, if they forgot granting it
+	jobs := &leaseJobs{name: "singleton-job", duration: 20 * config.GossipSettings.GossipRegularity}
+	heal := func(t *testing.T, holder int) {
+		s.Heal()
+	}
+	scenarios := []struct {
+		name string
+		// Called with the holder at the start of the scenario
+		setUp func(t *testing.T, holder int)
+	}{
+		{"contended", nil},
+		{"granting members restarted", func(t *testing.T, holder int) {
+			for i := range s.Nodes {
+				if i != holder {
+					if err := s.Restart(i); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}},
+		{"holder crashed", func(t *testing.T, holder int) {
+			s.Crash(holder)
+		}},
+		{"holder in minority", func(t *testing.T, holder int) {
+			majority, minority := []int{}, []int{holder}
+			for i := range s.Nodes {
+				if i != holder && !s.crashed[s.Nodes[i].Node.ID] {
+					if len(minority) < len(s.Nodes)/3 {
+						minority = append(minority, i)
+					} else {
+						majority = append(majority, i)
+					}
+				}
+			}
+			s.Partition(majority, minority)
+		}},
+		{"healed", heal},
+		{"holder isolated", func(t *testing.T, holder int) {
+			others := []int{}
+			for i := range s.Nodes {
+				if i != holder {
+					others = append(others, i)
+				}
+			}
+			s.Partition(others, []int{holder})
+		}},
+		{"healed again", heal},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			if scenario.setUp != nil {
+				holders := s.leaseHolders(jobs.name)
+				if len(holders) == 0 {
+					t.Fatal("expected a node to hold the lease beforehand")
+				}
+				scenario.setUp(t, holders[0])
+			}
+			for i := 0; i < s.partitionRounds(); i++ {
+				s.Step()
+				s.runLeaseJobs(jobs)
+			}
+			if jobs.overlaps > 0 || jobs.tokenRegressions > 0 {
+				t.Fatalf("expected one holder at a time with rising tokens, got %d overlaps and %d token regressions", jobs.overlaps, jobs.tokenRegressions)
+			}
+			if len(s.leaseHolders(jobs.name)) == 0 {
+				t.Fatal("expected a node to hold the lease afterwards")
+			}
+		})
+	}
+}
+
+func TestLeaseNeedsNodeToHaveJoinedAndKnowEnoughOfCluster(t *testing.T) {
+	tests := []struct {
+		name                string
+		otherNodes          int
+		expectedClusterSize int
+		acquired            bool
+	}{
+		{"alone", 0, 0, false},
+		{"alone in a cluster of one", 0, 1, true},
+		{"alone in a cluster of three", 0, 3, false},
+		{"cut off since starting", 2, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := &Node{ID: "node-1", OtherNodes: map[NodeID]NodeDescription{}}
+			for i := 0; i < test.otherNodes; i++ {
+				nodeID := fmt.Sprintf("node-%d", i+2)
+				node.OtherNodes[nodeID] = NodeDescription{ID: nodeID, RemoteAddress: nodeID}
+			}
+			g := NewGossip(node, GossipSettings{
+				Transport:           NewMemoryNetwork(1).Transport("node-1"),
+				ProbeTimeout:        10 * time.Millisecond,
+				ExpectedClusterSize: test.expectedClusterSize,
+			})
+			// So that only what this node knows of the cluster is checked
+			g.quorum.hasQuorum = true
+
+			_, err := g.AcquireLease("singleton-job", time.Minute)
+			if acquired := err == nil; acquired != test.acquired {
+				t.Fatalf("expected acquired to be %v, got error %v", test.acquired, err)
+			}
+		})
+	}
+}
+
+func TestLeaseIsRefusedWithPartialViewOfCluster(t *testing.T) {
+	config := newSimulationConfig(5)
+	config.GossipSettings.ExpectedClusterSize = 5
+	s := NewSimulation(config)
+	expectConverged(t, s, "joining", 15)
+
+	// The minority side wrongly believes the nodes it can't reach have left,
+	// so it would make up most of the cluster it knows of
+	s.Partition([]int{0, 1}, []int{2, 3, 4})
+	for _, minority := range s.Nodes[:2] {
+		for _, majority := range s.Nodes[3:] {
+			setNodeState(minority, majority.Node.ID, NodeLeft)
+		}
+	}
+	if _, err := s.Nodes[0].AcquireLease("singleton-job", time.Minute); err == nil {
+		t.Fatal("expected a node that knows of too few nodes to be refused the lease")
+	}
+	if _, err := s.Nodes[2].AcquireLease("singleton-job", time.Minute); err != nil {
+		t.Fatalf("expected the majority to grant the lease, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Timeouts adapt as in Lifeguard, so that a node which is slow itself doesn't
+// accuse its healthy peers. Each node keeps a local health score, which rises
+// when its probes fail without the intermediaries replying either, or when it
+// has to refute being suspected, and falls when its probes succeed. Probe
+// timeouts and the time between rounds are multiplied by one more than the
+// score.
+//
+// Suspicions also time out more slowly to begin with, starting at
+// MaxNodeTimeoutMultiplier times NodeTimeoutAfter. Each other node that
+// independently suspects the same node brings the timeout down towards
+// NodeTimeoutAfter, reaching it after SuspicionConfirmations suspicions.
+
+// LocalHealth is this node's local health score, where 0 is healthy
+func (g *Gossip) LocalHealth() int {
+	g.Lock()
+	defer g.Unlock()
+	return g.localHealth
+}
+
+// Must be called with the lock held
+func (g *Gossip) adjustLocalHealth(delta int) {
+	previousHealth := g.localHealth
+	g.localHealth += delta
+	if g.localHealth > g.MaxLocalHealth {
+		g.localHealth = g.MaxLocalHealth
+	}
+	if g.localHealth < 0 {
+		g.localHealth = 0
+	}
+	if g.localHealth != previousHealth {
+		debugLog.Printf("local health score is now %d\n", g.localHealth)
+	}
+}
+
+// Must be called with the lock held
+func (g *Gossip) scaleByLocalHealth(timeout time.Duration) time.Duration {
+	return timeout * time.Duration(1+g.localHealth)
+}
+
+// Must be called with the lock held
+func (g *Gossip) suspicionTimeout(nodeStatus NodeGossip) time.Duration {
+	minTimeout := g.NodeTimeoutAfter
+	maxTimeout := time.Duration(g.MaxNodeTimeoutMultiplier) * minTimeout
+
+	// Only nodes other than this one and the suspect can confirm suspicions
+	expectedConfirmations := g.SuspicionConfirmations
+	if others := g.liveNodeCount() - 1; others < expectedConfirmations {
+		expectedConfirmations = others
+	}
+	if expectedConfirmations <= 0 || maxTimeout <= minTimeout {
+		return minTimeout
+	}
+
+	confirmations := len(nodeStatus.suspectedBy) - 1
+	if confirmations < 0 {
+		confirmations = 0
+	}
+	fraction := math.Log(float64(confirmations+1)) / math.Log(float64(expectedConfirmations+1))
+	timeout := maxTimeout - time.Duration(fraction*float64(maxTimeout-minTimeout))
+	if timeout < minTimeout {
+		return minTimeout
+	}
+	return timeout
+}
+
+// Must be called with the lock held. Counts the other nodes that are alive
+// or suspected.
+func (g *Gossip) liveNodeCount() int {
+	count := 0
+	for _, nodeStatus := range g.OtherNodeStatuses {
+		if nodeStatus.State == NodeAlive || nodeStatus.State == NodeSuspect {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Must be called with the lock held. Records another node suspecting an
+// already suspected node, and passes the suspicion on if it is new, so that
+// other nodes can count it too.
+func (g *Gossip) confirmSuspicion(update membershipUpdate, nodeStatus NodeGossip) {
+	if update.From == "" || update.From == g.Node.ID || nodeStatus.suspectedBy[update.From] {
+		return
+	}
+	nodeStatus.addSuspicion(update.From)
+	g.setNodeStatus(update.NodeID, nodeStatus)
+	update.RemoteAddress = nodeStatus.Node.RemoteAddress
+	update.Tags = nil
+	g.queueBroadcast(update)
+}
+
+func (s *NodeGossip) addSuspicion(from NodeID) {
+	if from == "" {
+		return
+	}
+	if s.suspectedBy == nil {
+		s.suspectedBy = map[NodeID]bool{}
+	}
+	s.suspectedBy[from] = true
+}
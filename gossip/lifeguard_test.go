@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+// Runs a cluster with one node too slow to reply to probes in time, returning
+// the false positives about the healthy nodes it probes
+func simulateSlowNode(t *testing.T, config SimulationConfig) (uint64, uint64) {
+	s := NewSimulation(config)
+	expectConverged(t, s, "joining", 15)
+
+	suspicionsBefore, deathsBefore := s.FalsePositives()
+	s.Slow(1, 3*config.GossipSettings.ProbeTimeout)
+	for i := 0; i < 60; i++ {
+		s.Step()
+	}
+	s.Slow(1, 0)
+	expectConverged(t, s, "the slow node recovering", 100)
+	suspicions, deaths := s.FalsePositives()
+	return suspicions - suspicionsBefore, deaths - deathsBefore
+}
+
+func TestLifeguardReducesFalsePositivesFromSlowNode(t *testing.T) {
+	config := newSimulationConfig(30)
+	fixedConfig := config
+	fixedConfig.GossipSettings.MaxNodeTimeoutMultiplier = 1
+	fixedConfig.GossipSettings.MaxLocalHealth = 0
+
+	fixedSuspicions, fixedDeaths := simulateSlowNode(t, fixedConfig)
+	suspicions, deaths := simulateSlowNode(t, config)
+	if suspicions >= fixedSuspicions || deaths >= fixedDeaths {
+		t.Fatalf("expected fewer false positives than the %d suspicions and %d deaths with fixed timeouts, got %d and %d",
+			fixedSuspicions, fixedDeaths, suspicions, deaths)
+	}
+	// Lifeguard should make a large difference, not a marginal one
+	if 4*suspicions > fixedSuspicions {
+		t.Fatalf("expected at most a quarter of the %d false suspicions with fixed timeouts, got %d", fixedSuspicions, suspicions)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+var (
+	debugLog = log.New(os.Stderr, "DEBUG ", log.LstdFlags)
+	infoLog  = log.New(os.Stderr, "INFO ", log.LstdFlags)
+	warnLog  = log.New(os.Stderr, "WARN ", log.LstdFlags)
+	errorLog = log.New(os.Stderr, "ERROR ", log.LstdFlags)
+)
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// Discards log lines below the given level
+func SetLogLevel(level string) error {
+	if err := validateLogLevel(level); err != nil {
+		return err
+	}
+	loggers := []*log.Logger{debugLog, infoLog, warnLog, errorLog}
+	discard := true
+	for i, logger := range loggers {
+		if logLevels[i] == level {
+			discard = false
+		}
+		if discard {
+			logger.SetOutput(ioutil.Discard)
+		} else {
+			logger.SetOutput(os.Stderr)
+		}
+	}
+	return nil
+}
+
+func validateLogLevel(level string) error {
+	for _, logLevel := range logLevels {
+		if logLevel == level {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level '%s', must be one of %v", level, logLevels)
+}
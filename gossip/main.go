@@ -1,46 +1,313 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
-	// FIXME: Take config better
-	configFilePath := os.Args[1]
-	nodeID := os.Args[2]
-	// FIXME: Configure node local address better
-	localAddress := ":" + nodeID
+	configFilePath := flag.String("config", "", "path to the cluster config file")
+	nodeID := flag.String("node-id", "", "id of this node")
+	listenAddress := flag.String("listen-address", "", "address to listen for gossip on, overriding the config file")
+	remoteAddress := flag.String("remote-address", "", "address other nodes should use for this node, overriding the config file")
+	logLevel := flag.String("log-level", "", "one of debug, info, warn or error, overriding the config file")
+	discovery := flag.String("discovery", "file", "how to discover other nodes, either file or dns")
+	discoveryInterval := flag.Duration("discovery-interval", 10*time.Second, "how often to rediscover nodes")
+	dnsName := flag.String("dns-name", "", "DNS SRV name to discover nodes with, or A/AAAA name if -dns-port is set")
+	dnsPort := flag.Int("dns-port", 0, "gossip port of nodes discovered with A/AAAA records")
+	dnsResolver := flag.String("dns-resolver", "", "address of a DNS server to use instead of the system resolver")
+	tags := tagFlags{}
+	flag.Var(tags, "tag", "key=value tag for this node, adding to those in the config file; can be repeated")
+	zone := flag.String("zone", "", "zone this node is in, overriding the config file")
+	stateFile := flag.String("state-file", "", "file to save this node's state in so it can rejoin quickly, overriding the config file")
+	statusAddress := flag.String("status-address", "", "address to serve the status API on, overriding the config file")
+	adminAddress := flag.String("admin-address", "", "address to serve the admin API on, overriding the config file")
+	flag.Parse()
 
-	clusterDiscovery := ClusterDiscoveryFromFile{ConfigFile: configFilePath}
+	if *configFilePath == "" {
+		log.Fatal(fmt.Errorf("a config file must be given with -config"))
+	}
+	config, err := LoadConfig(*configFilePath, *nodeID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *listenAddress != "" {
+		config.ListenAddress = *listenAddress
+	}
+	if *remoteAddress != "" {
+		config.RemoteAddress = *remoteAddress
+	}
+	if *logLevel != "" {
+		config.LogLevel = *logLevel
+	}
+	if *zone != "" {
+		config.Zone = *zone
+	}
+	if *stateFile != "" {
+		config.GossipSettings.StateFile = *stateFile
+	}
+	if *statusAddress != "" {
+		config.StatusAddress = *statusAddress
+	}
+	if *adminAddress != "" {
+		config.AdminAddress = *adminAddress
+	}
+	if len(tags) > 0 && config.Tags == nil {
+		config.Tags = map[string]string{}
+	}
+	for key, value := range tags {
+		config.Tags[key] = value
+	}
+	if config.ListenAddress == "" {
+		config.ListenAddress = config.RemoteAddress
+	}
+	if err = config.Validate(); err != nil {
+		log.Fatal(fmt.Errorf("invalid config: %w", err))
+	}
+	if err = SetLogLevel(config.LogLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	var clusterDiscovery ClusterDiscovery
+	switch *discovery {
+	case "file":
+		clusterDiscovery = &ClusterDiscoveryFromFile{ConfigFile: *configFilePath}
+	case "dns":
+		if *dnsName == "" {
+			log.Fatal(fmt.Errorf("a DNS name must be given with -dns-name to discover nodes with DNS"))
+		}
+		clusterDiscovery = &ClusterDiscoveryFromDNS{
+			Name:            *dnsName,
+			Port:            *dnsPort,
+			ResolverAddress: *dnsResolver,
+		}
+	default:
+		log.Fatal(fmt.Errorf("unknown discovery '%s', must be file or dns", *discovery))
+	}
 	nodeList, err := clusterDiscovery.DiscoverNodes()
 	if err != nil {
 		log.Fatal(fmt.Errorf("error discovering nodes: %w", err))
 	}
 
+	// Nodes discovered without an ID are only used as seeds
 	otherNodes := indexNodes(nodeList)
-	delete(otherNodes, nodeID)
+	delete(otherNodes, "")
+	delete(otherNodes, config.NodeID)
 	node := &Node{
-		ID:           nodeID,
-		LocalAddress: localAddress,
-		OtherNodes:   otherNodes,
+		ID:            config.NodeID,
+		LocalAddress:  config.ListenAddress,
+		RemoteAddress: config.RemoteAddress,
+		Tags:          config.Tags,
+		Zone:          config.Zone,
+		Votes:         config.Votes,
+		OtherNodes:    otherNodes,
 	}
 
-	gossipSettings := GossipSettings{
-		GossipRegularity: 1 * time.Second,
-		NodeTimeoutAfter: 2 * time.Second,
+	var keyring *Keyring
+	if len(config.EncryptionKeys) > 0 {
+		keys := [][]byte{}
+		for _, encodedKey := range config.EncryptionKeys {
+			key, err := ParseKey(encodedKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			keys = append(keys, key)
+		}
+		if keyring, err = NewKeyring(keys...); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	gossipSettings := config.GossipSettings
+	gossipSettings.Keyring = keyring
+	switch config.Transport {
+	case "udp":
+		transport, err := NewUDPTransport(config.ListenAddress, gossipSettings.GossipRegularity)
+		if err != nil {
+			log.Fatal(err)
+		}
+		transport.Keyring = keyring
+		gossipSettings.Transport = transport
+	case "http":
+		var tlsConfig *tls.Config
+		if config.TLS.CAFile != "" {
+			tlsConfig, err = LoadMutualTLSConfig(config.TLS.CAFile, config.TLS.CertFile, config.TLS.KeyFile)
+			if err != nil {
+				log.Fatal(fmt.Errorf("error loading TLS config: %w", err))
+			}
+		}
+		transport, err := NewHTTPTransport(config.ListenAddress, tlsConfig, gossipSettings.GossipRegularity)
+		if err != nil {
+			log.Fatal(err)
+		}
+		transport.Keyring = keyring
+		gossipSettings.Transport = transport
 	}
 	gossip := NewGossip(node, gossipSettings)
+
+	rejoinAddresses := []string{}
+	if gossipSettings.StateFile != "" {
+		state, err := LoadState(gossipSettings.StateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if state != nil {
+			if err = gossip.RestoreState(state); err != nil {
+				log.Fatal(err)
+			}
+			rejoinAddresses = state.RejoinAddresses()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exitSignals := make(chan os.Signal, 1)
+	signal.Notify(exitSignals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-exitSignals
+		infoLog.Println("Leaving...")
+		cancel()
+	}()
+
+	if config.StatusAddress != "" {
+		go func() {
+			if err := ServeStatus(ctx, gossip, config.StatusAddress); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if config.AdminAddress != "" {
+		go func() {
+			if err := ServeAdmin(ctx, gossip, keyring, config.AdminAddress); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Discovered nodes are used as seeds, so that nodes which were not
+	// discovered can join, along with members saved before restarting
+	seedAddresses := []string{}
+	isSeed := map[string]bool{}
+	for _, discoveredNode := range nodeList {
+		if discoveredNode.ID != config.NodeID {
+			seedAddresses = append(seedAddresses, discoveredNode.RemoteAddress)
+			isSeed[discoveredNode.RemoteAddress] = true
+		}
+	}
+	for _, address := range rejoinAddresses {
+		if !isSeed[address] {
+			seedAddresses = append(seedAddresses, address)
+			isSeed[address] = true
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(gossipSettings.GossipRegularity)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			contacted, err := gossip.Join(seedAddresses)
+			if err != nil {
+				warnLog.Println(err)
+			}
+			if contacted > 0 || len(seedAddresses) == 0 {
+				return
+			}
+		}
+	}()
+
+	go clusterDiscovery.Watch(*discoveryInterval, ctx.Done(), gossip.UpdateDiscoveredNodes)
+
+	membershipEvents, _ := gossip.Subscribe()
 	go func() {
-		if err := gossip.Run(); err != nil {
-			log.Fatal(fmt.Errorf("error in gossiping: %w", err))
+		for event := range membershipEvents {
+			fmt.Printf("node '%s' %s at %s\n", event.Node.ID, event.Type, event.At.Format(time.RFC3339))
 		}
 	}()
 
-	for range time.Tick(1 * time.Second) {
-		summary := gossip.Summary()
-		fmt.Printf("RecentlySawMostOfCluster=%v %#v\n", summary.RecentlySawMostOfCluster(), summary)
+	userEvents, _ := gossip.SubscribeUserEvents()
+	go func() {
+		for event := range userEvents {
+			fmt.Printf("user event '%s' from node '%s' at lamport time %d: %q\n", event.Name, event.Origin, event.LTime, event.Payload)
+		}
+	}()
+
+	configChanges, _ := gossip.SubscribeConfig()
+	go func() {
+		for entry := range configChanges {
+			if entry.Deleted {
+				fmt.Printf("cluster config '%s' deleted by node '%s' at version %d\n", entry.Key, entry.UpdatedBy, entry.Version)
+				continue
+			}
+			fmt.Printf("cluster config '%s' set to %q by node '%s' at version %d\n", entry.Key, entry.Value, entry.UpdatedBy, entry.Version)
+		}
+	}()
+
+	// Every node answers ping queries, so that which nodes a query reaches
+	// can be checked with gossipctl
+	gossip.HandleQueries("ping", func(ctx context.Context, query Query) ([]byte, error) {
+		return []byte("pong from " + config.NodeID), nil
+	})
+
+	quorumEvents, _ := gossip.SubscribeQuorum()
+	go func() {
+		for event := range quorumEvents {
+			if event.Partitions != nil {
+				fmt.Printf("%s into %v at %s\n", event.Type, event.Partitions.Components, event.At.Format(time.RFC3339))
+				continue
+			}
+			fmt.Printf("%s at %s\n", event.Type, event.At.Format(time.RFC3339))
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			summary := gossip.Summary()
+			leadership := gossip.Leadership()
+			fmt.Printf("RecentlySawMostOfCluster=%v Leader=%s IsLeader=%v %#v\n", summary.RecentlySawMostOfCluster(), leadership.Leader, leadership.IsLeader, summary)
+		}
+	}()
+
+	if err := gossip.Run(ctx); err != nil {
+		log.Fatal(fmt.Errorf("error in gossiping: %w", err))
+	}
+	infoLog.Println("Left the cluster")
+}
+
+type tagFlags map[string]string
+
+func (t tagFlags) String() string {
+	pairs := []string{}
+	for key, value := range t {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (t tagFlags) Set(pair string) error {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("tags must be key=value, got '%s'", pair)
 	}
+	t[parts[0]] = parts[1]
+	return nil
 }
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// Tests fail and succeed on purpose, so only errors are logged
+func TestMain(m *testing.M) {
+	if err := SetLogLevel("error"); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
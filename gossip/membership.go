@@ -0,0 +1,231 @@
+package main
+
+import "fmt"
+
+// Nodes can join a running cluster by contacting any seed node. The seed
+// replies with its full membership list, and gossips about the new node to
+// everyone else. Nodes that leave tell a few other nodes, who gossip it on.
+
+// Must be called with the lock held. Adds a node that was not known about
+// before as alive, and gossips about it. Returns false if the node was
+// already known.
+func (g *Gossip) addNode(node NodeDescription, incarnation uint64) bool {
+	if node.ID == "" || node.ID == g.Node.ID || node.RemoteAddress == "" {
+		return false
+	}
+	if _, ok := g.OtherNodeStatuses[node.ID]; ok {
+		return false
+	}
+
+	infoLog.Printf("node '%s' joined at '%s'\n", node.ID, node.RemoteAddress)
+	now := g.Clock.Now()
+	g.setNodeStatus(node.ID, NodeGossip{
+		Node:        node,
+		State:       NodeAlive,
+		Incarnation: incarnation,
+		LastSeenAt:  &now,
+	})
+	g.queueBroadcast(membershipUpdate{
+		NodeID:        node.ID,
+		RemoteAddress: node.RemoteAddress,
+		State:         NodeAlive,
+		Incarnation:   incarnation,
+		Tags:          node.Tags,
+		Zone:          node.Zone,
+		Votes:         node.Votes,
+	})
+	return true
+}
+
+// Lists every node we know about, including this node. Nodes that we have
+// never heard from are left out, as they are only suspected because of that.
+func (g *Gossip) members() []membershipUpdate {
+	g.Lock()
+	defer g.Unlock()
+
+	members := []membershipUpdate{{
+		NodeID:        g.Node.ID,
+		RemoteAddress: g.Node.RemoteAddress,
+		State:         NodeAlive,
+		Incarnation:   g.Incarnation,
+		Tags:          g.Node.Tags,
+		Zone:          g.Node.Zone,
+		Votes:         g.Node.Votes,
+	}}
+	for _, nodeID := range g.knownNodeIDs() {
+		nodeStatus := g.OtherNodeStatuses[nodeID]
+		if nodeStatus.LastSeenAt == nil && nodeStatus.State == NodeSuspect {
+			continue
+		}
+		members = append(members, membershipUpdate{
+			NodeID:        nodeID,
+			RemoteAddress: nodeStatus.Node.RemoteAddress,
+			State:         nodeStatus.State,
+			Incarnation:   nodeStatus.Incarnation,
+			Tags:          nodeStatus.Node.Tags,
+			Zone:          nodeStatus.Node.Zone,
+			Votes:         nodeStatus.Node.Votes,
+		})
+	}
+	return members
+}
+
+// SetTags replaces this node's tags, and gossips them with a new incarnation
+// so that they take precedence over the old tags.
+func (g *Gossip) SetTags(tags map[string]string) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.Node.Tags = copyTags(tags)
+	g.Incarnation += 1
+	g.queueBroadcast(membershipUpdate{
+		NodeID:        g.Node.ID,
+		RemoteAddress: g.Node.RemoteAddress,
+		State:         NodeAlive,
+		Incarnation:   g.Incarnation,
+		Tags:          g.Node.Tags,
+		Zone:          g.Node.Zone,
+		Votes:         g.Node.Votes,
+	})
+}
+
+// Must be called with the lock held
+func (g *Gossip) self() NodeDescription {
+	return NodeDescription{
+		ID:            g.Node.ID,
+		RemoteAddress: g.Node.RemoteAddress,
+		Tags:          g.Node.Tags,
+		Zone:          g.Node.Zone,
+		Votes:         g.Node.Votes,
+	}
+}
+
+// MembersWithTags lists the alive members, including this node, that have
+// every one of the given tags. Services can use it to find their peers.
+func (g *Gossip) MembersWithTags(tags map[string]string) []NodeDescription {
+	g.Lock()
+	defer g.Unlock()
+
+	members := []NodeDescription{}
+	self := g.self()
+	self.Tags = copyTags(self.Tags)
+	if self.HasTags(tags) {
+		members = append(members, self)
+	}
+	for _, nodeID := range g.knownNodeIDs() {
+		nodeStatus := g.OtherNodeStatuses[nodeID]
+		if nodeStatus.State == NodeAlive && nodeStatus.Node.HasTags(tags) {
+			node := nodeStatus.Node
+			node.Tags = copyTags(node.Tags)
+			members = append(members, node)
+		}
+	}
+	return members
+}
+
+// Join contacts each seed node to learn about the members of the cluster and
+// to announce this node to them. Returns how many seed nodes were contacted.
+// Seeds are contacted concurrently, so an unresponsive seed only delays Join
+// by GossipRegularity.
+func (g *Gossip) Join(seedAddresses []string) (int, error) {
+	otherSeedAddresses := []string{}
+	for _, seedAddress := range seedAddresses {
+		if seedAddress != g.Node.RemoteAddress {
+			otherSeedAddresses = append(otherSeedAddresses, seedAddress)
+		}
+	}
+	replies := make([]*gossipReply, len(otherSeedAddresses))
+	errs := make([]error, len(otherSeedAddresses))
+	g.forEachConcurrently(len(otherSeedAddresses), func(i int) {
+		replies[i], errs[i] = g.sendGossipMessage(newGossipMessage(g, joinMessage), otherSeedAddresses[i], g.GossipRegularity)
+	})
+
+	contacted := 0
+	var lastErr error
+	for i, reply := range replies {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			continue
+		}
+
+		g.Lock()
+		g.addNode(NodeDescription{
+			ID:            reply.NodeID,
+			RemoteAddress: otherSeedAddresses[i],
+			Zone:          reply.Zone,
+			Votes:         reply.Votes,
+		}, reply.Incarnation)
+		g.joined = true
+		g.Unlock()
+		g.markAlive(reply.NodeID, reply.Incarnation)
+		g.applyReply(reply)
+		g.applyMembershipUpdates(reply.Members)
+		contacted += 1
+	}
+	if contacted == 0 && lastErr != nil {
+		return 0, fmt.Errorf("error joining cluster: %w", lastErr)
+	}
+	return contacted, nil
+}
+
+// Leave tells some other nodes that this node is leaving, so that they can
+// gossip it to everyone else rather than waiting to notice it is dead.
+func (g *Gossip) Leave() error {
+	g.Lock()
+	fanout := g.retransmitLimit()
+	g.Unlock()
+
+	targets := g.randomNodes(fanout, g.Node.ID)
+	if len(targets) == 0 {
+		return nil
+	}
+
+	message := newGossipMessage(g, leaveMessage)
+	errs := make([]error, len(targets))
+	g.forEachConcurrently(len(targets), func(i int) {
+		_, errs[i] = g.sendGossipMessage(message, targets[i].RemoteAddress, g.ProbeTimeout)
+	})
+
+	told := 0
+	var lastErr error
+	for _, err := range errs {
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		told += 1
+	}
+	if told == 0 {
+		return fmt.Errorf("error leaving cluster: %w", lastErr)
+	}
+	return nil
+}
+
+// UpdateDiscoveredNodes joins through nodes that cluster discovery has found.
+// Nodes that cluster discovery no longer finds are only no longer used as
+// seeds, as this node's view of discovery may be stale or partial, and are
+// left to failure detection if they have stopped.
+func (g *Gossip) UpdateDiscoveredNodes(added, removed []NodeDescription) {
+	seedAddresses := []string{}
+	addedNodeIDs := map[NodeID]bool{}
+	for _, node := range added {
+		if node.ID == g.Node.ID {
+			continue
+		}
+		seedAddresses = append(seedAddresses, node.RemoteAddress)
+		addedNodeIDs[node.ID] = true
+	}
+	if len(seedAddresses) > 0 {
+		if _, err := g.Join(seedAddresses); err != nil {
+			warnLog.Println(fmt.Errorf("error joining through discovered nodes: %w", err))
+		}
+	}
+
+	for _, node := range removed {
+		// Nodes whose address changed are both added and removed
+		if node.ID != "" && addedNodeIDs[node.ID] {
+			continue
+		}
+		infoLog.Printf("node at '%s' is no longer discovered\n", node.RemoteAddress)
+	}
+}
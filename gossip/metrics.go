@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are served on /metrics of the status API in the Prometheus text
+// format. Counters and histograms are kept per peer, which is fine for the
+// cluster sizes gossip is meant for. Member states, quorum and bytes are
+// read when scraped rather than being recorded.
+
+var probeRoundTripBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type gossipMetrics struct {
+	lock            sync.Mutex
+	probesSent      map[NodeID]uint64
+	probesFailed    map[NodeID]uint64
+	probeRoundTrips map[NodeID]*histogram
+	stateChanges    map[NodeID]map[NodeState]uint64
+}
+
+type histogram struct {
+	// Counts for each bucket, not including lower buckets
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+func (m *gossipMetrics) probeSent(nodeID NodeID) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.probesSent == nil {
+		m.probesSent = map[NodeID]uint64{}
+	}
+	m.probesSent[nodeID] += 1
+}
+
+func (m *gossipMetrics) probeFailed(nodeID NodeID) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.probesFailed == nil {
+		m.probesFailed = map[NodeID]uint64{}
+	}
+	m.probesFailed[nodeID] += 1
+}
+
+func (m *gossipMetrics) probeRoundTrip(nodeID NodeID, roundTrip time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.probeRoundTrips == nil {
+		m.probeRoundTrips = map[NodeID]*histogram{}
+	}
+	h, ok := m.probeRoundTrips[nodeID]
+	if !ok {
+		h = &histogram{bucketCounts: make([]uint64, len(probeRoundTripBuckets))}
+		m.probeRoundTrips[nodeID] = h
+	}
+	seconds := roundTrip.Seconds()
+	for i, bucket := range probeRoundTripBuckets {
+		if seconds <= bucket {
+			h.bucketCounts[i] += 1
+			break
+		}
+	}
+	h.sum += seconds
+	h.count += 1
+}
+
+func (m *gossipMetrics) stateChanged(nodeID NodeID, state NodeState) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stateChanges == nil {
+		m.stateChanges = map[NodeID]map[NodeState]uint64{}
+	}
+	if m.stateChanges[nodeID] == nil {
+		m.stateChanges[nodeID] = map[NodeState]uint64{}
+	}
+	m.stateChanges[nodeID][state] += 1
+}
+
+// WriteMetrics writes every metric in the Prometheus text format
+func (g *Gossip) WriteMetrics(w io.Writer) error {
+	g.Lock()
+	summary := g.summary()
+	membersByState := map[NodeState]int{NodeAlive: 1}
+	for _, nodeStatus := range g.OtherNodeStatuses {
+		membersByState[nodeStatus.State] += 1
+	}
+	incarnation := g.Incarnation
+	localHealth := g.localHealth
+	coordinateError := g.coordinates.coordinate.Error
+	configVersion := g.configVersion()
+	partitions := g.partitionView()
+	g.Unlock()
+	leadership := g.Leadership()
+
+	m := &metricsWriter{w: w}
+	m.header("gossip_members", "gauge", "Members known to this node by state, including this node.")
+	for _, state := range []NodeState{NodeAlive, NodeSuspect, NodeDead, NodeLeft} {
+		m.sample("gossip_members", labels("state", state.String()), float64(membersByState[state]))
+	}
+	m.header("gossip_quorum", "gauge", "Whether this node recently saw most of the cluster.")
+	m.sample("gossip_quorum", "", boolToFloat(summary.RecentlySawMostOfCluster()))
+	zones := []string{}
+	for zone := range summary.Zones {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	m.header("gossip_zone_votes", "gauge", "Votes of the nodes in each zone, by whether they were seen recently.")
+	for _, zone := range zones {
+		zoneSummary := summary.Zones[zone]
+		m.sample("gossip_zone_votes", labels("zone", zone, "seen", "true"), float64(zoneSummary.VotesSeenRecently))
+		m.sample("gossip_zone_votes", labels("zone", zone, "seen", "false"), float64(zoneSummary.Votes-zoneSummary.VotesSeenRecently))
+	}
+	m.header("gossip_partitions", "gauge", "Components the cluster is split into, as seen by this node.")
+	m.sample("gossip_partitions", "", float64(len(partitions.Components)))
+	m.header("gossip_is_leader", "gauge", "Whether this node holds an unexpired leader lease.")
+	m.sample("gossip_is_leader", "", boolToFloat(leadership.IsLeader))
+	m.header("gossip_incarnation", "gauge", "Incarnation number of this node.")
+	m.sample("gossip_incarnation", "", float64(incarnation))
+	m.header("gossip_local_health", "gauge", "Local health score of this node, where 0 is healthy and higher stretches its timeouts.")
+	m.sample("gossip_local_health", "", float64(localHealth))
+	m.header("gossip_coordinate_error", "gauge", "Estimated error of this node's network coordinates, relative to round trip times.")
+	m.sample("gossip_coordinate_error", "", coordinateError)
+	m.header("gossip_cluster_config_version", "gauge", "Highest version of any cluster config entry known to this node.")
+	m.sample("gossip_cluster_config_version", "", float64(configVersion))
+
+	stats := g.Transport.Stats()
+	m.header("gossip_transport_sent_bytes_total", "counter", "Bytes of gossip sent.")
+	m.sample("gossip_transport_sent_bytes_total", "", float64(stats.BytesSent))
+	m.header("gossip_transport_received_bytes_total", "counter", "Bytes of gossip received.")
+	m.sample("gossip_transport_received_bytes_total", "", float64(stats.BytesReceived))
+
+	g.metrics.lock.Lock()
+	defer g.metrics.lock.Unlock()
+	m.header("gossip_probes_sent_total", "counter", "Direct probes sent to each peer.")
+	for _, nodeID := range sortedNodeIDs(g.metrics.probesSent) {
+		m.sample("gossip_probes_sent_total", labels("peer", nodeID), float64(g.metrics.probesSent[nodeID]))
+	}
+	m.header("gossip_probes_failed_total", "counter", "Direct probes to each peer that were not acked in time.")
+	for _, nodeID := range sortedNodeIDs(g.metrics.probesFailed) {
+		m.sample("gossip_probes_failed_total", labels("peer", nodeID), float64(g.metrics.probesFailed[nodeID]))
+	}
+
+	m.header("gossip_probe_round_trip_seconds", "histogram", "Round trip time of acked direct probes to each peer.")
+	nodeIDs := []NodeID{}
+	for nodeID := range g.metrics.probeRoundTrips {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		h := g.metrics.probeRoundTrips[nodeID]
+		cumulativeCount := uint64(0)
+		for i, bucket := range probeRoundTripBuckets {
+			cumulativeCount += h.bucketCounts[i]
+			m.sample("gossip_probe_round_trip_seconds_bucket", labels("peer", nodeID, "le", formatFloat(bucket)), float64(cumulativeCount))
+		}
+		m.sample("gossip_probe_round_trip_seconds_bucket", labels("peer", nodeID, "le", "+Inf"), float64(h.count))
+		m.sample("gossip_probe_round_trip_seconds_sum", labels("peer", nodeID), h.sum)
+		m.sample("gossip_probe_round_trip_seconds_count", labels("peer", nodeID), float64(h.count))
+	}
+
+	m.header("gossip_member_state_changes_total", "counter", "Times each peer changed to each state, for alerting on flapping members.")
+	nodeIDs = nodeIDs[:0]
+	for nodeID := range g.metrics.stateChanges {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		for _, state := range []NodeState{NodeAlive, NodeSuspect, NodeDead, NodeLeft} {
+			if count, ok := g.metrics.stateChanges[nodeID][state]; ok {
+				m.sample("gossip_member_state_changes_total", labels("peer", nodeID, "state", state.String()), float64(count))
+			}
+		}
+	}
+	return m.err
+}
+
+func metricsEndpoint(g *Gossip) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := g.WriteMetrics(w); err != nil {
+			warnLog.Println(fmt.Errorf("error writing metrics: %w", err))
+		}
+	}
+}
+
+// Keeps the first error, after which nothing more is written
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *metricsWriter) header(name, metricType, help string) {
+	m.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (m *metricsWriter) sample(name, labels string, value float64) {
+	m.printf("%s%s %s\n", name, labels, formatFloat(value))
+}
+
+func (m *metricsWriter) printf(format string, args ...interface{}) {
+	if m.err != nil {
+		return
+	}
+	_, m.err = fmt.Fprintf(m.w, format, args...)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Takes alternating label names and values
+func labels(namesAndValues ...string) string {
+	pairs := []string{}
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, namesAndValues[i], labelValueEscaper.Replace(namesAndValues[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedNodeIDs(counts map[NodeID]uint64) []NodeID {
+	nodeIDs := make([]NodeID, 0, len(counts))
+	for nodeID := range counts {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	return nodeIDs
+}
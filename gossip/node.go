@@ -5,11 +5,55 @@ type NodeID = string
 type Node struct {
 	ID           NodeID
 	LocalAddress string
+	// The address other nodes should use to reach this node
+	RemoteAddress string
+	// Arbitrary metadata about this node, such as its role or zone. Use
+	// Gossip.SetTags to change them once gossiping.
+	Tags map[string]string
+	// The failure domain this node is in, such as a rack or availability
+	// zone, and its weight in quorum decisions
+	Zone  string
+	Votes int
 
+	// Nodes known about at startup. Gossip keeps track of nodes joining
+	// and leaving after that.
 	OtherNodes map[NodeID]NodeDescription
 }
 
 type NodeDescription struct {
-	ID            NodeID `yaml:"id"`
-	RemoteAddress string `yaml:"remote_address"`
+	ID            NodeID            `yaml:"id"`
+	RemoteAddress string            `yaml:"remote_address"`
+	Tags          map[string]string `yaml:"tags,omitempty"`
+	Zone          string            `yaml:"zone,omitempty"`
+	// Nodes have one vote unless set otherwise
+	Votes int `yaml:"votes,omitempty"`
+}
+
+// VoteCount is the node's weight in quorum decisions
+func (n NodeDescription) VoteCount() int {
+	if n.Votes <= 0 {
+		return 1
+	}
+	return n.Votes
+}
+
+// HasTags is true if the node has every one of the given tags
+func (n NodeDescription) HasTags(tags map[string]string) bool {
+	for key, value := range tags {
+		if nodeValue, ok := n.Tags[key]; !ok || nodeValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+	return copied
 }
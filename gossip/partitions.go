@@ -0,0 +1,248 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Every node reports which nodes it doesn't see as alive. Reports are
+// gossiped like membership updates whenever they change, and push-pull
+// exchanges every report known, so that nodes learn about links they aren't
+// part of. Nodes are grouped into components, where each link between nodes
+// in a component is seen as alive by both ends.
+//
+// Nodes we don't see as alive are placed by the last report we have from
+// them, as no reports cross a clean split. Nodes cut off together still see
+// each other as alive in their last reports, so they form a component of
+// their own, which only has links between nodes whose reports are that
+// stale. A node that is alone in its component, and whose report hasn't
+// changed since we suspected it, is unreachable rather than in a component,
+// as a crashed node can't be told apart from a node cut off from everyone.
+// Several nodes that crash at once, such as a rack losing power, are seen
+// as a split for the same reason. Reports are compared to when nodes were
+// suspected, which assumes that clocks are roughly in sync.
+
+type reachabilityReport struct {
+	NodeID    NodeID    `yaml:"node_id"`
+	ChangedAt time.Time `yaml:"changed_at"`
+	// Nodes the reporter doesn't see as alive
+	Unreachable []NodeID `yaml:"unreachable,omitempty"`
+}
+
+type PartitionView struct {
+	// Largest first. A healthy cluster has one component.
+	Components [][]NodeID `json:"components"`
+	// Nodes not seen as alive, not heard about since they were suspected, and
+	// not cut off along with other nodes
+	Unreachable []NodeID `json:"unreachable,omitempty"`
+	// Links that only one end sees as alive
+	Asymmetric []ReachabilityPair `json:"asymmetric,omitempty"`
+}
+
+// From sees To as alive, but To does not see From as alive
+type ReachabilityPair struct {
+	From NodeID `json:"from"`
+	To   NodeID `json:"to"`
+}
+
+func (g *Gossip) Partitions() PartitionView {
+	g.Lock()
+	defer g.Unlock()
+	return g.partitionView()
+}
+
+// Must be called with the lock held. Replaces any queued report from the
+// same node.
+func (g *Gossip) queueReachabilityReport(report reachabilityReport) {
+	g.reportBroadcasts.push(report.NodeID, report, 0)
+}
+
+// Must be called with the lock held. Works the same as piggybackedUpdates.
+func (g *Gossip) piggybackedReachabilityReports() []reachabilityReport {
+	reports := []reachabilityReport{}
+	for _, item := range g.reportBroadcasts.take(g.MaxPiggybackedUpdates, 0, g.retransmitLimit()) {
+		reports = append(reports, item.(reachabilityReport))
+	}
+	return reports
+}
+
+// Must be called with the lock held
+func (g *Gossip) reachabilityReports() []reachabilityReport {
+	reports := []reachabilityReport{}
+	for _, nodeID := range append([]NodeID{g.Node.ID}, g.knownNodeIDs()...) {
+		if report, ok := g.reachability[nodeID]; ok {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// Must be called with the lock held. Reports from this node, or no newer than
+// the report already known, are ignored. New reports are gossiped on.
+func (g *Gossip) applyReachabilityReports(reports []reachabilityReport) {
+	for _, report := range reports {
+		if report.NodeID == g.Node.ID {
+			continue
+		}
+		if _, ok := g.OtherNodeStatuses[report.NodeID]; !ok {
+			continue
+		}
+		if known, ok := g.reachability[report.NodeID]; ok && !report.ChangedAt.After(known.ChangedAt) {
+			continue
+		}
+		g.reachability[report.NodeID] = report
+		g.queueReachabilityReport(report)
+	}
+}
+
+// Called every round to update this node's report, and to warn when the
+// cluster splits or heals
+func (g *Gossip) updatePartitions() {
+	g.Lock()
+	defer g.Unlock()
+
+	now := g.Clock.Now()
+	unreachable := []NodeID{}
+	for _, nodeID := range g.knownNodeIDs() {
+		state := g.OtherNodeStatuses[nodeID].State
+		if state != NodeAlive && state != NodeLeft {
+			unreachable = append(unreachable, nodeID)
+		}
+	}
+	if report, ok := g.reachability[g.Node.ID]; !ok || !equalNodeIDs(report.Unreachable, unreachable) {
+		report := reachabilityReport{NodeID: g.Node.ID, ChangedAt: now, Unreachable: unreachable}
+		g.reachability[g.Node.ID] = report
+		g.queueReachabilityReport(report)
+	}
+
+	view := g.partitionView()
+	split := len(view.Components) > 1
+	if split == g.quorum.split {
+		return
+	}
+	g.quorum.split = split
+	event := QuorumEvent{Type: ClusterHealed, Summary: *g.summary(), Partitions: &view, At: now}
+	if split {
+		warnLog.Printf("cluster has split into %v\n", view.Components)
+		event.Type = ClusterSplit
+	} else {
+		infoLog.Println("cluster has healed")
+	}
+	g.publishQuorumEvent(event)
+}
+
+// Must be called with the lock held
+func (g *Gossip) partitionView() PartitionView {
+	view := PartitionView{}
+	nodeIDs := []NodeID{g.Node.ID}
+	// Nodes only known from reports they made before we suspected them
+	stale := []bool{false}
+	for _, nodeID := range g.knownNodeIDs() {
+		nodeStatus := g.OtherNodeStatuses[nodeID]
+		if nodeStatus.State == NodeLeft {
+			continue
+		}
+		isStale := false
+		if nodeStatus.State != NodeAlive {
+			report, ok := g.reachability[nodeID]
+			if !ok {
+				view.Unreachable = append(view.Unreachable, nodeID)
+				continue
+			}
+			isStale = nodeStatus.SuspectedAt == nil || !report.ChangedAt.After(*nodeStatus.SuspectedAt)
+		}
+		nodeIDs = append(nodeIDs, nodeID)
+		stale = append(stale, isStale)
+	}
+
+	// By index. Nodes that see every other node as alive, as most do, have
+	// no set.
+	indexes := make(map[NodeID]int, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		indexes[nodeID] = i
+	}
+	unreachable := make([]map[int]bool, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		for _, unreachableNodeID := range g.reachability[nodeID].Unreachable {
+			if j, ok := indexes[unreachableNodeID]; ok {
+				if unreachable[i] == nil {
+					unreachable[i] = map[int]bool{}
+				}
+				unreachable[i][j] = true
+			}
+		}
+	}
+
+	// Links that only one end sees as alive are found from the reports, as
+	// there are few of them
+	for i, nodeID := range nodeIDs {
+		for j := range unreachable[i] {
+			// Stale reports can't show a link has become asymmetric, and the
+			// stale end's report predates it being cut off from us
+			if !unreachable[j][i] && !stale[i] && !stale[j] {
+				view.Asymmetric = append(view.Asymmetric, ReachabilityPair{From: nodeIDs[j], To: nodeID})
+			}
+		}
+	}
+
+	// Components are joined by links that both ends see as alive, which is
+	// most links, so each component is found by walking the nodes not yet in
+	// one rather than comparing every pair of nodes. Links between stale and
+	// fresh nodes are ignored.
+	remaining := make([]int, len(nodeIDs))
+	for i := range remaining {
+		remaining[i] = i
+	}
+	for len(remaining) > 0 {
+		start := remaining[0]
+		queue := []int{start}
+		component := []NodeID{nodeIDs[start]}
+		remaining = remaining[1:]
+		for len(queue) > 0 {
+			i := queue[0]
+			queue = queue[1:]
+			notLinked := remaining[:0]
+			for _, j := range remaining {
+				if stale[i] == stale[j] && !unreachable[i][j] && !unreachable[j][i] {
+					queue = append(queue, j)
+					component = append(component, nodeIDs[j])
+				} else {
+					notLinked = append(notLinked, j)
+				}
+			}
+			remaining = notLinked
+		}
+		if len(component) == 1 && stale[start] {
+			view.Unreachable = append(view.Unreachable, component[0])
+			continue
+		}
+		sort.Strings(component)
+		view.Components = append(view.Components, component)
+	}
+	sort.Strings(view.Unreachable)
+	sort.Slice(view.Asymmetric, func(i, j int) bool {
+		if view.Asymmetric[i].From != view.Asymmetric[j].From {
+			return view.Asymmetric[i].From < view.Asymmetric[j].From
+		}
+		return view.Asymmetric[i].To < view.Asymmetric[j].To
+	})
+	sort.Slice(view.Components, func(i, j int) bool {
+		if len(view.Components[i]) != len(view.Components[j]) {
+			return len(view.Components[i]) > len(view.Components[j])
+		}
+		return view.Components[i][0] < view.Components[j][0]
+	})
+	return view
+}
+
+func equalNodeIDs(a, b []NodeID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
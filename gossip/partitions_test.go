@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPartitionViewFromReports(t *testing.T) {
+	suspectedAt := time.Unix(100, 0)
+	type report struct {
+		unreachable []NodeID
+		// Made before this node suspected the reporter
+		stale bool
+	}
+	tests := []struct {
+		name     string
+		states   map[NodeID]NodeState
+		reports  map[NodeID]report
+		expected PartitionView
+	}{
+		{
+			name:    "healthy",
+			reports: map[NodeID]report{"node-1": {}, "node-2": {}, "node-3": {}, "node-4": {}, "node-5": {}},
+			expected: PartitionView{
+				Components: [][]NodeID{{"node-1", "node-2", "node-3", "node-4", "node-5"}},
+			},
+		},
+		{
+			name:    "asymmetric link",
+			reports: map[NodeID]report{"node-1": {}, "node-2": {}, "node-3": {unreachable: []NodeID{"node-4"}}, "node-4": {}, "node-5": {}},
+			expected: PartitionView{
+				Components: [][]NodeID{{"node-1", "node-2", "node-3", "node-4", "node-5"}},
+				Asymmetric: []ReachabilityPair{{From: "node-4", To: "node-3"}},
+			},
+		},
+		{
+			name:   "clean split",
+			states: map[NodeID]NodeState{"node-4": NodeSuspect, "node-5": NodeDead},
+			reports: map[NodeID]report{
+				"node-1": {unreachable: []NodeID{"node-4", "node-5"}},
+				"node-2": {unreachable: []NodeID{"node-4", "node-5"}},
+				"node-3": {unreachable: []NodeID{"node-4", "node-5"}},
+				"node-4": {stale: true},
+				"node-5": {stale: true},
+			},
+			expected: PartitionView{
+				Components: [][]NodeID{{"node-1", "node-2", "node-3"}, {"node-4", "node-5"}},
+			},
+		},
+		{
+			name:   "crashed node",
+			states: map[NodeID]NodeState{"node-5": NodeDead},
+			reports: map[NodeID]report{
+				"node-1": {unreachable: []NodeID{"node-5"}},
+				"node-2": {unreachable: []NodeID{"node-5"}},
+				"node-3": {unreachable: []NodeID{"node-5"}},
+				"node-4": {unreachable: []NodeID{"node-5"}},
+				"node-5": {stale: true},
+			},
+			expected: PartitionView{
+				Components:  [][]NodeID{{"node-1", "node-2", "node-3", "node-4"}},
+				Unreachable: []NodeID{"node-5"},
+			},
+		},
+		{
+			name:   "suspected node that reported since",
+			states: map[NodeID]NodeState{"node-5": NodeSuspect},
+			reports: map[NodeID]report{
+				"node-1": {unreachable: []NodeID{"node-5"}},
+				"node-2": {},
+				"node-3": {},
+				"node-4": {},
+				"node-5": {},
+			},
+			expected: PartitionView{
+				Components: [][]NodeID{{"node-1", "node-2", "node-3", "node-4", "node-5"}},
+				Asymmetric: []ReachabilityPair{{From: "node-5", To: "node-1"}},
+			},
+		},
+		{
+			name:   "suspected node without a report",
+			states: map[NodeID]NodeState{"node-5": NodeSuspect},
+			reports: map[NodeID]report{
+				"node-1": {unreachable: []NodeID{"node-5"}},
+				"node-2": {},
+				"node-3": {},
+				"node-4": {},
+			},
+			expected: PartitionView{
+				Components:  [][]NodeID{{"node-1", "node-2", "node-3", "node-4"}},
+				Unreachable: []NodeID{"node-5"},
+			},
+		},
+		{
+			name:    "left node",
+			states:  map[NodeID]NodeState{"node-5": NodeLeft},
+			reports: map[NodeID]report{"node-1": {}, "node-2": {}, "node-3": {}, "node-4": {}, "node-5": {}},
+			expected: PartitionView{
+				Components: [][]NodeID{{"node-1", "node-2", "node-3", "node-4"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGossip(&Node{ID: "node-1"}, GossipSettings{})
+			g.Lock()
+			defer g.Unlock()
+			for _, nodeID := range []NodeID{"node-2", "node-3", "node-4", "node-5"} {
+				nodeStatus := NodeGossip{Node: NodeDescription{ID: nodeID}, State: NodeAlive}
+				if state, ok := test.states[nodeID]; ok {
+					nodeStatus.State = state
+					nodeStatus.SuspectedAt = &suspectedAt
+				}
+				g.setNodeStatus(nodeID, nodeStatus)
+			}
+			for nodeID, report := range test.reports {
+				changedAt := suspectedAt.Add(time.Second)
+				if report.stale {
+					changedAt = suspectedAt.Add(-time.Second)
+				}
+				g.reachability[nodeID] = reachabilityReport{NodeID: nodeID, ChangedAt: changedAt, Unreachable: report.unreachable}
+			}
+
+			if view := g.partitionView(); !reflect.DeepEqual(view, test.expected) {
+				t.Fatalf("expected %+v, got %+v", test.expected, view)
+			}
+		})
+	}
+}
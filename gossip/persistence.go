@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A node can save its incarnation and the members it knows about to a state
+// file, periodically and when it stops. When it restarts it carries on from
+// one incarnation higher, so that its alive gossip supersedes rumours that it
+// is dead or has left, rather than being ignored until it hears them and
+// refutes them. Saved members are suspected until heard from, like nodes in
+// the config file, and are used as extra seeds to rejoin through.
+//
+// Lease grants and the highest token seen for each lease are saved too, as
+// soon as a lease is granted, so that a member that restarts doesn't grant a
+// lease it has already granted to another node, or a token it has seen.
+//
+// The keyring is saved as well, so that keys rotated through the admin API
+// are still used after restarting. Saved keys are only used while the keys
+// in the config file are the ones they replaced, so that keys rotated by
+// changing the config file take effect.
+
+type PersistedState struct {
+	NodeID      NodeID            `yaml:"node_id"`
+	Incarnation uint64            `yaml:"incarnation"`
+	SavedAt     time.Time         `yaml:"saved_at"`
+	Members     []PersistedMember `yaml:"members"`
+	Leases      []PersistedLease  `yaml:"leases,omitempty"`
+	// Base64 keys, primary first, and the IDs of the config file's keys
+	Keys         []string `yaml:"keys,omitempty"`
+	ConfigKeyIDs []string `yaml:"config_key_ids,omitempty"`
+}
+
+// Members that left aren't saved
+type PersistedMember struct {
+	NodeDescription `yaml:",inline"`
+	Incarnation     uint64     `yaml:"incarnation"`
+	Dead            bool       `yaml:"dead,omitempty"`
+	LastSeenAt      *time.Time `yaml:"last_seen_at,omitempty"`
+}
+
+type PersistedLease struct {
+	Name  string `yaml:"name"`
+	Token uint64 `yaml:"token"`
+	// The last grant of the lease, which may have expired
+	Grant *PersistedLeaseGrant `yaml:"grant,omitempty"`
+}
+
+type PersistedLeaseGrant struct {
+	Holder      NodeID    `yaml:"holder"`
+	Incarnation uint64    `yaml:"incarnation"`
+	Token       uint64    `yaml:"token"`
+	ExpiresAt   time.Time `yaml:"expires_at"`
+}
+
+// LoadState reads a state file. Returns nil if it doesn't exist yet.
+func LoadState(path string) (*PersistedState, error) {
+	stateBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %w", err)
+	}
+	var state PersistedState
+	if err = yaml.Unmarshal(stateBytes, &state); err != nil {
+		return nil, fmt.Errorf("error deserialising state file: %w", err)
+	}
+	return &state, nil
+}
+
+// RejoinAddresses lists the addresses of saved members that weren't dead
+func (s *PersistedState) RejoinAddresses() []string {
+	addresses := []string{}
+	for _, member := range s.Members {
+		if !member.Dead && member.RemoteAddress != "" {
+			addresses = append(addresses, member.RemoteAddress)
+		}
+	}
+	return addresses
+}
+
+// RestoreState carries on from a saved state, and must be called before Run.
+// Members already heard from are kept as they are.
+func (g *Gossip) RestoreState(state *PersistedState) error {
+	g.Lock()
+	defer g.Unlock()
+
+	if state.NodeID != g.Node.ID {
+		return fmt.Errorf("state file is for node '%s', not '%s'", state.NodeID, g.Node.ID)
+	}
+	if state.Incarnation >= g.Incarnation {
+		g.Incarnation = state.Incarnation + 1
+	}
+	now := g.Clock.Now()
+	for _, member := range state.Members {
+		if member.ID == "" || member.ID == g.Node.ID || member.RemoteAddress == "" {
+			continue
+		}
+		if nodeStatus, ok := g.OtherNodeStatuses[member.ID]; ok && nodeStatus.LastSeenAt != nil {
+			continue
+		}
+		node := member.NodeDescription
+		node.Tags = copyTags(node.Tags)
+		nodeStatus := NodeGossip{
+			Node:        node,
+			State:       NodeSuspect,
+			Incarnation: member.Incarnation,
+			SuspectedAt: &now,
+		}
+		if member.Dead {
+			nodeStatus.State = NodeDead
+			nodeStatus.SuspectedAt = nil
+		}
+		g.OtherNodeStatuses[member.ID] = nodeStatus
+	}
+	for _, lease := range state.Leases {
+		g.witnessLeaseToken(lease.Name, lease.Token)
+		if _, ok := g.leases.granted[lease.Name]; ok || lease.Grant == nil {
+			continue
+		}
+		if g.leases.granted == nil {
+			g.leases.granted = map[string]leaseGrantRecord{}
+		}
+		g.leases.granted[lease.Name] = leaseGrantRecord{
+			holder:      lease.Grant.Holder,
+			incarnation: lease.Grant.Incarnation,
+			token:       lease.Grant.Token,
+			expiresAt:   lease.Grant.ExpiresAt,
+		}
+	}
+	if err := g.restoreKeys(state); err != nil {
+		return err
+	}
+	infoLog.Printf("restored %d members saved at %s, rejoining with incarnation %d\n", len(state.Members), state.SavedAt.Format(time.RFC3339), g.Incarnation)
+	return nil
+}
+
+// Must be called with the lock held
+func (g *Gossip) restoreKeys(state *PersistedState) error {
+	if g.Keyring == nil || len(state.Keys) == 0 {
+		return nil
+	}
+	if strings.Join(state.ConfigKeyIDs, ",") != strings.Join(g.configKeyIDs, ",") {
+		infoLog.Println("encryption keys in the config file have changed since the state file was saved, so using them instead of the saved keys")
+		return nil
+	}
+	keys := [][]byte{}
+	for _, encodedKey := range state.Keys {
+		key, err := ParseKey(encodedKey)
+		if err != nil {
+			return fmt.Errorf("error parsing key from state file: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return g.Keyring.replace(keys)
+}
+
+// SaveState writes this node's incarnation and members to StateFile, unless
+// it is empty. The file is replaced atomically, so a crash while saving
+// leaves the previous state.
+func (g *Gossip) SaveState() error {
+	if g.StateFile == "" {
+		return nil
+	}
+	// Otherwise an older state could replace a newer one
+	g.stateFileLock.Lock()
+	defer g.stateFileLock.Unlock()
+	stateBytes, err := yaml.Marshal(g.persistedState())
+	if err != nil {
+		return fmt.Errorf("error serialising state: %w", err)
+	}
+	temporaryPath := g.StateFile + ".tmp"
+	if err = ioutil.WriteFile(temporaryPath, stateBytes, 0600); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	if err = os.Rename(temporaryPath, g.StateFile); err != nil {
+		return fmt.Errorf("error replacing state file: %w", err)
+	}
+	return nil
+}
+
+func (g *Gossip) persistedState() *PersistedState {
+	g.Lock()
+	defer g.Unlock()
+
+	state := &PersistedState{
+		NodeID:      g.Node.ID,
+		Incarnation: g.Incarnation,
+		SavedAt:     g.Clock.Now(),
+		Members:     []PersistedMember{},
+	}
+	for _, nodeID := range g.knownNodeIDs() {
+		nodeStatus := g.OtherNodeStatuses[nodeID]
+		if nodeStatus.State == NodeLeft {
+			continue
+		}
+		node := nodeStatus.Node
+		node.Tags = copyTags(node.Tags)
+		state.Members = append(state.Members, PersistedMember{
+			NodeDescription: node,
+			Incarnation:     nodeStatus.Incarnation,
+			Dead:            nodeStatus.State == NodeDead,
+			LastSeenAt:      nodeStatus.LastSeenAt,
+		})
+	}
+	names := []string{}
+	for name := range g.leases.tokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lease := PersistedLease{Name: name, Token: g.leases.tokens[name]}
+		if record, ok := g.leases.granted[name]; ok {
+			lease.Grant = &PersistedLeaseGrant{
+				Holder:      record.holder,
+				Incarnation: record.incarnation,
+				Token:       record.token,
+				ExpiresAt:   record.expiresAt,
+			}
+		}
+		state.Leases = append(state.Leases, lease)
+	}
+	if g.Keyring != nil {
+		for _, key := range g.Keyring.installedKeys() {
+			state.Keys = append(state.Keys, base64.StdEncoding.EncodeToString(key))
+		}
+		state.ConfigKeyIDs = g.configKeyIDs
+	}
+	return state
+}
+
+func saveStatePeriodically(ctx context.Context, g *Gossip) {
+	ticker := time.NewTicker(g.StateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := g.SaveState(); err != nil {
+			warnLog.Println(err)
+		}
+	}
+}
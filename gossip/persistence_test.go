@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func setMember(g *Gossip, nodeID NodeID, state NodeState, lastSeenAt *time.Time) {
+	g.Lock()
+	defer g.Unlock()
+	g.setNodeStatus(nodeID, NodeGossip{
+		Node:        NodeDescription{ID: nodeID, RemoteAddress: nodeID + ":9000"},
+		State:       state,
+		Incarnation: 2,
+		LastSeenAt:  lastSeenAt,
+	})
+}
+
+func TestStateIsSavedAndRestored(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.yml")
+	if state, err := LoadState(stateFile); state != nil || err != nil {
+		t.Fatalf("expected no state before it is saved, got %+v: %v", state, err)
+	}
+
+	g := NewGossip(&Node{ID: "node-1"}, GossipSettings{StateFile: stateFile})
+	g.Incarnation = 5
+	seenAt := time.Now()
+	setMember(g, "node-2", NodeAlive, &seenAt)
+	setMember(g, "node-3", NodeDead, &seenAt)
+	setMember(g, "node-4", NodeLeft, &seenAt)
+	if err := g.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := LoadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejoinAddresses := state.RejoinAddresses(); !reflect.DeepEqual(rejoinAddresses, []string{"node-2:9000"}) {
+		t.Fatalf("expected to rejoin through the alive member only, got %v", rejoinAddresses)
+	}
+
+	restarted := NewGossip(&Node{ID: "node-1"}, GossipSettings{})
+	if err = restarted.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Incarnation != 6 {
+		t.Fatalf("expected to carry on from incarnation 6, got %d", restarted.Incarnation)
+	}
+	expectedStates := map[NodeID]NodeState{"node-2": NodeSuspect, "node-3": NodeDead}
+	for nodeID, nodeStatus := range restarted.OtherNodeStatuses {
+		if nodeStatus.State != expectedStates[nodeID] || nodeStatus.Incarnation != 2 || nodeStatus.Node.RemoteAddress != nodeID+":9000" {
+			t.Fatalf("expected node '%s' to be restored as %s, got %+v", nodeID, expectedStates[nodeID], nodeStatus)
+		}
+	}
+	if len(restarted.OtherNodeStatuses) != len(expectedStates) {
+		t.Fatalf("expected members that left not to be restored, got %d members", len(restarted.OtherNodeStatuses))
+	}
+}
+
+func TestRestoringStateKeepsWhatIsAlreadyKnown(t *testing.T) {
+	state := &PersistedState{
+		NodeID:      "node-1",
+		Incarnation: 5,
+		Members: []PersistedMember{
+			{NodeDescription: NodeDescription{ID: "node-2", RemoteAddress: "old:9000"}, Incarnation: 1},
+		},
+	}
+	g := NewGossip(&Node{ID: "node-1"}, GossipSettings{})
+	g.Incarnation = 8
+	seenAt := time.Now()
+	setMember(g, "node-2", NodeAlive, &seenAt)
+	if err := g.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if g.Incarnation != 8 {
+		t.Fatalf("expected a higher incarnation to be kept, got %d", g.Incarnation)
+	}
+	if nodeStatus := g.OtherNodeStatuses["node-2"]; nodeStatus.State != NodeAlive || nodeStatus.Node.RemoteAddress != "node-2:9000" {
+		t.Fatalf("expected a member already heard from to be kept, got %+v", nodeStatus)
+	}
+}
+
+func TestStateSavedByAnotherNodeIsRejected(t *testing.T) {
+	g := NewGossip(&Node{ID: "node-1"}, GossipSettings{})
+	if err := g.RestoreState(&PersistedState{NodeID: "node-2", Incarnation: 5}); err == nil {
+		t.Fatal("expected a state file saved by another node to be rejected")
+	}
+	if g.Incarnation != 0 {
+		t.Fatalf("expected the incarnation to be left alone, got %d", g.Incarnation)
+	}
+}
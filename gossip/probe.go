@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Failure detection follows SWIM. Each round one node is probed directly. If
+// it doesn't ack within ProbeTimeout then IndirectProbeCount other nodes are
+// asked to probe it on our behalf, so a single slow link can't make a healthy
+// node look dead. Nodes that fail both are suspected, and suspected nodes are
+// confirmed dead if nothing is heard from them within the suspicion timeout.
+// Timeouts adapt as in Lifeguard, see lifeguard.go.
+
+type NodeState int
+
+const (
+	NodeAlive NodeState = iota
+	NodeSuspect
+	NodeDead
+	NodeLeft
+)
+
+func (s NodeState) String() string {
+	switch s {
+	case NodeAlive:
+		return "alive"
+	case NodeSuspect:
+		return "suspect"
+	case NodeDead:
+		return "dead"
+	case NodeLeft:
+		return "left"
+	default:
+		return fmt.Sprintf("NodeState(%d)", int(s))
+	}
+}
+
+// Probe targets are chosen round-robin through a shuffled list of nodes. This
+// bounds how long a failed node can go unprobed, unlike choosing uniformly.
+func (g *Gossip) nextProbeTarget() (NodeDescription, bool) {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.probeIndex >= len(g.probeOrder) {
+		g.probeOrder = g.probeOrder[:0]
+		for _, nodeID := range g.knownNodeIDs() {
+			if g.OtherNodeStatuses[nodeID].State != NodeLeft {
+				g.probeOrder = append(g.probeOrder, nodeID)
+			}
+		}
+		g.random.Shuffle(len(g.probeOrder), func(i, j int) {
+			g.probeOrder[i], g.probeOrder[j] = g.probeOrder[j], g.probeOrder[i]
+		})
+		g.probeIndex = 0
+	}
+	if len(g.probeOrder) == 0 {
+		return NodeDescription{}, false
+	}
+
+	nodeStatus, ok := g.OtherNodeStatuses[g.probeOrder[g.probeIndex]]
+	g.probeIndex += 1
+	if !ok || nodeStatus.State == NodeLeft {
+		return NodeDescription{}, false
+	}
+	return nodeStatus.Node, true
+}
+
+// The whole probe must finish by the deadline, so that a peer which never
+// replies can't delay the rest of the round or the next one
+func (g *Gossip) probe(target NodeDescription, deadline time.Time) {
+	g.Lock()
+	probeTimeout := g.scaleByLocalHealth(g.ProbeTimeout)
+	g.Unlock()
+
+	if g.probeDirectly(target.ID, target.RemoteAddress, minDuration(probeTimeout, deadline.Sub(g.Clock.Now()))) {
+		g.Lock()
+		g.adjustLocalHealth(-1)
+		g.Unlock()
+		return
+	}
+	// The intermediaries wait up to ProbeTimeout for the target themselves
+	acked, asked, replied := g.probeIndirectly(target, minDuration(2*probeTimeout, deadline.Sub(g.Clock.Now())))
+	if acked {
+		return
+	}
+	g.Lock()
+	// Intermediaries reply even if the target doesn't, so missing replies
+	// suggest this node is too slow to receive them
+	if asked > 0 {
+		g.adjustLocalHealth(asked - replied)
+	} else {
+		g.adjustLocalHealth(1)
+	}
+	g.Unlock()
+	g.markSuspect(target.ID)
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Probes a node at its known address, or at the address given if it isn't
+// known yet, as intermediaries may not have heard of nodes that just joined
+func (g *Gossip) probeDirectly(nodeID NodeID, address string, timeout time.Duration) bool {
+	g.Lock()
+	if target, ok := g.OtherNodeStatuses[nodeID]; ok {
+		address = target.Node.RemoteAddress
+	}
+	g.Unlock()
+	if address == "" {
+		return false
+	}
+
+	g.metrics.probeSent(nodeID)
+	sentAt := g.Clock.Now()
+	reply, err := g.sendGossipMessage(newGossipMessage(g, pingMessage), address, timeout)
+	if err != nil {
+		debugLog.Println(fmt.Errorf("error probing node '%s': %w", nodeID, err))
+		g.metrics.probeFailed(nodeID)
+		return false
+	}
+	g.applyReply(reply)
+	if !reply.Ack || reply.NodeID != nodeID {
+		g.metrics.probeFailed(nodeID)
+		return false
+	}
+	roundTrip := g.Clock.Now().Sub(sentAt)
+	g.metrics.probeRoundTrip(nodeID, roundTrip)
+	g.Lock()
+	g.updateCoordinate(nodeID, reply.Coordinate, roundTrip)
+	g.Unlock()
+	g.markAlive(nodeID, reply.Incarnation)
+	return true
+}
+
+// Returns whether any intermediary acked the node, how many intermediaries
+// were asked, and how many replied at all
+func (g *Gossip) probeIndirectly(target NodeDescription, timeout time.Duration) (bool, int, int) {
+	nodeID := target.ID
+	intermediaries := g.randomNodes(g.IndirectProbeCount, nodeID)
+	if len(intermediaries) == 0 || timeout <= 0 {
+		return false, 0, 0
+	}
+
+	replies := make([]bool, len(intermediaries))
+	acks := make([]bool, len(intermediaries))
+	g.forEachConcurrently(len(intermediaries), func(i int) {
+		intermediary := intermediaries[i]
+		message := newGossipMessage(g, pingReqMessage)
+		message.Target = nodeID
+		message.TargetAddress = target.RemoteAddress
+		reply, err := g.sendGossipMessage(message, intermediary.RemoteAddress, timeout)
+		if err != nil {
+			debugLog.Println(fmt.Errorf("error asking node '%s' to probe node '%s': %w", intermediary.ID, nodeID, err))
+			return
+		}
+		g.applyReply(reply)
+		replies[i] = true
+		acks[i] = reply.Ack
+	})
+
+	replied := 0
+	for _, ok := range replies {
+		if ok {
+			replied += 1
+		}
+	}
+	for _, ack := range acks {
+		if ack {
+			g.markAlive(nodeID, 0)
+			return true, len(intermediaries), replied
+		}
+	}
+	return false, len(intermediaries), replied
+}
+
+// Picks up to count random nodes that are neither dead nor left, excluding one node
+func (g *Gossip) randomNodes(count int, excluding NodeID) []NodeDescription {
+	g.Lock()
+	defer g.Unlock()
+
+	candidates := []NodeDescription{}
+	for _, nodeID := range g.knownNodeIDs() {
+		nodeStatus := g.OtherNodeStatuses[nodeID]
+		if nodeID == excluding || nodeStatus.State == NodeDead || nodeStatus.State == NodeLeft {
+			continue
+		}
+		candidates = append(candidates, nodeStatus.Node)
+	}
+	g.random.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
+	return candidates
+}
+
+// Having heard from a node directly is proof it is alive, whatever its state.
+// Returns false if the node is unknown.
+func (g *Gossip) markAlive(nodeID NodeID, incarnation uint64) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	nodeStatus, ok := g.OtherNodeStatuses[nodeID]
+	if !ok {
+		return false
+	}
+	if nodeStatus.State != NodeAlive {
+		infoLog.Printf("node '%s' is alive\n", nodeID)
+	}
+	now := g.Clock.Now()
+	nodeStatus.State = NodeAlive
+	nodeStatus.LastSeenAt = &now
+	nodeStatus.SuspectedAt = nil
+	nodeStatus.suspectedBy = nil
+	if incarnation > nodeStatus.Incarnation {
+		nodeStatus.Incarnation = incarnation
+		g.queueBroadcast(membershipUpdate{
+			NodeID:        nodeID,
+			RemoteAddress: nodeStatus.Node.RemoteAddress,
+			State:         NodeAlive,
+			Incarnation:   incarnation,
+			Tags:          nodeStatus.Node.Tags,
+			Zone:          nodeStatus.Node.Zone,
+			Votes:         nodeStatus.Node.Votes,
+		})
+	}
+	g.setNodeStatus(nodeID, nodeStatus)
+	return true
+}
+
+func (g *Gossip) markSuspect(nodeID NodeID) {
+	g.Lock()
+	defer g.Unlock()
+
+	nodeStatus, ok := g.OtherNodeStatuses[nodeID]
+	if !ok {
+		return
+	}
+	switch nodeStatus.State {
+	case NodeAlive:
+		infoLog.Printf("node '%s' is suspected\n", nodeID)
+		now := g.Clock.Now()
+		nodeStatus.State = NodeSuspect
+		nodeStatus.SuspectedAt = &now
+		nodeStatus.suspectedBy = nil
+	case NodeSuspect:
+		// Failing to probe a node another node suspects confirms the suspicion
+		if nodeStatus.suspectedBy[g.Node.ID] {
+			return
+		}
+	default:
+		return
+	}
+	nodeStatus.addSuspicion(g.Node.ID)
+	g.setNodeStatus(nodeID, nodeStatus)
+	g.queueBroadcast(membershipUpdate{
+		NodeID:        nodeID,
+		RemoteAddress: nodeStatus.Node.RemoteAddress,
+		State:         NodeSuspect,
+		Incarnation:   nodeStatus.Incarnation,
+		From:          g.Node.ID,
+	})
+}
+
+func (g *Gossip) confirmSuspectedNodesDead() {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, nodeID := range g.knownNodeIDs() {
+		nodeStatus := g.OtherNodeStatuses[nodeID]
+		if nodeStatus.State != NodeSuspect || nodeStatus.SuspectedAt == nil {
+			continue
+		}
+		if g.Clock.Now().Sub(*nodeStatus.SuspectedAt) <= g.suspicionTimeout(nodeStatus) {
+			continue
+		}
+		infoLog.Printf("node '%s' is dead\n", nodeID)
+		nodeStatus.State = NodeDead
+		g.setNodeStatus(nodeID, nodeStatus)
+		g.queueBroadcast(membershipUpdate{
+			NodeID:        nodeID,
+			RemoteAddress: nodeStatus.Node.RemoteAddress,
+			State:         NodeDead,
+			Incarnation:   nodeStatus.Incarnation,
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Accepts connections and packets at an address, but never replies
+func listenBlackhole(t *testing.T, transport string) string {
+	switch transport {
+	case "udp":
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn.LocalAddr().String()
+	default:
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted := make(chan []net.Conn, 1)
+		go func() {
+			var conns []net.Conn
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					accepted <- conns
+					return
+				}
+				conns = append(conns, conn)
+			}
+		}()
+		t.Cleanup(func() {
+			listener.Close()
+			for _, conn := range <-accepted {
+				conn.Close()
+			}
+		})
+		return listener.Addr().String()
+	}
+}
+
+func newTestTransport(t *testing.T, transport string, serverTimeout time.Duration) (Transport, string) {
+	switch transport {
+	case "udp":
+		udpTransport, err := NewUDPTransport("127.0.0.1:0", serverTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return udpTransport, udpTransport.ListenAddress
+	default:
+		httpTransport, err := NewHTTPTransport("127.0.0.1:0", nil, serverTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httpTransport, httpTransport.ListenAddress
+	}
+}
+
+func TestBlackholedPeerDoesntDelayProbeRounds(t *testing.T) {
+	for _, transport := range []string{"udp", "http"} {
+		t.Run(transport, func(t *testing.T) {
+			testBlackholedPeerDoesntDelayProbeRounds(t, transport)
+		})
+	}
+}
+
+func testBlackholedPeerDoesntDelayProbeRounds(t *testing.T, transport string) {
+	settings := GossipSettings{
+		GossipRegularity:         200 * time.Millisecond,
+		ProbeTimeout:             50 * time.Millisecond,
+		IndirectProbeCount:       2,
+		NodeTimeoutAfter:         time.Minute,
+		MaxNodeTimeoutMultiplier: 1,
+		MaxPiggybackedUpdates:    10,
+		RetransmitMultiplier:     4,
+	}
+	// Time for the work a round does besides waiting on its probe
+	slack := 100 * time.Millisecond
+	blackhole := NodeDescription{ID: "blackholed", RemoteAddress: listenBlackhole(t, transport)}
+
+	var nodes []*Gossip
+	var seedAddresses []string
+	for _, nodeID := range []NodeID{"node-1", "node-2", "node-3"} {
+		nodeSettings := settings
+		var address string
+		nodeSettings.Transport, address = newTestTransport(t, transport, settings.GossipRegularity)
+		node := &Node{
+			ID:            nodeID,
+			RemoteAddress: address,
+			OtherNodes:    map[NodeID]NodeDescription{blackhole.ID: blackhole},
+		}
+		g := NewGossip(node, nodeSettings)
+		served := make(chan error, 1)
+		go func() {
+			served <- g.Transport.Serve(g.handleGossipMessage)
+		}()
+		t.Cleanup(func() {
+			g.Transport.Close()
+			<-served
+		})
+		nodes = append(nodes, g)
+		seedAddresses = append(seedAddresses, address)
+	}
+	seedAddresses = append(seedAddresses, blackhole.RemoteAddress)
+
+	for _, g := range nodes {
+		startedAt := time.Now()
+		if contacted, err := g.Join(seedAddresses); err != nil || contacted != 2 {
+			t.Fatalf("expected node '%s' to join 2 seeds, joined %d: %v", g.Node.ID, contacted, err)
+		}
+		if took := time.Since(startedAt); took > settings.GossipRegularity+slack {
+			t.Errorf("expected node '%s' to join within %s, took %s", g.Node.ID, settings.GossipRegularity, took)
+		}
+	}
+
+	var subscriptions []<-chan MembershipEvent
+	for _, g := range nodes {
+		events, unsubscribe := g.Subscribe()
+		defer unsubscribe()
+		subscriptions = append(subscriptions, events)
+	}
+	// Every node probes every other node, and the blackholed one, twice over
+	for round := 0; round < 2*len(nodes); round++ {
+		for _, g := range nodes {
+			startedAt := time.Now()
+			g.gossipRound()
+			if took := time.Since(startedAt); took > settings.GossipRegularity+slack {
+				t.Errorf("expected round %d on node '%s' to take at most %s, took %s", round, g.Node.ID, settings.GossipRegularity, took)
+			}
+		}
+	}
+
+	for i, events := range subscriptions {
+		for len(events) > 0 {
+			event := <-events
+			if event.Node.ID != blackhole.ID && (event.Type == MemberSuspected || event.Type == MemberDead) {
+				t.Errorf("expected node '%s' to never suspect healthy node '%s', got %s", nodes[i].Node.ID, event.Node.ID, event.Type)
+			}
+		}
+		nodes[i].Lock()
+		state := nodes[i].OtherNodeStatuses[blackhole.ID].State
+		nodes[i].Unlock()
+		if state != NodeSuspect {
+			t.Errorf("expected node '%s' to suspect the blackholed node, got %s", nodes[i].Node.ID, state)
+		}
+	}
+}
+
+// Intermediaries may not have heard of a node that just joined, so they
+// probe it at the address the sender of the ping-req gives
+func TestIndirectProbesReachNodesTheIntermediaryDoesntKnow(t *testing.T) {
+	network := NewMemoryNetwork(1)
+	var nodes []*Gossip
+	for _, nodeID := range []NodeID{"node-1", "node-2", "node-3"} {
+		transport := network.Transport(nodeID)
+		g := NewGossip(&Node{ID: nodeID, RemoteAddress: nodeID}, GossipSettings{Transport: transport, ProbeTimeout: time.Second})
+		transport.listen(g.handleGossipMessage)
+		nodes = append(nodes, g)
+	}
+	prober, intermediary := nodes[0], nodes[1]
+
+	tests := []struct {
+		name          string
+		targetAddress string
+		acked         bool
+	}{
+		{"target's address", "node-3", true},
+		{"no address", "", false},
+		{"another node's address", "node-1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := newGossipMessage(prober, pingReqMessage)
+			message.Target = "node-3"
+			message.TargetAddress = test.targetAddress
+			reply, err := prober.Transport.Send(intermediary.Node.RemoteAddress, message, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Ack != test.acked {
+				t.Fatalf("expected the ping-req to be acked to be %v", test.acked)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Queries ask members to respond to a named request, such as which of them
+// holds a shard. Unlike user events, a query is sent straight to each member
+// rather than spread epidemically, so that responses come back in one round
+// trip and the querying node knows which members didn't reply in time.
+// Members can be filtered by their tags, which each member checks again in
+// case its tags have changed.
+
+const (
+	defaultQueryTimeout = 5 * time.Second
+	// Members keep connections open for queries this long at most, and the
+	// admin API must answer them within its write timeout
+	maxQueryTimeout     = 30 * time.Second
+	maxQueryPayloadSize = 64 << 10
+)
+
+type Query struct {
+	Name    string
+	Payload []byte
+	From    NodeID
+	LTime   uint64
+}
+
+// QueryHandler responds to a query, or returns nil to not respond. The
+// context is cancelled once the querying node has stopped waiting.
+type QueryHandler func(ctx context.Context, query Query) ([]byte, error)
+
+type QueryParams struct {
+	// Only members with all of these tags are queried
+	Tags map[string]string
+	// How long to wait for responses, up to thirty seconds. Defaults to five
+	// seconds.
+	Timeout time.Duration
+}
+
+type QueryResponse struct {
+	From    NodeID `json:"from"`
+	Payload []byte `json:"payload,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type QueryResult struct {
+	// Sorted by the member that responded
+	Responses []QueryResponse `json:"responses"`
+	// Members that received the query but didn't respond to it
+	Acked []NodeID `json:"acked"`
+	// Members that didn't reply before the deadline
+	NoReply []NodeID `json:"no_reply"`
+}
+
+type queryRequest struct {
+	Name    string            `yaml:"name"`
+	Payload []byte            `yaml:"payload,omitempty"`
+	LTime   uint64            `yaml:"ltime"`
+	Tags    map[string]string `yaml:"tags,omitempty"`
+	Timeout time.Duration     `yaml:"timeout"`
+}
+
+type queryResponse struct {
+	Responded bool   `yaml:"responded"`
+	Payload   []byte `yaml:"payload,omitempty"`
+	Error     string `yaml:"error,omitempty"`
+}
+
+type queries struct {
+	clock    lamportClock
+	handlers map[string]QueryHandler
+}
+
+// HandleQueries responds to queries with a name, replacing any previous
+// handler. A nil handler stops responding.
+func (g *Gossip) HandleQueries(name string, handler QueryHandler) {
+	g.Lock()
+	defer g.Unlock()
+	if g.queries.handlers == nil {
+		g.queries.handlers = map[string]QueryHandler{}
+	}
+	if handler == nil {
+		delete(g.queries.handlers, name)
+		return
+	}
+	g.queries.handlers[name] = handler
+}
+
+// Query sends a query to every alive member with the tags, including this
+// node, and waits for their responses until the timeout
+func (g *Gossip) Query(name string, payload []byte, params QueryParams) (QueryResult, error) {
+	if name == "" {
+		return QueryResult{}, fmt.Errorf("queries must have a name")
+	}
+	if len(payload) > maxQueryPayloadSize {
+		return QueryResult{}, fmt.Errorf("query payloads must be at most %d bytes, got %d", maxQueryPayloadSize, len(payload))
+	}
+	if params.Timeout > maxQueryTimeout {
+		return QueryResult{}, fmt.Errorf("query timeouts must be at most %s, got %s", maxQueryTimeout, params.Timeout)
+	}
+	timeout := params.Timeout
+	if timeout <= 0 {
+		timeout = defaultQueryTimeout
+	}
+
+	g.Lock()
+	request := &queryRequest{
+		Name:    name,
+		Payload: payload,
+		LTime:   g.queries.clock.increment(),
+		Tags:    params.Tags,
+		Timeout: timeout,
+	}
+	members := []NodeDescription{}
+	for _, nodeID := range g.knownNodeIDs() {
+		nodeStatus := g.OtherNodeStatuses[nodeID]
+		if nodeStatus.State == NodeAlive && nodeStatus.Node.HasTags(params.Tags) {
+			members = append(members, nodeStatus.Node)
+		}
+	}
+	queriesSelf := NodeDescription{Tags: g.Node.Tags}.HasTags(params.Tags)
+	g.Unlock()
+
+	responses := make([]*queryResponse, len(members))
+	g.forEachConcurrently(len(members), func(i int) {
+		message := newGossipMessage(g, queryMessage)
+		message.Query = request
+		reply, err := g.sendGossipMessage(message, members[i].RemoteAddress, timeout)
+		if err != nil {
+			debugLog.Println(fmt.Errorf("error querying node '%s': %w", members[i].ID, err))
+			return
+		}
+		g.applyReply(reply)
+		if reply.QueryResponse == nil {
+			reply.QueryResponse = &queryResponse{}
+		}
+		responses[i] = reply.QueryResponse
+	})
+	if queriesSelf {
+		members = append(members, NodeDescription{ID: g.Node.ID})
+		responses = append(responses, g.respondToQuery(g.Node.ID, request))
+	}
+
+	result := QueryResult{Responses: []QueryResponse{}, Acked: []NodeID{}, NoReply: []NodeID{}}
+	for i, response := range responses {
+		switch {
+		case response == nil:
+			result.NoReply = append(result.NoReply, members[i].ID)
+		case response.Responded:
+			result.Responses = append(result.Responses, QueryResponse{
+				From:    members[i].ID,
+				Payload: response.Payload,
+				Error:   response.Error,
+			})
+		default:
+			result.Acked = append(result.Acked, members[i].ID)
+		}
+	}
+	sort.Slice(result.Responses, func(i, j int) bool {
+		return result.Responses[i].From < result.Responses[j].From
+	})
+	sort.Strings(result.Acked)
+	sort.Strings(result.NoReply)
+	return result, nil
+}
+
+func (g *Gossip) respondToQuery(from NodeID, request *queryRequest) *queryResponse {
+	g.Lock()
+	g.queries.clock.witness(request.LTime)
+	handler := g.queries.handlers[request.Name]
+	hasTags := NodeDescription{Tags: g.Node.Tags}.HasTags(request.Tags)
+	g.Unlock()
+	if handler == nil || !hasTags {
+		return &queryResponse{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), minDuration(request.Timeout, maxQueryTimeout))
+	defer cancel()
+	payload, err := handler(ctx, Query{
+		Name:    request.Name,
+		Payload: request.Payload,
+		From:    from,
+		LTime:   request.LTime,
+	})
+	if err != nil {
+		return &queryResponse{Responded: true, Error: err.Error()}
+	}
+	if payload == nil {
+		return &queryResponse{}
+	}
+	if len(payload) > maxQueryPayloadSize {
+		return &queryResponse{Responded: true, Error: fmt.Sprintf("response of %d bytes is too large", len(payload))}
+	}
+	return &queryResponse{Responded: true, Payload: payload}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlowQueryHandlersAreStillAnswered(t *testing.T) {
+	for _, transport := range []string{"udp", "http"} {
+		t.Run(transport, func(t *testing.T) {
+			testSlowQueryHandlersAreStillAnswered(t, transport)
+		})
+	}
+}
+
+func testSlowQueryHandlersAreStillAnswered(t *testing.T, transport string) {
+	settings := GossipSettings{
+		GossipRegularity:      100 * time.Millisecond,
+		ProbeTimeout:          50 * time.Millisecond,
+		MaxPiggybackedUpdates: 10,
+		RetransmitMultiplier:  4,
+	}
+	var nodes []*Gossip
+	for _, nodeID := range []NodeID{"node-1", "node-2"} {
+		nodeSettings := settings
+		var address string
+		// Servers time out connections after GossipRegularity, as they do
+		// when run
+		nodeSettings.Transport, address = newTestTransport(t, transport, settings.GossipRegularity)
+		g := NewGossip(&Node{ID: nodeID, RemoteAddress: address}, nodeSettings)
+		served := make(chan error, 1)
+		go func() {
+			served <- g.Transport.Serve(g.handleGossipMessage)
+		}()
+		t.Cleanup(func() {
+			g.Transport.Close()
+			<-served
+		})
+		nodes = append(nodes, g)
+	}
+	if _, err := nodes[0].Join([]string{nodes[1].Node.RemoteAddress}); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes[1].HandleQueries("slow", func(ctx context.Context, query Query) ([]byte, error) {
+		time.Sleep(3 * settings.GossipRegularity)
+		return []byte("done"), nil
+	})
+	result, err := nodes[0].Query("slow", nil, QueryParams{Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Responses) != 1 || result.Responses[0].From != "node-2" || string(result.Responses[0].Payload) != "done" {
+		t.Fatalf("expected node-2 to respond, got %+v", result)
+	}
+}
+
+func TestQueryTimeoutsAreLimited(t *testing.T) {
+	g := NewGossip(&Node{ID: "node-1"}, GossipSettings{})
+	if _, err := g.Query("query", nil, QueryParams{Timeout: maxQueryTimeout + time.Second}); err == nil {
+		t.Fatalf("expected an error querying with a timeout over %s", maxQueryTimeout)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Quorum is a majority of votes by default, where each node has one vote
+// unless configured otherwise. A cluster spread across zones can instead
+// require a majority of zones, where a zone counts if most of its votes were
+// seen, so that the loss of a large zone doesn't take quorum with it.
+//
+// Embedding services can subscribe to this node gaining or losing a view of
+// most of the cluster, so that they can stop doing work in a minority
+// partition.
+//
+// Leadership is decided without any extra messages. The leader is the lowest
+// node ID that is alive, as seen by a node with a view of most of the
+// cluster. Because views differ between nodes, a node only becomes leader
+// once it has been the lowest alive node ID with quorum for a whole
+// LeaderLeaseDuration. A leader gives up leadership immediately when that
+// stops being true, and leadership lapses if it isn't renewed every round.
+// This is safe as long as LeaderLeaseDuration is longer than it takes a
+// partitioned leader to suspect most of the cluster.
+
+type QuorumPolicy string
+
+const (
+	QuorumMajorityOfVotes QuorumPolicy = "majority"
+	QuorumMajorityOfZones QuorumPolicy = "zones"
+)
+
+type QuorumEventType int
+
+const (
+	QuorumGained QuorumEventType = iota
+	QuorumLost
+	LeadershipGained
+	LeadershipLost
+	ClusterSplit
+	ClusterHealed
+)
+
+func (t QuorumEventType) String() string {
+	switch t {
+	case QuorumGained:
+		return "quorum-gained"
+	case QuorumLost:
+		return "quorum-lost"
+	case LeadershipGained:
+		return "leadership-gained"
+	case LeadershipLost:
+		return "leadership-lost"
+	case ClusterSplit:
+		return "cluster-split"
+	case ClusterHealed:
+		return "cluster-healed"
+	default:
+		return fmt.Sprintf("QuorumEventType(%d)", int(t))
+	}
+}
+
+type QuorumEvent struct {
+	Type    QuorumEventType
+	Summary GossipSummary
+	// Only set for cluster split and healed events
+	Partitions *PartitionView
+	At         time.Time
+}
+
+type Leadership struct {
+	// The lowest alive node ID, or empty if this node lacks quorum
+	Leader         NodeID
+	IsLeader       bool
+	LeaseExpiresAt *time.Time
+}
+
+type quorumState struct {
+	hasQuorum      bool
+	leader         NodeID
+	candidateSince *time.Time
+	leaseExpiresAt *time.Time
+	split          bool
+
+	subscribers quorumSubscriberSet
+}
+
+type quorumSubscriberSet struct {
+	channels map[int]chan QuorumEvent
+	nextID   int
+}
+
+// Must be called with the lock held
+func (s *quorumSubscriberSet) add(channel chan QuorumEvent) func() {
+	if s.channels == nil {
+		s.channels = map[int]chan QuorumEvent{}
+	}
+	id := s.nextID
+	s.nextID += 1
+	s.channels[id] = channel
+	return func() {
+		if _, ok := s.channels[id]; ok {
+			delete(s.channels, id)
+			close(channel)
+		}
+	}
+}
+
+// Must be called with the lock held
+func (s *quorumSubscriberSet) publish(event QuorumEvent) int {
+	dropped := 0
+	for _, channel := range s.channels {
+		select {
+		case channel <- event:
+		default:
+			dropped += 1
+		}
+	}
+	return dropped
+}
+
+// SubscribeQuorum returns a channel of quorum and leadership events, and a
+// function to unsubscribe. Events are dropped if the channel is full.
+func (g *Gossip) SubscribeQuorum() (<-chan QuorumEvent, func()) {
+	events := make(chan QuorumEvent, 16)
+	g.Lock()
+	defer g.Unlock()
+	return events, g.unsubscriber(g.quorum.subscribers.add(events))
+}
+
+func (g *Gossip) HasQuorum() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.quorum.hasQuorum
+}
+
+// Leadership reports who this node thinks is leader. IsLeader is only true
+// while the lease is unexpired, so a leader whose gossip has stalled fences
+// itself.
+func (g *Gossip) Leadership() Leadership {
+	g.Lock()
+	defer g.Unlock()
+
+	leadership := Leadership{Leader: g.quorum.leader}
+	if g.quorum.leaseExpiresAt != nil && g.Clock.Now().Before(*g.quorum.leaseExpiresAt) {
+		leadership.IsLeader = true
+		leaseExpiresAt := *g.quorum.leaseExpiresAt
+		leadership.LeaseExpiresAt = &leaseExpiresAt
+	}
+	return leadership
+}
+
+// Must be called with the lock held. Zones and votes are only learned from
+// the nodes themselves, or from the config file, so a node can be counted in
+// the "" zone until it has been heard from.
+func (g *Gossip) learnZone(nodeID NodeID, zone string, votes int) {
+	nodeStatus, ok := g.OtherNodeStatuses[nodeID]
+	if !ok || (nodeStatus.Node.Zone == zone && nodeStatus.Node.Votes == votes) {
+		return
+	}
+	nodeStatus.Node.Zone = zone
+	nodeStatus.Node.Votes = votes
+	g.setNodeStatus(nodeID, nodeStatus)
+}
+
+// Called every round to update quorum and leadership
+func (g *Gossip) updateQuorum() {
+	g.Lock()
+	defer g.Unlock()
+
+	now := g.Clock.Now()
+	summary := g.summary()
+	hasQuorum := summary.RecentlySawMostOfCluster()
+	if hasQuorum != g.quorum.hasQuorum {
+		g.quorum.hasQuorum = hasQuorum
+		if hasQuorum {
+			infoLog.Println("gained quorum")
+			g.publishQuorumEvent(QuorumEvent{Type: QuorumGained, Summary: *summary, At: now})
+		} else {
+			warnLog.Println("lost quorum")
+			g.publishQuorumEvent(QuorumEvent{Type: QuorumLost, Summary: *summary, At: now})
+		}
+	}
+
+	g.quorum.leader = ""
+	if hasQuorum {
+		g.quorum.leader = g.Node.ID
+		for nodeID, nodeStatus := range g.OtherNodeStatuses {
+			if nodeStatus.State == NodeAlive && nodeID < g.quorum.leader {
+				g.quorum.leader = nodeID
+			}
+		}
+	}
+
+	wasLeader := g.quorum.leaseExpiresAt != nil
+	if g.quorum.leader != g.Node.ID {
+		g.quorum.candidateSince = nil
+		g.quorum.leaseExpiresAt = nil
+		if wasLeader {
+			warnLog.Println("lost leadership")
+			g.publishQuorumEvent(QuorumEvent{Type: LeadershipLost, Summary: *summary, At: now})
+		}
+		return
+	}
+
+	if g.quorum.candidateSince == nil {
+		g.quorum.candidateSince = &now
+	}
+	if now.Sub(*g.quorum.candidateSince) < g.LeaderLeaseDuration {
+		return
+	}
+	leaseExpiresAt := now.Add(g.LeaderLeaseDuration)
+	g.quorum.leaseExpiresAt = &leaseExpiresAt
+	if !wasLeader {
+		infoLog.Println("gained leadership")
+		g.publishQuorumEvent(QuorumEvent{Type: LeadershipGained, Summary: *summary, At: now})
+	}
+}
+
+// Must be called with the lock held
+func (g *Gossip) publishQuorumEvent(event QuorumEvent) {
+	if dropped := g.quorum.subscribers.publish(event); dropped > 0 {
+		warnLog.Printf("dropped %s event as %d subscribers are not keeping up\n", event.Type, dropped)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+// Whether no node on either side of a partition sees any node on the other
+// side as alive
+func (s *Simulation) sidesApart(a, b []int) bool {
+	for _, sides := range [][2][]int{{a, b}, {b, a}} {
+		for _, i := range sides[0] {
+			for _, j := range sides[1] {
+				if s.Nodes[i].OtherNodeStatuses[s.Nodes[j].Node.ID].State == NodeAlive {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func (s *Simulation) nodesWithQuorum(indexes []int) int {
+	count := 0
+	for _, i := range indexes {
+		if s.Nodes[i].Summary().RecentlySawMostOfCluster() {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Spreads the cluster across three zones, one holding half the nodes, and
+// cuts a zone off to check which side keeps quorum under each policy
+func TestQuorumWhenZoneIsCutOff(t *testing.T) {
+	tests := []struct {
+		policy   QuorumPolicy
+		lostZone string
+		// Whether the rest of the cluster, and the lost zone, keep quorum
+		othersHaveQuorum  bool
+		lostZoneHasQuorum bool
+	}{
+		// Half the votes isn't a majority, so losing the large zone loses
+		// quorum everywhere, unless quorum is a majority of zones
+		{QuorumMajorityOfVotes, "zone-a", false, false},
+		{QuorumMajorityOfZones, "zone-a", true, false},
+		{QuorumMajorityOfVotes, "zone-b", true, false},
+		{QuorumMajorityOfZones, "zone-b", true, false},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy)+"/"+test.lostZone, func(t *testing.T) {
+			config := newSimulationConfig(30)
+			config.Zones = []string{"zone-a", "zone-b", "zone-a", "zone-c"}
+			config.GossipSettings.QuorumPolicy = test.policy
+			s := NewSimulation(config)
+			expectConverged(t, s, "joining", 15)
+
+			lost, others := []int{}, []int{}
+			for i, node := range s.Nodes {
+				if node.Node.Zone == test.lostZone {
+					lost = append(lost, i)
+				} else {
+					others = append(others, i)
+				}
+			}
+			s.Partition(lost, others)
+			if rounds, settled := s.RunUntil(func() bool { return s.sidesApart(lost, others) }, 100); !settled {
+				t.Fatalf("expected each side to see the other as down, still hadn't after %d rounds", rounds)
+			}
+
+			for _, side := range []struct {
+				name      string
+				indexes   []int
+				hasQuorum bool
+			}{{"the other zones", others, test.othersHaveQuorum}, {test.lostZone, lost, test.lostZoneHasQuorum}} {
+				expected := 0
+				if side.hasQuorum {
+					expected = len(side.indexes)
+				}
+				if withQuorum := s.nodesWithQuorum(side.indexes); withQuorum != expected {
+					t.Errorf("expected %d of %d nodes in %s to have quorum, got %d", expected, len(side.indexes), side.name, withQuorum)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+#!/usr/bin/env bash
+# Generates a CA, and a certificate for each node ID given as an argument.
+# The node ID is used as the common name and as a DNS SAN.
+set -euo pipefail
+
+mkdir -p certs
+cd certs
+
+if [ ! -f ca.pem ]; then
+  openssl req -x509 -newkey rsa:2048 -nodes -days 365 \
+    -subj "/CN=gossip-ca" -keyout ca-key.pem -out ca.pem
+fi
+
+for node_id in "$@"; do
+  openssl req -newkey rsa:2048 -nodes \
+    -subj "/CN=${node_id}" -keyout "${node_id}-key.pem" -out "${node_id}.csr"
+  openssl x509 -req -days 365 -in "${node_id}.csr" \
+    -CA ca.pem -CAkey ca-key.pem -CAcreateserial \
+    -extfile <(printf "subjectAltName=DNS:%s\nextendedKeyUsage=serverAuth,clientAuth" "${node_id}") \
+    -out "${node_id}.pem"
+  rm "${node_id}.csr"
+done
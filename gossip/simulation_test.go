@@ -0,0 +1,539 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Simulations run a whole cluster in one process over a MemoryNetwork, with
+// time kept by a VirtualClock. Nodes take turns to run each round and send
+// messages one at a time, so a simulation with the same seed always has the
+// same result.
+
+type SimulationConfig struct {
+	Nodes    int
+	Seed     int64
+	Latency  time.Duration
+	Jitter   time.Duration
+	LossRate float64
+	// Nodes are put in these zones in turn, so a zone listed twice gets
+	// twice as many nodes
+	Zones []string
+	// Each node's clock runs faster than the others by up to this fraction,
+	// and starts from a different time
+	ClockDrift float64
+	// Nodes save their state to files in this directory, if set, so that
+	// they carry on from it when restarted
+	StateDir string
+	// Nodes' clocks move on while they wait for replies, so that they
+	// measure round trip times. This puts clocks out of step by up to the
+	// round trips in a round, so is off unless a test needs it.
+	MeasureRoundTrips bool
+
+	GossipSettings GossipSettings
+}
+
+type Simulation struct {
+	Config  SimulationConfig
+	Clock   *VirtualClock
+	Network *MemoryNetwork
+	Nodes   []*Gossip
+	Round   int
+
+	transports []*MemoryTransport
+	crashed    map[NodeID]bool
+	slow       map[NodeID]bool
+	// Nodes that seem slow to themselves run rounds less often
+	nextRoundAt []time.Time
+
+	countedStateChanges map[[2]NodeID][2]uint64
+	falseSuspicions     uint64
+	falseDeaths         uint64
+}
+
+// NewSimulation starts every node, and has every node join through the first
+func NewSimulation(config SimulationConfig) *Simulation {
+	s := &Simulation{
+		Config:  config,
+		Clock:   NewVirtualClock(time.Unix(0, 0)),
+		Network: NewMemoryNetwork(config.Seed),
+		crashed: map[NodeID]bool{},
+		slow:    map[NodeID]bool{},
+
+		countedStateChanges: map[[2]NodeID][2]uint64{},
+	}
+	s.Network.Latency = config.Latency
+	s.Network.Jitter = config.Jitter
+	s.Network.LossRate = config.LossRate
+
+	for i := 0; i < config.Nodes; i++ {
+		settings := config.GossipSettings
+		settings.Clock = s.Clock
+		if config.ClockDrift > 0 {
+			random := rand.New(rand.NewSource(config.Seed + int64(i)))
+			settings.Clock = driftingClock{
+				base:   s.Clock,
+				start:  s.Clock.Now(),
+				offset: time.Duration(random.Int63n(int64(time.Hour))),
+				rate:   1 + random.Float64()*config.ClockDrift,
+			}
+		}
+		node, transport := s.startNode(i, settings)
+		s.Nodes = append(s.Nodes, node)
+		s.transports = append(s.transports, transport)
+		s.nextRoundAt = append(s.nextRoundAt, s.Clock.Now())
+	}
+	// Nodes retry joining until the seed replies, as they would in practice
+	for _, node := range s.Nodes[1:] {
+		for attempt := 0; attempt < maxJoinAttempts; attempt++ {
+			contacted, err := node.Join([]string{s.Nodes[0].Node.RemoteAddress})
+			if err != nil {
+				debugLog.Println(err)
+			}
+			if contacted > 0 {
+				break
+			}
+		}
+	}
+	s.countFalsePositives()
+	return s
+}
+
+const maxJoinAttempts = 10
+
+func (s *Simulation) startNode(i int, settings GossipSettings) (*Gossip, *MemoryTransport) {
+	nodeID := fmt.Sprintf("node-%04d", i)
+	transport := s.Network.Transport(nodeID)
+	settings.Transport = transport
+	if s.Config.MeasureRoundTrips {
+		clock, ok := settings.Clock.(*roundTripClock)
+		if !ok {
+			clock = &roundTripClock{base: settings.Clock}
+			settings.Clock = clock
+		}
+		transport.clock = clock
+	}
+	if s.Config.StateDir != "" {
+		settings.StateFile = filepath.Join(s.Config.StateDir, nodeID+".yml")
+	}
+	node := NewGossip(&Node{
+		ID:            nodeID,
+		LocalAddress:  nodeID,
+		RemoteAddress: nodeID,
+		OtherNodes:    map[string]NodeDescription{},
+	}, settings)
+	if len(s.Config.Zones) > 0 {
+		node.Node.Zone = s.Config.Zones[i%len(s.Config.Zones)]
+	}
+	node.random = rand.New(rand.NewSource(s.Config.Seed + int64(i)))
+	transport.listen(node.handleGossipMessage)
+	return node, transport
+}
+
+// Step runs one round on every node that hasn't crashed and is due one, then
+// advances the clock by GossipRegularity
+func (s *Simulation) Step() {
+	settings := s.Config.GossipSettings
+	pushPullEvery := 0
+	if settings.PushPullInterval > 0 {
+		pushPullEvery = int(settings.PushPullInterval / settings.GossipRegularity)
+		if pushPullEvery < 1 {
+			pushPullEvery = 1
+		}
+	}
+	for i, node := range s.Nodes {
+		if s.crashed[node.Node.ID] {
+			continue
+		}
+		if !s.Clock.Now().Before(s.nextRoundAt[i]) {
+			s.nextRoundAt[i] = s.Clock.Now().Add(node.gossipRound())
+		}
+		// Nodes push-pull in different rounds, as they would in practice
+		if pushPullEvery > 0 && (s.Round+i)%pushPullEvery == 0 {
+			node.pushPullRound()
+		}
+	}
+	s.countFalsePositives()
+	s.Clock.Advance(settings.GossipRegularity)
+	s.Round += 1
+}
+
+// RunUntil steps until done returns true, for up to maxRounds. Returns how
+// many rounds it took, and whether done ever returned true.
+func (s *Simulation) RunUntil(done func() bool, maxRounds int) (int, bool) {
+	for rounds := 0; rounds < maxRounds; rounds++ {
+		if done() {
+			return rounds, true
+		}
+		s.Step()
+	}
+	return maxRounds, done()
+}
+
+// Crash stops a node without it leaving, so that it stops responding
+func (s *Simulation) Crash(i int) {
+	s.crashed[s.Nodes[i].Node.ID] = true
+	s.transports[i].Close()
+}
+
+// Restart replaces a node with a new one with the same ID and clock, which
+// carries on from its state file if StateDir is set, and rejoins through
+// another running node
+func (s *Simulation) Restart(i int) error {
+	s.transports[i].Close()
+	node, transport := s.startNode(i, s.Nodes[i].GossipSettings)
+	s.Nodes[i], s.transports[i] = node, transport
+	delete(s.crashed, node.Node.ID)
+	// The new node counts its state changes from zero
+	for link := range s.countedStateChanges {
+		if link[0] == node.Node.ID {
+			delete(s.countedStateChanges, link)
+		}
+	}
+
+	if node.StateFile != "" {
+		state, err := LoadState(node.StateFile)
+		if err != nil {
+			return err
+		}
+		if state != nil {
+			if err = node.RestoreState(state); err != nil {
+				return err
+			}
+		}
+	}
+	for j, seed := range s.Nodes {
+		if j == i || s.crashed[seed.Node.ID] {
+			continue
+		}
+		for attempt := 0; attempt < maxJoinAttempts; attempt++ {
+			contacted, err := node.Join([]string{seed.Node.RemoteAddress})
+			if err != nil {
+				debugLog.Println(err)
+			}
+			if contacted > 0 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("restarted node '%s' couldn't rejoin", node.Node.ID)
+}
+
+// Slow delays every message a node receives, as if it were overloaded. A
+// delay of zero makes it healthy again.
+func (s *Simulation) Slow(i int, delay time.Duration) {
+	s.slow[s.Nodes[i].Node.ID] = delay > 0
+	s.Network.Delay(s.Nodes[i].Node.RemoteAddress, delay)
+}
+
+// Partition splits the nodes into groups by index, which can only reach
+// nodes in the same group
+func (s *Simulation) Partition(groups ...[]int) {
+	addressGroups := [][]string{}
+	for _, group := range groups {
+		addresses := []string{}
+		for _, i := range group {
+			addresses = append(addresses, s.Nodes[i].Node.RemoteAddress)
+		}
+		addressGroups = append(addressGroups, addresses)
+	}
+	s.Network.Partition(addressGroups...)
+}
+
+func (s *Simulation) Heal() {
+	s.Network.Heal()
+}
+
+// Converged is true once every running node sees every other running node
+// as alive, and every crashed node as dead or left
+func (s *Simulation) Converged() bool {
+	for _, observer := range s.Nodes {
+		if s.crashed[observer.Node.ID] {
+			continue
+		}
+		observer.Lock()
+		converged := true
+		for _, node := range s.Nodes {
+			if node == observer {
+				continue
+			}
+			nodeStatus, known := observer.OtherNodeStatuses[node.Node.ID]
+			if s.crashed[node.Node.ID] {
+				converged = !known || nodeStatus.State == NodeDead || nodeStatus.State == NodeLeft
+			} else {
+				converged = known && nodeStatus.State == NodeAlive
+			}
+			if !converged {
+				break
+			}
+		}
+		observer.Unlock()
+		if !converged {
+			return false
+		}
+	}
+	return true
+}
+
+// FalsePositives counts how many times so far running nodes have suspected,
+// or declared dead, other running nodes that weren't slow at the time
+func (s *Simulation) FalsePositives() (suspicions, deaths uint64) {
+	return s.falseSuspicions, s.falseDeaths
+}
+
+// Counts the state changes since the last step, so that they are attributed
+// to whether nodes were crashed or slow then rather than now
+func (s *Simulation) countFalsePositives() {
+	for _, observer := range s.Nodes {
+		if s.crashed[observer.Node.ID] {
+			continue
+		}
+		observer.metrics.lock.Lock()
+		for nodeID, stateChanges := range observer.metrics.stateChanges {
+			link := [2]NodeID{observer.Node.ID, nodeID}
+			counted := s.countedStateChanges[link]
+			if !s.crashed[nodeID] && !s.slow[nodeID] {
+				s.falseSuspicions += stateChanges[NodeSuspect] - counted[0]
+				s.falseDeaths += stateChanges[NodeDead] - counted[1]
+			}
+			s.countedStateChanges[link] = [2]uint64{stateChanges[NodeSuspect], stateChanges[NodeDead]}
+		}
+		observer.metrics.lock.Unlock()
+	}
+}
+
+func (s *Simulation) BytesSent() uint64 {
+	bytes := uint64(0)
+	for _, transport := range s.transports {
+		bytes += transport.Stats().BytesSent
+	}
+	return bytes
+}
+
+// VirtualClock only moves when advanced
+type VirtualClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Runs at a different rate to another clock, as clocks on different machines
+// do, and starts from a different time
+type driftingClock struct {
+	base   Clock
+	start  time.Time
+	offset time.Duration
+	rate   float64
+}
+
+func (c driftingClock) Now() time.Time {
+	elapsed := c.base.Now().Sub(c.start)
+	return c.start.Add(c.offset + time.Duration(float64(elapsed)*c.rate))
+}
+
+// A node's clock, which moves on while it waits for each reply so that it
+// measures round trip times, and otherwise follows another clock
+type roundTripClock struct {
+	lock  sync.Mutex
+	base  Clock
+	ahead time.Time
+}
+
+func (c *roundTripClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now()
+}
+
+// Must be called with the lock held
+func (c *roundTripClock) now() time.Time {
+	if now := c.base.Now(); !now.Before(c.ahead) {
+		return now
+	}
+	return c.ahead
+}
+
+func (c *roundTripClock) wait(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ahead = c.now().Add(d)
+}
+
+// Like a cluster within one region, with the default settings
+func newSimulationConfig(nodes int) SimulationConfig {
+	return SimulationConfig{
+		Nodes:          nodes,
+		Seed:           1,
+		Latency:        5 * time.Millisecond,
+		Jitter:         10 * time.Millisecond,
+		LossRate:       0.01,
+		GossipSettings: DefaultConfig("").GossipSettings,
+	}
+}
+
+// Long enough for each side of a partition to declare the other dead
+func (s *Simulation) partitionRounds() int {
+	settings := s.Config.GossipSettings
+	return 2 * int(time.Duration(settings.MaxNodeTimeoutMultiplier)*settings.NodeTimeoutAfter/settings.GossipRegularity+1)
+}
+
+func expectConverged(t *testing.T, s *Simulation, scenario string, maxRounds int) {
+	t.Helper()
+	if rounds, converged := s.RunUntil(s.Converged, maxRounds); !converged {
+		t.Fatalf("expected the cluster to converge within %d rounds of %s, still hadn't after %d", maxRounds, scenario, rounds)
+	}
+}
+
+func expectNoFalsePositives(t *testing.T, s *Simulation, scenario string) {
+	t.Helper()
+	if suspicions, deaths := s.FalsePositives(); suspicions > 0 || deaths > 0 {
+		t.Fatalf("expected no false positives during %s, got %d false suspicions and %d false deaths", scenario, suspicions, deaths)
+	}
+}
+
+func TestSimulatedClusterConverges(t *testing.T) {
+	s := NewSimulation(newSimulationConfig(30))
+	expectConverged(t, s, "joining", 15)
+
+	for i := 0; i < 100; i++ {
+		s.Step()
+	}
+	if !s.Converged() {
+		t.Fatal("expected the cluster to stay converged")
+	}
+	expectNoFalsePositives(t, s, "steady state")
+
+	s.Crash(len(s.Nodes) - 1)
+	expectConverged(t, s, "a crash", 15)
+	expectNoFalsePositives(t, s, "a crash")
+	// A crashed node can't be told apart from one cut off by itself
+	if view := s.Nodes[0].Partitions(); len(view.Components) != 1 || len(view.Unreachable) != 1 {
+		t.Fatalf("expected one component and the crashed node unreachable, got %+v", view)
+	}
+}
+
+// Every node joins through the same seed, so the first to join learn of most
+// others from gossip, which carries a few updates per message, or from
+// push-pulls. Joining takes a few push-pull intervals rather than the few
+// rounds it takes in small clusters.
+func TestSimulatedLargeClusterConverges(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulating a large cluster takes tens of seconds")
+	}
+	s := NewSimulation(newSimulationConfig(250))
+	pushPullRounds := int(s.Config.GossipSettings.PushPullInterval / s.Config.GossipSettings.GossipRegularity)
+	rounds, converged := s.RunUntil(s.Converged, 3*pushPullRounds)
+	t.Logf("joined in %d rounds", rounds)
+	if !converged {
+		t.Fatalf("expected %d nodes to converge within %d rounds of joining", len(s.Nodes), rounds)
+	}
+	expectNoFalsePositives(t, s, "joining")
+
+	for i := 0; i < 50; i++ {
+		s.Step()
+	}
+	if !s.Converged() {
+		t.Fatal("expected the cluster to stay converged")
+	}
+	expectNoFalsePositives(t, s, "steady state")
+
+	for i := 0; i < 5; i++ {
+		s.Crash(i*50 + 7)
+	}
+	rounds, converged = s.RunUntil(s.Converged, 30)
+	t.Logf("noticed crashes in %d rounds", rounds)
+	if !converged {
+		t.Fatalf("expected every node to notice the crashes within %d rounds", rounds)
+	}
+	expectNoFalsePositives(t, s, "crashes")
+}
+
+func TestSimulatedClusterHealsPartition(t *testing.T) {
+	s := NewSimulation(newSimulationConfig(30))
+	expectConverged(t, s, "joining", 15)
+
+	majority, minority := []int{}, []int{}
+	for i := range s.Nodes {
+		if i < 20 {
+			majority = append(majority, i)
+		} else {
+			minority = append(minority, i)
+		}
+	}
+	var subscriptions []<-chan QuorumEvent
+	for _, i := range []int{majority[0], minority[0]} {
+		events, unsubscribe := s.Nodes[i].SubscribeQuorum()
+		defer unsubscribe()
+		subscriptions = append(subscriptions, events)
+	}
+
+	s.Partition(majority, minority)
+	for i := 0; i < s.partitionRounds(); i++ {
+		s.Step()
+	}
+	for _, sides := range [][2][]int{{majority, minority}, {minority, majority}} {
+		observer := s.Nodes[sides[0][0]]
+		view := observer.Partitions()
+		if len(view.Components) != 2 || len(view.Components[0]) != len(majority) || len(view.Components[1]) != len(minority) || len(view.Unreachable) != 0 {
+			t.Fatalf("expected node '%s' to see components of %d and %d nodes, got %+v", observer.Node.ID, len(majority), len(minority), view)
+		}
+	}
+
+	s.Heal()
+	expectConverged(t, s, "healing", 60)
+	for i := 0; i < 5; i++ {
+		s.Step()
+	}
+	for i, events := range subscriptions {
+		splitEvents := []QuorumEventType{}
+		for len(events) > 0 {
+			if event := <-events; event.Type == ClusterSplit || event.Type == ClusterHealed {
+				splitEvents = append(splitEvents, event.Type)
+			}
+		}
+		if len(splitEvents) != 2 || splitEvents[0] != ClusterSplit || splitEvents[1] != ClusterHealed {
+			t.Errorf("expected subscriber %d to see the cluster split then heal, got %v", i, splitEvents)
+		}
+	}
+	expectConverged(t, s, "healing", 60)
+}
+
+func TestSimulationsWithTheSameSeedHaveTheSameResult(t *testing.T) {
+	run := func() (int, uint64, uint64, uint64) {
+		config := newSimulationConfig(10)
+		config.LossRate = 0.1
+		s := NewSimulation(config)
+		rounds, _ := s.RunUntil(s.Converged, 100)
+		s.Crash(3)
+		for i := 0; i < 20; i++ {
+			s.Step()
+		}
+		suspicions, deaths := s.FalsePositives()
+		return rounds, suspicions, deaths, s.BytesSent()
+	}
+	rounds, suspicions, deaths, bytes := run()
+	againRounds, againSuspicions, againDeaths, againBytes := run()
+	if rounds != againRounds || suspicions != againSuspicions || deaths != againDeaths || bytes != againBytes {
+		t.Fatalf("expected the same result, got %d rounds, %d suspicions, %d deaths and %d bytes, then %d, %d, %d and %d",
+			rounds, suspicions, deaths, bytes, againRounds, againSuspicions, againDeaths, againBytes)
+	}
+}
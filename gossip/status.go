@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The status API is a read-only JSON view of this node's membership list, for
+// operators and gossipctl, along with metrics on /metrics. /health responds
+// 503 when this node can't see most of the cluster, so load balancers can
+// avoid nodes in a minority partition.
+
+type MemberStatus struct {
+	ID            NodeID            `json:"id"`
+	RemoteAddress string            `json:"remote_address"`
+	State         string            `json:"state"`
+	Incarnation   uint64            `json:"incarnation"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	Zone          string            `json:"zone,omitempty"`
+	Votes         int               `json:"votes"`
+	// Self is true for the node serving the status API
+	Self               bool       `json:"self,omitempty"`
+	LastSeenAt         *time.Time `json:"last_seen_at,omitempty"`
+	LastSeenAgeSeconds *float64   `json:"last_seen_age_seconds,omitempty"`
+	SuspectedAt        *time.Time `json:"suspected_at,omitempty"`
+	// Estimated from network coordinates, once they are known
+	EstimatedRTTSeconds *float64 `json:"estimated_rtt_seconds,omitempty"`
+}
+
+type SummaryStatus struct {
+	NodeID                   NodeID        `json:"node_id"`
+	Incarnation              uint64        `json:"incarnation"`
+	LocalHealth              int           `json:"local_health"`
+	Coordinate               Coordinate    `json:"coordinate"`
+	ClusterNodeCount         int           `json:"cluster_node_count"`
+	OtherNodesSeenRecently   int           `json:"other_nodes_seen_recently"`
+	OtherNodesSuspected      int           `json:"other_nodes_suspected"`
+	OtherNodesDead           int           `json:"other_nodes_dead"`
+	RecentlySawMostOfCluster bool          `json:"recently_saw_most_of_cluster"`
+	QuorumPolicy             QuorumPolicy  `json:"quorum_policy"`
+	ClusterVotes             int           `json:"cluster_votes"`
+	VotesSeenRecently        int           `json:"votes_seen_recently"`
+	Zones                    []ZoneStatus  `json:"zones"`
+	ConfigVersion            uint64        `json:"config_version"`
+	Leader                   NodeID        `json:"leader,omitempty"`
+	IsLeader                 bool          `json:"is_leader"`
+	LeaseExpiresAt           *time.Time    `json:"lease_expires_at,omitempty"`
+	Partitions               PartitionView `json:"partitions"`
+}
+
+type ZoneStatus struct {
+	Zone              string `json:"zone"`
+	Nodes             int    `json:"nodes"`
+	NodesSeenRecently int    `json:"nodes_seen_recently"`
+	Votes             int    `json:"votes"`
+	VotesSeenRecently int    `json:"votes_seen_recently"`
+	SawMostOfZone     bool   `json:"saw_most_of_zone"`
+}
+
+type ClusterConfigStatus struct {
+	Version uint64 `json:"version"`
+	// Includes deleted keys
+	Entries []ConfigEntry `json:"entries"`
+}
+
+type HealthStatus struct {
+	NodeID  NodeID `json:"node_id"`
+	Healthy bool   `json:"healthy"`
+}
+
+// MemberStatuses lists this node and every node it knows about, sorted by ID
+func (g *Gossip) MemberStatuses() []MemberStatus {
+	return g.memberStatuses(false)
+}
+
+// MemberStatusesByProximity lists this node and every node it knows about,
+// nearest first
+func (g *Gossip) MemberStatusesByProximity() []MemberStatus {
+	return g.memberStatuses(true)
+}
+
+func (g *Gossip) memberStatuses(byProximity bool) []MemberStatus {
+	g.Lock()
+	defer g.Unlock()
+
+	now := g.Clock.Now()
+	members := []MemberStatus{{
+		ID:            g.Node.ID,
+		RemoteAddress: g.Node.RemoteAddress,
+		State:         NodeAlive.String(),
+		Incarnation:   g.Incarnation,
+		Tags:          copyTags(g.Node.Tags),
+		Zone:          g.Node.Zone,
+		Votes:         g.self().VoteCount(),
+		Self:          true,
+	}}
+	selfRTT := 0.0
+	members[0].EstimatedRTTSeconds = &selfRTT
+	for nodeID, nodeStatus := range g.OtherNodeStatuses {
+		member := MemberStatus{
+			ID:            nodeID,
+			RemoteAddress: nodeStatus.Node.RemoteAddress,
+			State:         nodeStatus.State.String(),
+			Incarnation:   nodeStatus.Incarnation,
+			Tags:          copyTags(nodeStatus.Node.Tags),
+			Zone:          nodeStatus.Node.Zone,
+			Votes:         nodeStatus.Node.VoteCount(),
+			LastSeenAt:    nodeStatus.LastSeenAt,
+			SuspectedAt:   nodeStatus.SuspectedAt,
+		}
+		if nodeStatus.LastSeenAt != nil {
+			age := now.Sub(*nodeStatus.LastSeenAt).Seconds()
+			member.LastSeenAgeSeconds = &age
+		}
+		if rtt, ok := g.estimateRTT(nodeID); ok {
+			rttSeconds := rtt.Seconds()
+			member.EstimatedRTTSeconds = &rttSeconds
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if byProximity {
+			return g.closerThan(members[i].ID, members[j].ID)
+		}
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+func (g *Gossip) SummaryStatus() SummaryStatus {
+	summary := g.Summary()
+	leadership := g.Leadership()
+	g.Lock()
+	incarnation := g.Incarnation
+	localHealth := g.localHealth
+	coordinate := g.coordinates.coordinate.clone()
+	configVersion := g.configVersion()
+	g.Unlock()
+	zones := []ZoneStatus{}
+	for zone, zoneSummary := range summary.Zones {
+		zones = append(zones, ZoneStatus{
+			Zone:              zone,
+			Nodes:             zoneSummary.Nodes,
+			NodesSeenRecently: zoneSummary.NodesSeenRecently,
+			Votes:             zoneSummary.Votes,
+			VotesSeenRecently: zoneSummary.VotesSeenRecently,
+			SawMostOfZone:     zoneSummary.SawMostOfZone(),
+		})
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		return zones[i].Zone < zones[j].Zone
+	})
+	return SummaryStatus{
+		NodeID:                   g.Node.ID,
+		Incarnation:              incarnation,
+		LocalHealth:              localHealth,
+		Coordinate:               coordinate,
+		ClusterNodeCount:         summary.ClusterNodeCount,
+		OtherNodesSeenRecently:   summary.OtherNodesSeenRecently,
+		OtherNodesSuspected:      summary.OtherNodesSuspected,
+		OtherNodesDead:           summary.OtherNodesDead,
+		RecentlySawMostOfCluster: summary.RecentlySawMostOfCluster(),
+		QuorumPolicy:             summary.QuorumPolicy,
+		ClusterVotes:             summary.ClusterVotes,
+		VotesSeenRecently:        summary.VotesSeenRecently,
+		Zones:                    zones,
+		ConfigVersion:            configVersion,
+		Leader:                   leadership.Leader,
+		IsLeader:                 leadership.IsLeader,
+		LeaseExpiresAt:           leadership.LeaseExpiresAt,
+		Partitions:               g.Partitions(),
+	}
+}
+
+func NewStatusHandler(g *Gossip) http.Handler {
+	mux := http.NewServeMux()
+	// Members can be filtered with ?state=alive, and with any number of
+	// ?tag=key=value. They are sorted nearest first with ?sort=proximity.
+	mux.HandleFunc("/members", func(w http.ResponseWriter, r *http.Request) {
+		state := r.URL.Query().Get("state")
+		listMembers := g.MemberStatuses
+		switch order := r.URL.Query().Get("sort"); order {
+		case "", "id":
+		case "proximity":
+			listMembers = g.MemberStatusesByProximity
+		default:
+			http.Error(w, fmt.Sprintf("members can be sorted by id or proximity, not '%s'", order), http.StatusBadRequest)
+			return
+		}
+		tags := map[string]string{}
+		for _, pair := range r.URL.Query()["tag"] {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				http.Error(w, fmt.Sprintf("tags must be key=value, got '%s'", pair), http.StatusBadRequest)
+				return
+			}
+			tags[parts[0]] = parts[1]
+		}
+		statusEndpoint(func() (int, interface{}) {
+			members := []MemberStatus{}
+			for _, member := range listMembers() {
+				node := NodeDescription{Tags: member.Tags}
+				if (state == "" || member.State == state) && node.HasTags(tags) {
+					members = append(members, member)
+				}
+			}
+			return http.StatusOK, members
+		})(w, r)
+	})
+	mux.HandleFunc("/config", statusEndpoint(func() (int, interface{}) {
+		g.Lock()
+		defer g.Unlock()
+		return http.StatusOK, ClusterConfigStatus{
+			Version: g.configVersion(),
+			Entries: g.configEntries(),
+		}
+	}))
+	mux.HandleFunc("/leases", statusEndpoint(func() (int, interface{}) {
+		return http.StatusOK, g.Leases()
+	}))
+	mux.HandleFunc("/summary", statusEndpoint(func() (int, interface{}) {
+		return http.StatusOK, g.SummaryStatus()
+	}))
+	mux.HandleFunc("/health", statusEndpoint(func() (int, interface{}) {
+		health := HealthStatus{
+			NodeID:  g.Node.ID,
+			Healthy: g.Summary().RecentlySawMostOfCluster(),
+		}
+		if !health.Healthy {
+			return http.StatusServiceUnavailable, health
+		}
+		return http.StatusOK, health
+	}))
+	mux.HandleFunc("/metrics", metricsEndpoint(g))
+	return mux
+}
+
+func statusEndpoint(status func() (int, interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		statusCode, body := status()
+		responseBytes, err := json.MarshalIndent(body, "", "  ")
+		if err != nil {
+			errorLog.Println(fmt.Errorf("error serialising status: %w", err))
+			http.Error(w, "error serialising status", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		w.Write(append(responseBytes, '\n'))
+	}
+}
+
+// ServeStatus serves the status API until the context is cancelled
+func ServeStatus(ctx context.Context, g *Gossip, listenAddress string) error {
+	server := &http.Server{
+		Addr:         listenAddress,
+		Handler:      NewStatusHandler(g),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("error serving status API: %w", err)
+	}
+	return nil
+}
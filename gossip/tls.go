@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// Nodes authenticate each other with Mutual TLS. Every node has a certificate
+// signed by the cluster CA, whose common name or a DNS SAN is its node ID.
+// Gossip that claims to be from a node ID not in the peer's certificate is
+// rejected, as are replies from nodes with the wrong certificate. Every node
+// is both a server and a client, so certificates need both extended key
+// usages.
+
+func LoadMutualTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	caBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %w", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("error parsing CA file: no certificates found")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate and key: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caPool,
+		RootCAs:      caPool,
+		MinVersion:   tls.VersionTLS12,
+		// Nodes are addressed by IP and port, so certificates can't be checked
+		// against the hostname. Instead the chain is verified here, and the
+		// node ID is checked against the certificate once it is known.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeerCertificateChain(caPool, x509.ExtKeyUsageServerAuth),
+	}
+	// Only servers ask for this, so clients are checked for client auth
+	serverConfig := config.Clone()
+	serverConfig.VerifyPeerCertificate = verifyPeerCertificateChain(caPool, x509.ExtKeyUsageClientAuth)
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return serverConfig, nil
+	}
+	return config, nil
+}
+
+func verifyPeerCertificateChain(caPool *x509.CertPool, keyUsage x509.ExtKeyUsage) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("peer presented no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, rawCert := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCert)
+			if err != nil {
+				return fmt.Errorf("error parsing peer certificate: %w", err)
+			}
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         caPool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{keyUsage},
+		})
+		if err != nil {
+			return fmt.Errorf("error verifying peer certificate: %w", err)
+		}
+		return nil
+	}
+}
+
+func peerCertificateMatchesNodeID(state *tls.ConnectionState, nodeID NodeID) error {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("peer presented no certificate")
+	}
+	cert := state.PeerCertificates[0]
+	if cert.Subject.CommonName == nodeID {
+		return nil
+	}
+	for _, dnsName := range cert.DNSNames {
+		if dnsName == nodeID {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer certificate is not for node id '%s'", nodeID)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	dir    string
+	caFile string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	issued int
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{dir: t.TempDir(), cert: cert, key: key}
+	ca.caFile = ca.writePEM(t, "ca.pem", "CERTIFICATE", certBytes)
+	return ca
+}
+
+// Issues a certificate, and returns the name its files are saved under
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames []string, keyUsages ...x509.ExtKeyUsage) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.issued += 1
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(ca.issued + 1)),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  keyUsages,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := string(rune('a' + ca.issued))
+	ca.writePEM(t, name+".pem", "CERTIFICATE", certBytes)
+	ca.writePEM(t, name+"-key.pem", "EC PRIVATE KEY", keyBytes)
+	return name
+}
+
+func (ca *testCA) writePEM(t *testing.T, name, blockType string, bytes []byte) string {
+	path := filepath.Join(ca.dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Starts a node that trusts the CA, using a certificate the issuer issued
+func startTLSNode(t *testing.T, ca, issuer *testCA, certName string, nodeID NodeID, serve bool) (*Gossip, *HTTPTransport) {
+	config, err := LoadMutualTLSConfig(ca.caFile, filepath.Join(issuer.dir, certName+".pem"), filepath.Join(issuer.dir, certName+"-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := NewHTTPTransport("127.0.0.1:0", config, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGossip(&Node{ID: nodeID, RemoteAddress: transport.ListenAddress}, GossipSettings{Transport: transport})
+	served := make(chan error, 1)
+	if serve {
+		go func() {
+			served <- transport.Serve(g.handleGossipMessage)
+		}()
+	} else {
+		served <- nil
+	}
+	t.Cleanup(func() {
+		transport.Close()
+		<-served
+	})
+	return g, transport
+}
+
+func TestMutualTLSChecksPeerCertificates(t *testing.T) {
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	both := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	nodeOne := ca.issue(t, "node-1", nil, both...)
+
+	tests := []struct {
+		name string
+		// Issued to node-1, which serves, and node-2, which sends a ping
+		serverCert   string
+		clientIssuer *testCA
+		clientCert   string
+		accepted     bool
+	}{
+		{"matching common names", nodeOne, ca, ca.issue(t, "node-2", nil, both...), true},
+		{"matching DNS SAN", nodeOne, ca, ca.issue(t, "client", []string{"node-2"}, both...), true},
+		{"client with another node's certificate", nodeOne, ca, ca.issue(t, "node-3", []string{"node-3"}, both...), false},
+		{"server with another node's certificate", ca.issue(t, "node-3", nil, both...), ca, ca.issue(t, "node-2", nil, both...), false},
+		{"client certificate without client auth", nodeOne, ca, ca.issue(t, "node-2", nil, x509.ExtKeyUsageServerAuth), false},
+		{"server certificate without server auth", ca.issue(t, "node-1", nil, x509.ExtKeyUsageClientAuth), ca, ca.issue(t, "node-2", nil, both...), false},
+		{"client certificate from another CA", nodeOne, otherCA, otherCA.issue(t, "node-2", nil, both...), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, server := startTLSNode(t, ca, ca, test.serverCert, "node-1", true)
+			client, clientTransport := startTLSNode(t, ca, test.clientIssuer, test.clientCert, "node-2", false)
+
+			reply, err := clientTransport.Send(server.ListenAddress, newGossipMessage(client, pingMessage), time.Second)
+			if accepted := err == nil && reply.Ack; accepted != test.accepted {
+				t.Fatalf("expected accepted to be %v, got error %v", test.accepted, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A Transport carries gossip messages between nodes and brings back replies.
+type Transport interface {
+	// Send sends a message to the node at an address, and waits up to
+	// timeout for its reply
+	Send(address string, message *gossipMessage, timeout time.Duration) (*gossipReply, error)
+	// Serve receives messages until the transport is closed, replying to each
+	// with whatever handle returns
+	Serve(handle gossipHandler) error
+	Close() error
+	Stats() TransportStats
+}
+
+// How long a server may take to reply to a message. Query handlers can be
+// slower than gossip, so queries are given as long as their sender waits for
+// them, up to maxQueryTimeout.
+func replyTimeout(message *gossipMessage, serverTimeout time.Duration) time.Duration {
+	if message.Kind != queryMessage || message.Query == nil || message.Query.Timeout <= serverTimeout {
+		return serverTimeout
+	}
+	return minDuration(message.Query.Timeout, maxQueryTimeout)
+}
+
+// Transports that call the receiving node's handler before Send returns can
+// ask for fan-out to be sent one message at a time, so that messages are
+// handled in the same order every time
+type sequentialTransport interface {
+	Transport
+	sendsSequentially()
+}
+
+// Handles a message that has been authenticated as far as the transport can.
+// Returning an error rejects the message.
+type gossipHandler = func(message *gossipMessage) (*gossipReply, error)
+
+type TransportStats struct {
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+type transportCounters struct {
+	bytesSent     uint64
+	bytesReceived uint64
+}
+
+func (c *transportCounters) sent(n int) {
+	atomic.AddUint64(&c.bytesSent, uint64(n))
+}
+
+func (c *transportCounters) received(n int) {
+	atomic.AddUint64(&c.bytesReceived, uint64(n))
+}
+
+func (c *transportCounters) Stats() TransportStats {
+	return TransportStats{
+		BytesSent:     atomic.LoadUint64(&c.bytesSent),
+		BytesReceived: atomic.LoadUint64(&c.bytesReceived),
+	}
+}
+
+// Counts bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	counters *transportCounters
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counters.received(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counters.sent(n)
+	return n, err
+}
+
+type countingListener struct {
+	net.Listener
+	counters *transportCounters
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, counters: l.counters}, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// HTTPTransport sends each message as a YAML HTTP request, with the reply in
+// the response. It is much more expensive than UDPTransport, but it can use
+// Mutual TLS to authenticate nodes. With a keyring, the YAML is encrypted as
+// well, and whether it is a message or reply is authenticated.
+type HTTPTransport struct {
+	transportCounters
+
+	ListenAddress string
+	// Mutual TLS configuration. Gossip is sent over plain HTTP if this is nil.
+	TLS *tls.Config
+	// Encrypts and authenticates gossip if set
+	Keyring *Keyring
+
+	client        *http.Client
+	server        *http.Server
+	serverTimeout time.Duration
+	listener      net.Listener
+}
+
+// Lets handlers extend the write deadline of the connection they are on
+type httpConnContextKey struct{}
+
+var _ Transport = (*HTTPTransport)(nil)
+
+// Authenticated along with encrypted bodies, so that a message can't be
+// passed off as a reply or the other way around
+var (
+	httpMessageData = []byte("gossip message")
+	httpReplyData   = []byte("gossip reply")
+)
+
+// Listens straight away, so that the listen address is known even if the OS
+// picks the port. Requests must be received and replied to within
+// serverTimeout, so that a peer that stalls can't hold connections open,
+// except that queries are given as long as their sender waits.
+func NewHTTPTransport(listenAddress string, tlsConfig *tls.Config, serverTimeout time.Duration) (*HTTPTransport, error) {
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for gossip: %w", err)
+	}
+	t := &HTTPTransport{
+		ListenAddress: listener.Addr().String(),
+		TLS:           tlsConfig,
+		serverTimeout: serverTimeout,
+		listener:      listener,
+	}
+	dialer := &net.Dialer{}
+	t.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, address)
+				if err != nil {
+					return nil, err
+				}
+				return &countingConn{Conn: conn, counters: &t.transportCounters}, nil
+			},
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	t.server = &http.Server{
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: serverTimeout,
+		ReadTimeout:       serverTimeout,
+		WriteTimeout:      serverTimeout,
+		// Kept open between rounds so that connections, and particularly TLS
+		// sessions, are reused
+		IdleTimeout: time.Minute,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, httpConnContextKey{}, conn)
+		},
+	}
+	return t, nil
+}
+
+func (t *HTTPTransport) Serve(handle gossipHandler) error {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			errorLog.Println(fmt.Errorf("error reading from connection: %w", err))
+			return
+		}
+		if t.Keyring != nil {
+			if bodyBytes, err = t.Keyring.decrypt(bodyBytes, httpMessageData); err != nil {
+				warnLog.Println(fmt.Errorf("error: rejected gossip message: %w", err))
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		var gossipMessage gossipMessage
+		if err = yaml.Unmarshal(bodyBytes, &gossipMessage); err != nil {
+			errorLog.Println(fmt.Errorf("error deserialising body: %w", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if t.TLS != nil {
+			if err := peerCertificateMatchesNodeID(r.TLS, gossipMessage.NodeID); err != nil {
+				warnLog.Println(fmt.Errorf("error: rejected gossip message claiming to be from node id '%s': %w", gossipMessage.NodeID, err))
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		if timeout := replyTimeout(&gossipMessage, t.serverTimeout); timeout > t.serverTimeout {
+			if conn, ok := r.Context().Value(httpConnContextKey{}).(net.Conn); ok {
+				conn.SetWriteDeadline(time.Now().Add(timeout))
+			}
+		}
+		reply, err := handle(&gossipMessage)
+		if err != nil {
+			warnLog.Println(fmt.Errorf("error: rejected gossip message: %w", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		replyBytes, err := yaml.Marshal(reply)
+		if err != nil {
+			errorLog.Println(fmt.Errorf("error serialising reply into YAML: %w", err))
+			return
+		}
+		contentType := "application/yaml"
+		if t.Keyring != nil {
+			if replyBytes, err = t.Keyring.encrypt(replyBytes, httpReplyData); err != nil {
+				errorLog.Println(fmt.Errorf("error encrypting reply: %w", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		if _, err = w.Write(replyBytes); err != nil {
+			errorLog.Println(fmt.Errorf("error sending reply: %w", err))
+			return
+		}
+	}))
+
+	t.server.Handler = mux
+	countedListener := &countingListener{Listener: t.listener, counters: &t.transportCounters}
+	var err error
+	if t.TLS != nil {
+		err = t.server.ServeTLS(countedListener, "", "")
+	} else {
+		err = t.server.Serve(countedListener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (t *HTTPTransport) Close() error {
+	// Closes the listener as well, in case Serve was never called
+	defer t.listener.Close()
+	return t.server.Close()
+}
+
+func (t *HTTPTransport) Send(nodeAddress string, gossipMessage *gossipMessage, timeout time.Duration) (*gossipReply, error) {
+	url := fmt.Sprintf("http://%s/", nodeAddress)
+	if t.TLS != nil {
+		url = fmt.Sprintf("https://%s/", nodeAddress)
+	}
+	messageBytes, err := yaml.Marshal(gossipMessage)
+	if err != nil {
+		return nil, fmt.Errorf("error serialising message into YAML: %w", err)
+	}
+	contentType := "application/yaml"
+	if t.Keyring != nil {
+		if messageBytes, err = t.Keyring.encrypt(messageBytes, httpMessageData); err != nil {
+			return nil, fmt.Errorf("error encrypting message: %w", err)
+		}
+		contentType = "application/octet-stream"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(messageBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	request.Header.Set("Content-Type", contentType)
+	r, err := t.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error sending gossip message to node at '%s': %w", nodeAddress, err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gossip message was rejected by node at '%s': %s", nodeAddress, r.Status)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading from connection: %w", err)
+	}
+	if t.Keyring != nil {
+		if bodyBytes, err = t.Keyring.decrypt(bodyBytes, httpReplyData); err != nil {
+			return nil, fmt.Errorf("error decrypting gossip reply from node at '%s': %w", nodeAddress, err)
+		}
+	}
+
+	var gossipReply gossipReply
+	if err = yaml.Unmarshal(bodyBytes, &gossipReply); err != nil {
+		return nil, fmt.Errorf("error deserialising body: %w", err)
+	}
+
+	if gossipReply.NodeID == "" {
+		return nil, fmt.Errorf("gossip reply had no nodeid")
+	}
+	if t.TLS != nil {
+		if err := peerCertificateMatchesNodeID(r.TLS, gossipReply.NodeID); err != nil {
+			return nil, fmt.Errorf("error authenticating gossip reply from node id '%s': %w", gossipReply.NodeID, err)
+		}
+	}
+	return &gossipReply, nil
+}
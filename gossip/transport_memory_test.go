@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MemoryNetwork connects MemoryTransports within one process, for
+// simulations. Messages are delivered synchronously by calling the receiving
+// node's handler, and latency is only compared against the send timeout,
+// so a simulation runs as fast as it can while time is kept by a
+// VirtualClock.
+//
+// Loss and latency are decided by hashing the seed with the sender, receiver
+// and how many messages have been sent between them, rather than drawing
+// from a shared random source. Decisions are then the same however sends on
+// different links are interleaved.
+type MemoryNetwork struct {
+	Seed int64
+	// Latency of each message is between Latency and Latency+Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+	// Fraction of messages and replies that are dropped
+	LossRate float64
+
+	lock       sync.Mutex
+	listening  map[string]*MemoryTransport
+	partitions map[string]int
+	delays     map[string]time.Duration
+	linkCounts map[[2]string]uint64
+}
+
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		Seed:       seed,
+		listening:  map[string]*MemoryTransport{},
+		partitions: map[string]int{},
+		delays:     map[string]time.Duration{},
+		linkCounts: map[[2]string]uint64{},
+	}
+}
+
+// Partition splits the network so that messages are only delivered between
+// addresses in the same group. Addresses not in any group can't reach any
+// other address.
+func (n *MemoryNetwork) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partitions = map[string]int{}
+	for i, group := range groups {
+		for _, address := range group {
+			n.partitions[address] = i + 1
+		}
+	}
+}
+
+func (n *MemoryNetwork) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partitions = map[string]int{}
+}
+
+// Delay adds a delay to every message and reply received at an address, as
+// if the node there were too overloaded to process them promptly. A delay of
+// zero removes it.
+func (n *MemoryNetwork) Delay(address string, delay time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if delay == 0 {
+		delete(n.delays, address)
+		return
+	}
+	n.delays[address] = delay
+}
+
+// Transport returns a transport for the given address. Nothing can be sent
+// to it until it is served.
+func (n *MemoryNetwork) Transport(address string) *MemoryTransport {
+	return &MemoryTransport{
+		ListenAddress: address,
+		network:       n,
+		closed:        make(chan struct{}),
+	}
+}
+
+// Decides whether a message from one address to another is delivered, and
+// how long it takes
+func (n *MemoryNetwork) link(from, to string) (*MemoryTransport, time.Duration, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	receiver, ok := n.listening[to]
+	if !ok {
+		return nil, 0, false
+	}
+	if len(n.partitions) > 0 && (n.partitions[from] == 0 || n.partitions[from] != n.partitions[to]) {
+		return nil, 0, false
+	}
+	link := [2]string{from, to}
+	count := n.linkCounts[link]
+	n.linkCounts[link] += 1
+	if n.fraction(from, to, count, 0) < n.LossRate {
+		return nil, 0, false
+	}
+	latency := n.Latency + time.Duration(n.fraction(from, to, count, 1)*float64(n.Jitter)) + n.delays[to]
+	return receiver, latency, true
+}
+
+// A deterministic fraction between 0 and 1
+func (n *MemoryNetwork) fraction(from, to string, count uint64, purpose byte) float64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n.Seed))
+	h.Write(buf[:])
+	h.Write([]byte(from))
+	h.Write([]byte{0})
+	h.Write([]byte(to))
+	h.Write([]byte{0, purpose})
+	binary.BigEndian.PutUint64(buf[:], count)
+	h.Write(buf[:])
+	// The high bits of FNV barely change with the last bytes hashed, so without
+	// mixing them a link could lose every message or none
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb53ed31c85a9
+	x ^= x >> 33
+	return float64(x>>11) / float64(uint64(1)<<53)
+}
+
+// MemoryTransport sends gossip through a MemoryNetwork. Messages and replies
+// are passed through the binary encoding, and encrypted if there is a
+// keyring, so that nodes don't share memory and bytes can be counted.
+type MemoryTransport struct {
+	transportCounters
+
+	ListenAddress string
+	Keyring       *Keyring
+
+	network *MemoryNetwork
+	// Moved on by the round trip time of each reply, if set
+	clock     *roundTripClock
+	handle    gossipHandler
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ sequentialTransport = (*MemoryTransport)(nil)
+
+func (t *MemoryTransport) sendsSequentially() {}
+
+// Serve blocks until the transport is closed. Simulations call listen instead.
+func (t *MemoryTransport) Serve(handle gossipHandler) error {
+	t.listen(handle)
+	<-t.closed
+	return nil
+}
+
+func (t *MemoryTransport) listen(handle gossipHandler) {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	t.handle = handle
+	t.network.listening[t.ListenAddress] = t
+}
+
+func (t *MemoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.network.lock.Lock()
+		if t.network.listening[t.ListenAddress] == t {
+			delete(t.network.listening, t.ListenAddress)
+		}
+		t.network.lock.Unlock()
+		close(t.closed)
+	})
+	return nil
+}
+
+func (t *MemoryTransport) Send(nodeAddress string, message *gossipMessage, timeout time.Duration) (*gossipReply, error) {
+	messageBytes, err := encodeGossipMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	if messageBytes, err = t.encrypt(messageBytes, memoryMessageData); err != nil {
+		return nil, err
+	}
+	t.sent(len(messageBytes))
+
+	timedOut := fmt.Errorf("error sending gossip message to node at '%s': timed out waiting for reply after %s", nodeAddress, timeout)
+	receiver, latency, ok := t.network.link(t.ListenAddress, nodeAddress)
+	if !ok {
+		return nil, timedOut
+	}
+	reply, err := receiver.receive(messageBytes)
+	if err != nil {
+		return nil, fmt.Errorf("gossip message was rejected by node at '%s': %w", nodeAddress, err)
+	}
+
+	// Replies to messages that have already timed out are still lost
+	_, replyLatency, ok := t.network.link(nodeAddress, t.ListenAddress)
+	if !ok || latency+replyLatency > timeout {
+		return nil, timedOut
+	}
+	replyBytes, err := receiver.encrypt(encodeGossipReply(reply), memoryReplyData)
+	if err != nil {
+		return nil, err
+	}
+	t.received(len(replyBytes))
+	if t.clock != nil {
+		t.clock.wait(latency + replyLatency)
+	}
+	if replyBytes, err = t.decrypt(replyBytes, memoryReplyData); err != nil {
+		return nil, fmt.Errorf("error decrypting reply from node at '%s': %w", nodeAddress, err)
+	}
+	return decodeGossipReply(replyBytes)
+}
+
+// Authenticated with encrypted messages and replies, so that one can't be
+// passed off as the other
+var (
+	memoryMessageData = []byte("message")
+	memoryReplyData   = []byte("reply")
+)
+
+func (t *MemoryTransport) receive(messageBytes []byte) (*gossipReply, error) {
+	messageBytes, err := t.decrypt(messageBytes, memoryMessageData)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting message: %w", err)
+	}
+	message, err := decodeGossipMessage(messageBytes)
+	if err != nil {
+		return nil, err
+	}
+	return t.handle(message)
+}
+
+func (t *MemoryTransport) encrypt(payload, additionalData []byte) ([]byte, error) {
+	if t.Keyring == nil {
+		return payload, nil
+	}
+	return t.Keyring.encrypt(payload, additionalData)
+}
+
+func (t *MemoryTransport) decrypt(payload, additionalData []byte) ([]byte, error) {
+	if t.Keyring == nil {
+		return payload, nil
+	}
+	return t.Keyring.decrypt(payload, additionalData)
+}
+
+func TestMemoryNetworkLosesMessagesAtTheLossRate(t *testing.T) {
+	network := NewMemoryNetwork(1)
+	network.LossRate = 0.1
+	for _, address := range []string{"node-1", "node-2"} {
+		network.Transport(address).listen(nil)
+	}
+
+	lost := 0
+	for i := 0; i < 10000; i++ {
+		if _, _, ok := network.link("node-1", "node-2"); !ok {
+			lost += 1
+		}
+	}
+	if lost < 900 || lost > 1100 {
+		t.Fatalf("expected about 1000 of 10000 messages to be lost, got %d", lost)
+	}
+}
+
+func TestMemoryNetworkOnlyDeliversWithinPartitions(t *testing.T) {
+	network := NewMemoryNetwork(1)
+	for _, address := range []string{"node-1", "node-2", "node-3"} {
+		network.Transport(address).listen(nil)
+	}
+
+	network.Partition([]string{"node-1", "node-2"}, []string{"node-3"})
+	for _, link := range []struct {
+		from, to  string
+		delivered bool
+	}{
+		{"node-1", "node-2", true},
+		{"node-2", "node-1", true},
+		{"node-1", "node-3", false},
+		{"node-3", "node-2", false},
+	} {
+		if _, _, ok := network.link(link.from, link.to); ok != link.delivered {
+			t.Fatalf("expected delivery from %s to %s to be %v", link.from, link.to, link.delivered)
+		}
+	}
+	network.Heal()
+	if _, _, ok := network.link("node-1", "node-3"); !ok {
+		t.Fatal("expected delivery once healed")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDPTransport sends each message and its reply as a single UDP packet, using
+// the binary encoding. Joins and push-pulls, which carry the full member list,
+// queries, whose responses can be large, and any message too large for one
+// packet are sent over TCP on the same port.
+//
+// Each packet is a packet type byte, a 4 byte sequence number used to match
+// replies to messages, and then the encoded message or reply. Over TCP there
+// is one message per connection, framed by a 4 byte length.
+//
+// With a keyring, messages and replies are encrypted, and the packet type and
+// sequence number are authenticated. Errors are sent unencrypted, as they
+// carry nothing secret, and forging one has the same effect as dropping the
+// reply.
+type UDPTransport struct {
+	transportCounters
+
+	ListenAddress string
+	MaxPacketSize int
+	// How long a TCP connection has to send its message and receive a reply,
+	// unless it is a query
+	ServerTimeout time.Duration
+	// Encrypts and authenticates gossip if set
+	Keyring *Keyring
+
+	packetConn *net.UDPConn
+	listener   net.Listener
+
+	lock         sync.Mutex
+	nextSequence uint32
+	pending      map[uint32]chan udpResult
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+var _ Transport = (*UDPTransport)(nil)
+
+const (
+	udpMessagePacket byte = 1
+	udpReplyPacket   byte = 2
+	udpErrorPacket   byte = 3
+
+	udpHeaderSize        = 5
+	defaultMaxPacketSize = 1400
+	maxTCPFrameSize      = 16 << 20
+)
+
+type udpResult struct {
+	packetType byte
+	payload    []byte
+}
+
+// Listens straight away, so that messages can be sent before Serve is called.
+// Replies are only received once Serve has been called.
+func NewUDPTransport(listenAddress string, serverTimeout time.Duration) (*UDPTransport, error) {
+	udpAddress, err := net.ResolveUDPAddr("udp", listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving listen address: %w", err)
+	}
+	packetConn, err := net.ListenUDP("udp", udpAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for UDP gossip: %w", err)
+	}
+	// Listens for TCP on the same port, even if the port was picked by the OS
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		packetConn.Close()
+		return nil, fmt.Errorf("error listening for TCP gossip: %w", err)
+	}
+	return &UDPTransport{
+		ListenAddress: packetConn.LocalAddr().String(),
+		MaxPacketSize: defaultMaxPacketSize,
+		ServerTimeout: serverTimeout,
+		packetConn:    packetConn,
+		listener:      listener,
+		pending:       map[uint32]chan udpResult{},
+		closed:        make(chan struct{}),
+	}, nil
+}
+
+func (t *UDPTransport) Serve(handle gossipHandler) error {
+	go t.serveTCP(handle)
+
+	buf := make([]byte, 65536)
+	for {
+		n, address, err := t.packetConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-t.closed:
+				return nil
+			default:
+				return fmt.Errorf("error receiving UDP gossip: %w", err)
+			}
+		}
+		t.received(n)
+		if n < udpHeaderSize {
+			warnLog.Println(fmt.Errorf("error: received UDP packet too short to be gossip from '%s'", address))
+			continue
+		}
+		packetType := buf[0]
+		sequence := binary.BigEndian.Uint32(buf[1:udpHeaderSize])
+		payload, err := t.open(buf[:udpHeaderSize], buf[udpHeaderSize:n])
+		if err != nil {
+			warnLog.Println(fmt.Errorf("error: rejected UDP packet from '%s': %w", address, err))
+			continue
+		}
+
+		switch packetType {
+		case udpMessagePacket:
+			go t.handlePacket(handle, sequence, payload, address)
+		case udpReplyPacket, udpErrorPacket:
+			t.lock.Lock()
+			result, ok := t.pending[sequence]
+			delete(t.pending, sequence)
+			t.lock.Unlock()
+			if ok {
+				result <- udpResult{packetType: packetType, payload: payload}
+			}
+		default:
+			warnLog.Println(fmt.Errorf("error: received UDP packet of unknown type %d from '%s'", packetType, address))
+		}
+	}
+}
+
+func (t *UDPTransport) handlePacket(handle gossipHandler, sequence uint32, payload []byte, address *net.UDPAddr) {
+	packetType, replyBytes := t.handleMessage(handle, payload)
+	// Replies must fit in one packet, so piggybacked user events, config
+	// entries, reachability reports and then updates are dropped until they do
+	for packetType == udpReplyPacket && t.packetSize(replyBytes) > t.MaxPacketSize {
+		reply, err := decodeGossipReply(replyBytes)
+		switch {
+		case err != nil:
+		case len(reply.Events) > 0:
+			reply.Events = reply.Events[:len(reply.Events)-1]
+		case len(reply.Config) > 0:
+			reply.Config = reply.Config[:len(reply.Config)-1]
+		case len(reply.Reachability) > 0:
+			reply.Reachability = reply.Reachability[:len(reply.Reachability)-1]
+		case len(reply.Updates) > 0:
+			reply.Updates = reply.Updates[:len(reply.Updates)-1]
+		default:
+			err = fmt.Errorf("reply too large for a UDP packet")
+		}
+		if err != nil {
+			packetType, replyBytes = udpErrorPacket, []byte(err.Error())
+			break
+		}
+		replyBytes = encodeGossipReply(reply)
+	}
+	if err := t.writePacket(packetType, sequence, replyBytes, address); err != nil {
+		errorLog.Println(fmt.Errorf("error sending reply: %w", err))
+	}
+}
+
+// Returns the packet type and payload to reply with
+func (t *UDPTransport) handleMessage(handle gossipHandler, payload []byte) (byte, []byte) {
+	message, err := decodeGossipMessage(payload)
+	if err != nil {
+		warnLog.Println(fmt.Errorf("error: rejected gossip message: %w", err))
+		return udpErrorPacket, []byte(err.Error())
+	}
+	reply, err := handle(message)
+	if err != nil {
+		warnLog.Println(fmt.Errorf("error: rejected gossip message: %w", err))
+		return udpErrorPacket, []byte(err.Error())
+	}
+	return udpReplyPacket, encodeGossipReply(reply)
+}
+
+func (t *UDPTransport) writePacket(packetType byte, sequence uint32, payload []byte, address *net.UDPAddr) error {
+	header := make([]byte, udpHeaderSize)
+	header[0] = packetType
+	binary.BigEndian.PutUint32(header[1:udpHeaderSize], sequence)
+	payload, err := t.seal(header, payload)
+	if err != nil {
+		return err
+	}
+	n, err := t.packetConn.WriteToUDP(append(header, payload...), address)
+	t.sent(n)
+	return err
+}
+
+// How large a packet carrying a payload will be, including encryption
+func (t *UDPTransport) packetSize(payload []byte) int {
+	if t.Keyring == nil {
+		return udpHeaderSize + len(payload)
+	}
+	return udpHeaderSize + encryptionOverhead + len(payload)
+}
+
+// Encrypts a payload if there is a keyring, unless the header starts with the
+// error packet type. The header is authenticated too.
+func (t *UDPTransport) seal(header, payload []byte) ([]byte, error) {
+	if t.Keyring == nil || header[0] == udpErrorPacket {
+		return payload, nil
+	}
+	return t.Keyring.encrypt(payload, header)
+}
+
+// Decrypts a payload sealed with the same header. Always returns a copy.
+func (t *UDPTransport) open(header, payload []byte) ([]byte, error) {
+	if t.Keyring == nil || header[0] == udpErrorPacket {
+		return append([]byte{}, payload...), nil
+	}
+	return t.Keyring.decrypt(payload, header)
+}
+
+func (t *UDPTransport) serveTCP(handle gossipHandler) {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.closed:
+			default:
+				errorLog.Println(fmt.Errorf("error accepting TCP gossip: %w", err))
+			}
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			countedConn := &countingConn{Conn: conn, counters: &t.transportCounters}
+			conn.SetDeadline(time.Now().Add(t.ServerTimeout))
+			payload, err := t.readTCPFrame(countedConn)
+			if err != nil {
+				warnLog.Println(fmt.Errorf("error reading TCP gossip: %w", err))
+				return
+			}
+			packetType, replyBytes := t.handleMessage(func(message *gossipMessage) (*gossipReply, error) {
+				conn.SetDeadline(time.Now().Add(replyTimeout(message, t.ServerTimeout)))
+				return handle(message)
+			}, payload)
+			if err = t.writeTCPFrame(countedConn, packetType, replyBytes); err != nil {
+				errorLog.Println(fmt.Errorf("error sending reply: %w", err))
+			}
+		}(conn)
+	}
+}
+
+func (t *UDPTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		err = t.packetConn.Close()
+		if listenerErr := t.listener.Close(); err == nil {
+			err = listenerErr
+		}
+	})
+	return err
+}
+
+func (t *UDPTransport) Send(nodeAddress string, message *gossipMessage, timeout time.Duration) (*gossipReply, error) {
+	messageBytes, err := encodeGossipMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	var result udpResult
+	if message.Kind == joinMessage || message.Kind == pushPullMessage || message.Kind == queryMessage || t.packetSize(messageBytes) > t.MaxPacketSize {
+		result, err = t.sendTCP(nodeAddress, messageBytes, timeout)
+	} else {
+		result, err = t.sendUDP(nodeAddress, messageBytes, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error sending gossip message to node at '%s': %w", nodeAddress, err)
+	}
+	if result.packetType == udpErrorPacket {
+		return nil, fmt.Errorf("gossip message was rejected by node at '%s': %s", nodeAddress, result.payload)
+	}
+
+	reply, err := decodeGossipReply(result.payload)
+	if err != nil {
+		return nil, err
+	}
+	if reply.NodeID == "" {
+		return nil, fmt.Errorf("gossip reply had no nodeid")
+	}
+	return reply, nil
+}
+
+func (t *UDPTransport) sendUDP(nodeAddress string, messageBytes []byte, timeout time.Duration) (udpResult, error) {
+	address, err := net.ResolveUDPAddr("udp", nodeAddress)
+	if err != nil {
+		return udpResult{}, fmt.Errorf("error resolving address: %w", err)
+	}
+
+	results := make(chan udpResult, 1)
+	t.lock.Lock()
+	sequence := t.nextSequence
+	t.nextSequence += 1
+	t.pending[sequence] = results
+	t.lock.Unlock()
+	defer func() {
+		t.lock.Lock()
+		delete(t.pending, sequence)
+		t.lock.Unlock()
+	}()
+
+	if err := t.writePacket(udpMessagePacket, sequence, messageBytes, address); err != nil {
+		return udpResult{}, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		return result, nil
+	case <-timer.C:
+		return udpResult{}, fmt.Errorf("timed out waiting for reply after %s", timeout)
+	case <-t.closed:
+		return udpResult{}, fmt.Errorf("transport closed")
+	}
+}
+
+func (t *UDPTransport) sendTCP(nodeAddress string, messageBytes []byte, timeout time.Duration) (udpResult, error) {
+	conn, err := net.DialTimeout("tcp", nodeAddress, timeout)
+	if err != nil {
+		return udpResult{}, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return udpResult{}, err
+	}
+
+	countedConn := &countingConn{Conn: conn, counters: &t.transportCounters}
+	if err = t.writeTCPFrame(countedConn, udpMessagePacket, messageBytes); err != nil {
+		return udpResult{}, err
+	}
+	packetType, payload, err := readTCPFrame(countedConn)
+	if err != nil {
+		return udpResult{}, err
+	}
+	if payload, err = t.open([]byte{packetType}, payload); err != nil {
+		return udpResult{}, err
+	}
+	return udpResult{packetType: packetType, payload: payload}, nil
+}
+
+// Over TCP, only the packet type is authenticated along with the payload
+func (t *UDPTransport) writeTCPFrame(w io.Writer, packetType byte, payload []byte) error {
+	payload, err := t.seal([]byte{packetType}, payload)
+	if err != nil {
+		return err
+	}
+	return writeTCPFrame(w, packetType, payload)
+}
+
+// Reads a message frame, which is all the server expects to receive
+func (t *UDPTransport) readTCPFrame(r io.Reader) ([]byte, error) {
+	packetType, payload, err := readTCPFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if packetType != udpMessagePacket {
+		return nil, fmt.Errorf("expected a message frame, got type %d", packetType)
+	}
+	return t.open([]byte{packetType}, payload)
+}
+
+func writeTCPFrame(w io.Writer, packetType byte, payload []byte) error {
+	frame := make([]byte, udpHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(1+len(payload)))
+	frame[4] = packetType
+	copy(frame[udpHeaderSize:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readTCPFrame(r io.Reader) (byte, []byte, error) {
+	var header [udpHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 1 || length > maxTCPFrameSize {
+		return 0, nil, fmt.Errorf("invalid frame length %d", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Applications can broadcast user events to the whole cluster. Events are
+// small named payloads, piggybacked on gossip like membership updates. Each
+// is stamped with a Lamport time, and nodes remember the events of the last
+// userEventBufferSize Lamport times, so that an event is delivered once however
+// many times it is received. Events at the same Lamport time with the same
+// name and payload are treated as the same event. Events older than the
+// buffer are dropped, as they can't be told apart from duplicates.
+
+const (
+	userEventBufferSize = 256
+	// Events are piggybacked on UDP packets, so they must be small
+	maxUserEventSize = 512
+)
+
+type UserEvent struct {
+	Name    string `yaml:"name"`
+	Payload []byte `yaml:"payload,omitempty"`
+	LTime   uint64 `yaml:"ltime"`
+	Origin  NodeID `yaml:"origin"`
+}
+
+// Must be used with the lock held
+type lamportClock struct {
+	counter uint64
+}
+
+func (c *lamportClock) increment() uint64 {
+	c.counter += 1
+	return c.counter
+}
+
+// Moves the clock past a time seen from another node
+func (c *lamportClock) witness(lTime uint64) {
+	if lTime >= c.counter {
+		c.counter = lTime + 1
+	}
+}
+
+type userEventSlot struct {
+	lTime  uint64
+	events []UserEvent
+}
+
+type userEvents struct {
+	clock       lamportClock
+	buffer      [userEventBufferSize]userEventSlot
+	broadcasts  transmitQueue
+	subscribers userEventSubscriberSet
+}
+
+type userEventSubscriberSet struct {
+	channels map[int]chan UserEvent
+	nextID   int
+}
+
+// Must be called with the lock held
+func (s *userEventSubscriberSet) add(channel chan UserEvent) func() {
+	if s.channels == nil {
+		s.channels = map[int]chan UserEvent{}
+	}
+	id := s.nextID
+	s.nextID += 1
+	s.channels[id] = channel
+	return func() {
+		if _, ok := s.channels[id]; ok {
+			delete(s.channels, id)
+			close(channel)
+		}
+	}
+}
+
+// Must be called with the lock held
+func (s *userEventSubscriberSet) publish(event UserEvent) int {
+	dropped := 0
+	for _, channel := range s.channels {
+		select {
+		case channel <- event:
+		default:
+			dropped += 1
+		}
+	}
+	return dropped
+}
+
+// UserEvent broadcasts an event to every node, including this one
+func (g *Gossip) UserEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("user events must have a name")
+	}
+	if size := len(name) + len(payload); size > maxUserEventSize {
+		return fmt.Errorf("user events must be at most %d bytes, got %d", maxUserEventSize, size)
+	}
+	g.Lock()
+	defer g.Unlock()
+	g.receiveUserEvent(UserEvent{
+		Name:    name,
+		Payload: append([]byte{}, payload...),
+		LTime:   g.userEvents.clock.increment(),
+		Origin:  g.Node.ID,
+	})
+	return nil
+}
+
+// SubscribeUserEvents returns a channel of user events, and a function to
+// unsubscribe. Events are dropped if the channel is full.
+func (g *Gossip) SubscribeUserEvents() (<-chan UserEvent, func()) {
+	events := make(chan UserEvent, 64)
+	g.Lock()
+	defer g.Unlock()
+	return events, g.unsubscriber(g.userEvents.subscribers.add(events))
+}
+
+// Must be called with the lock held
+func (g *Gossip) applyUserEvents(events []UserEvent) {
+	for _, event := range events {
+		g.userEvents.clock.witness(event.LTime)
+		g.receiveUserEvent(event)
+	}
+}
+
+// Must be called with the lock held. Delivers and gossips on events that
+// haven't been seen before.
+func (g *Gossip) receiveUserEvent(event UserEvent) {
+	if now := g.userEvents.clock.counter; now > userEventBufferSize && event.LTime <= now-userEventBufferSize {
+		debugLog.Printf("dropped user event '%s' at %d as too old to deduplicate\n", event.Name, event.LTime)
+		return
+	}
+	slot := &g.userEvents.buffer[event.LTime%userEventBufferSize]
+	if slot.lTime != event.LTime {
+		*slot = userEventSlot{lTime: event.LTime}
+	}
+	for _, seen := range slot.events {
+		if seen.Name == event.Name && bytes.Equal(seen.Payload, event.Payload) {
+			return
+		}
+	}
+	slot.events = append(slot.events, event)
+	// Events have no key, as no event supersedes another
+	g.userEvents.broadcasts.push("", event, len(event.Name)+len(event.Payload))
+	if dropped := g.userEvents.subscribers.publish(event); dropped > 0 {
+		warnLog.Printf("dropped user event '%s' as %d subscribers are not keeping up\n", event.Name, dropped)
+	}
+}
+
+// Must be called with the lock held. Works the same as piggybackedUpdates,
+// except that events stop being added once they reach maxUserEventSize in
+// total, so that they fit in a packet alongside other gossip.
+func (g *Gossip) piggybackedUserEvents() []UserEvent {
+	events := []UserEvent{}
+	for _, item := range g.userEvents.broadcasts.take(g.MaxPiggybackedUpdates, maxUserEventSize, g.retransmitLimit()) {
+		events = append(events, item.(UserEvent))
+	}
+	return events
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// Every node gossips each event on, so nodes receive it from several peers.
+// Once it has spread, some nodes gossip it again, as nodes that hadn't heard
+// of it would.
+func TestSimulatedUserEventsAreDeliveredOnce(t *testing.T) {
+	s := NewSimulation(newSimulationConfig(10))
+	expectConverged(t, s, "joining", 15)
+	var subscriptions []<-chan UserEvent
+	for _, node := range s.Nodes {
+		events, unsubscribe := node.SubscribeUserEvents()
+		defer unsubscribe()
+		subscriptions = append(subscriptions, events)
+	}
+
+	sent := []string{}
+	for _, event := range []struct {
+		node    int
+		payload string
+	}{
+		{0, "v1"},
+		{3, "v2"},
+		{5, "v3"},
+	} {
+		if err := s.Nodes[event.node].UserEvent("deploy", []byte(event.payload)); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, fmt.Sprintf("deploy %s from %s", event.payload, s.Nodes[event.node].Node.ID))
+	}
+	sort.Strings(sent)
+	for i := 0; i < 20; i++ {
+		s.Step()
+	}
+	for _, node := range s.Nodes[6:] {
+		node.Lock()
+		for _, slot := range node.userEvents.buffer {
+			for _, event := range slot.events {
+				node.userEvents.broadcasts.push("", event, len(event.Name)+len(event.Payload))
+			}
+		}
+		node.Unlock()
+	}
+	for i := 0; i < 20; i++ {
+		s.Step()
+	}
+
+	for i, events := range subscriptions {
+		received := []string{}
+		for len(events) > 0 {
+			event := <-events
+			received = append(received, fmt.Sprintf("%s %s from %s", event.Name, event.Payload, event.Origin))
+		}
+		sort.Strings(received)
+		if !equalNodeIDs(received, sent) {
+			t.Fatalf("expected node '%s' to receive each event once, got %v", s.Nodes[i].Node.ID, received)
+		}
+	}
+}